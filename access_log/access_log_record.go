@@ -18,6 +18,27 @@ type AccessLogRecord struct {
 	FirstByteAt   time.Time
 	FinishedAt    time.Time
 	BodyBytesSent int64
+	Attempts      int
+	RequestId     string
+
+	// The trace the request belongs to, and the router's span of it
+	TraceId string
+	SpanId  string
+
+	// The address of the client, when it is behind proxies and so differs
+	// from the remote address
+	ClientIp string
+
+	// Set when the response body was gzipped by the router, in which case
+	// BodyBytesSent counts the compressed bytes
+	Compressed            bool
+	UncompressedBodyBytes int64
+
+	// Which rate limit the request was rejected by, if any
+	RateLimited string
+
+	// Whether the response came from the cache, for routes that are cached
+	CacheStatus string
 }
 
 func (r *AccessLogRecord) FormatStartedAt() string {
@@ -32,6 +53,13 @@ func (r *AccessLogRecord) FormatRequestHeader(k string) (v string) {
 	return
 }
 
+func (r *AccessLogRecord) FormatRequestId() string {
+	if r.RequestId == "" {
+		return "-"
+	}
+	return r.RequestId
+}
+
 func (r *AccessLogRecord) ResponseTime() float64 {
 	return float64(r.FinishedAt.UnixNano()-r.StartedAt.UnixNano()) / float64(time.Second)
 }
@@ -52,7 +80,7 @@ func (r *AccessLogRecord) makeRecord() *bytes.Buffer {
 	fmt.Fprintf(b, `"%s" `, r.FormatRequestHeader("Referer"))
 	fmt.Fprintf(b, `"%s" `, r.FormatRequestHeader("User-Agent"))
 	fmt.Fprintf(b, `%s `, r.Request.RemoteAddr)
-	fmt.Fprintf(b, `vcap_request_id:%s `, r.FormatRequestHeader("X-Vcap-Request-Id"))
+	fmt.Fprintf(b, `vcap_request_id:%s `, r.FormatRequestId())
 
 	if r.ResponseTime() < 0 {
 		fmt.Fprintf(b, "response_time:MissingFinishedAt ")
@@ -66,6 +94,28 @@ func (r *AccessLogRecord) makeRecord() *bytes.Buffer {
 		fmt.Fprintf(b, `app_id:%s`, r.RouteEndpoint.ApplicationId)
 	}
 
+	fmt.Fprintf(b, ` attempts:%d`, r.Attempts)
+
+	if r.TraceId != "" {
+		fmt.Fprintf(b, ` trace_id:%s span_id:%s`, r.TraceId, r.SpanId)
+	}
+
+	if r.ClientIp != "" {
+		fmt.Fprintf(b, ` client_ip:%s`, r.ClientIp)
+	}
+
+	if r.Compressed {
+		fmt.Fprintf(b, ` uncompressed_body_bytes:%d`, r.UncompressedBodyBytes)
+	}
+
+	if r.CacheStatus != "" {
+		fmt.Fprintf(b, ` cache:%s`, r.CacheStatus)
+	}
+
+	if r.RateLimited != "" {
+		fmt.Fprintf(b, ` rate_limited:%s`, r.RateLimited)
+	}
+
 	fmt.Fprint(b, "\n")
 	return b
 }
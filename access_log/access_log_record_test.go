@@ -6,7 +6,6 @@ import (
 	"net/url"
 	"time"
 
-	router_http "github.com/cloudfoundry/gorouter/common/http"
 	"github.com/cloudfoundry/gorouter/route"
 )
 
@@ -24,13 +23,14 @@ func CompleteAccessLogRecord() AccessLogRecord {
 				Opaque: "http://example.com/request",
 			},
 			Header: http.Header{
-				"Referer":                       []string{"FakeReferer"},
-				"User-Agent":                    []string{"FakeUserAgent"},
-				router_http.VcapRequestIdHeader: []string{"abc-123-xyz-pdq"},
+				"Referer":    []string{"FakeReferer"},
+				"User-Agent": []string{"FakeUserAgent"},
 			},
 			RemoteAddr: "FakeRemoteAddr",
 		},
 		BodyBytesSent: 23,
+		Attempts:      2,
+		RequestId:     "abc-123-xyz-pdq",
 		Response: &http.Response{
 			StatusCode: 200,
 		},
@@ -55,11 +55,50 @@ func (s *AccessLogRecordSuite) TestMakeRecordWithAllValues(c *C) {
 		"FakeRemoteAddr " +
 		"vcap_request_id:abc-123-xyz-pdq " +
 		"response_time:60.000000000 " +
-		"app_id:FakeApplicationId\n"
+		"app_id:FakeApplicationId " +
+		"attempts:2\n"
 
 	c.Assert(record.makeRecord().String(), Equals, recordString)
 }
 
+func (s *AccessLogRecordSuite) TestMakeRecordWhenRateLimited(c *C) {
+	record := CompleteAccessLogRecord()
+	record.RateLimited = "route"
+
+	c.Check(record.makeRecord().String(), Matches, ".* attempts:2 rate_limited:route\n")
+}
+
+func (s *AccessLogRecordSuite) TestMakeRecordWhenCompressed(c *C) {
+	record := CompleteAccessLogRecord()
+	record.Compressed = true
+	record.UncompressedBodyBytes = 100
+
+	c.Check(record.makeRecord().String(), Matches, `.*" 200 23 ".* attempts:2 uncompressed_body_bytes:100\n`)
+}
+
+func (s *AccessLogRecordSuite) TestMakeRecordWithCacheStatus(c *C) {
+	record := CompleteAccessLogRecord()
+	record.CacheStatus = "hit"
+
+	c.Check(record.makeRecord().String(), Matches, ".* attempts:2 cache:hit\n")
+}
+
+func (s *AccessLogRecordSuite) TestMakeRecordWithClientIp(c *C) {
+	record := CompleteAccessLogRecord()
+	record.ClientIp = "1.2.3.4"
+
+	c.Check(record.makeRecord().String(), Matches, ".* attempts:2 client_ip:1.2.3.4\n")
+}
+
+func (s *AccessLogRecordSuite) TestMakeRecordWithTrace(c *C) {
+	record := CompleteAccessLogRecord()
+	record.TraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	record.SpanId = "00f067aa0ba902b7"
+	record.ClientIp = "1.2.3.4"
+
+	c.Check(record.makeRecord().String(), Matches, ".* attempts:2 trace_id:4bf92f3577b34da6a3ce929d0e0e4736 span_id:00f067aa0ba902b7 client_ip:1.2.3.4\n")
+}
+
 func (s *AccessLogRecordSuite) TestMakeRecordWithValuesMissing(c *C) {
 	record := AccessLogRecord{
 		Request: &http.Request{
@@ -88,7 +127,8 @@ func (s *AccessLogRecordSuite) TestMakeRecordWithValuesMissing(c *C) {
 		"FakeRemoteAddr " +
 		"vcap_request_id:- " +
 		"response_time:MissingFinishedAt " +
-		"app_id:MissingRouteEndpointApplicationId\n"
+		"app_id:MissingRouteEndpointApplicationId " +
+		"attempts:0\n"
 
 	c.Assert(record.makeRecord().String(), Equals, recordString)
 }
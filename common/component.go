@@ -27,6 +27,7 @@ type VcapComponent struct {
 	Varz        *Varz                     `json:"-"`
 	Healthz     *Healthz                  `json:"-"`
 	InfoRoutes  map[string]json.Marshaler `json:"-"`
+	AdminRoutes map[string]http.Handler   `json:"-"`
 	Logger      *steno.Logger             `json:"-"`
 
 	// These fields are automatically generated
@@ -135,10 +136,16 @@ func (c *VcapComponent) ListenAndServe() {
 	hs := http.NewServeMux()
 
 	hs.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		h := UpdateHealthz()
+
 		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
+		if h.IsDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
 
-		fmt.Fprintf(w, UpdateHealthz().Value())
+		fmt.Fprint(w, h.Value())
 	})
 
 	hs.HandleFunc("/varz", func(w http.ResponseWriter, req *http.Request) {
@@ -150,6 +157,7 @@ func (c *VcapComponent) ListenAndServe() {
 	})
 
 	for path, marshaler := range c.InfoRoutes {
+		marshaler := marshaler
 		hs.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
@@ -159,6 +167,10 @@ func (c *VcapComponent) ListenAndServe() {
 		})
 	}
 
+	for path, handler := range c.AdminRoutes {
+		hs.Handle(path, handler)
+	}
+
 	f := func(user, password string) bool {
 		return user == c.Credentials[0] && password == c.Credentials[1]
 	}
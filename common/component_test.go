@@ -88,6 +88,26 @@ func (s *ComponentSuite) TestInfoRouteAccessNonExistent(c *C) {
 	c.Check(code, Equals, 404)
 }
 
+func (s *ComponentSuite) TestAdminRoute(c *C) {
+	s.Component.AdminRoutes = map[string]http.Handler{
+		"/action": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}),
+	}
+	s.serveComponent(c)
+
+	req, err := http.NewRequest("POST", "http://"+s.Component.Host+"/action", nil)
+	c.Assert(err, IsNil)
+
+	code, _, _ := s.doGetRequest(c, req)
+	c.Check(code, Equals, 401)
+
+	req.SetBasicAuth("username", "password")
+
+	code, _, _ = s.doGetRequest(c, req)
+	c.Check(code, Equals, 202)
+}
+
 func (s *ComponentSuite) serveComponent(c *C) {
 	go s.Component.ListenAndServe()
 
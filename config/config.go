@@ -1,9 +1,15 @@
 package config
 
 import (
+	"crypto/x509"
+	"fmt"
 	vcap "github.com/cloudfoundry/gorouter/common"
+	"github.com/cloudfoundry/gorouter/route"
+	"html/template"
 	"io/ioutil"
 	"launchpad.net/goyaml"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -52,11 +58,253 @@ var defaultLoggregatorConfig = LoggregatorConfig{
 	Url: "",
 }
 
+type OutlierDetectionConfig struct {
+	// Zero disables outlier detection
+	ConsecutiveFailures       int "consecutive_failures"
+	BaseEjectionTimeInSeconds int "base_ejection_time"
+	MaxEjectionTimeInSeconds  int "max_ejection_time"
+	MaxEjectionPercent        int "max_ejection_percent"
+
+	// These fields are populated by the `Process` function.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+}
+
+var defaultOutlierDetectionConfig = OutlierDetectionConfig{
+	ConsecutiveFailures:       0,
+	BaseEjectionTimeInSeconds: 30,
+	MaxEjectionTimeInSeconds:  300,
+	MaxEjectionPercent:        50,
+}
+
+type CircuitBreakerConfig struct {
+	// Zero disables a limit; with neither set the circuit breaker is off
+	ErrorPercent   int "error_percent"
+	TimeoutPercent int "timeout_percent"
+
+	WindowInSeconds   int "window"
+	MinRequests       int "min_requests"
+	OpenTimeInSeconds int "open_time"
+
+	// Share of a route's endpoints whose circuit may be open at the same time
+	MaxOpenPercent int "max_open_percent"
+
+	// These fields are populated by the `Process` function.
+	Window   time.Duration "-"
+	OpenTime time.Duration "-"
+}
+
+var defaultCircuitBreakerConfig = CircuitBreakerConfig{
+	ErrorPercent:      0,
+	TimeoutPercent:    0,
+	WindowInSeconds:   10,
+	MinRequests:       20,
+	OpenTimeInSeconds: 30,
+	MaxOpenPercent:    50,
+}
+
+type HealthCheckConfig struct {
+	// Zero disables health checking
+	IntervalInSeconds  int    "interval"
+	TimeoutInSeconds   int    "timeout"
+	Path               string "path"
+	UnhealthyThreshold int    "unhealthy_threshold"
+	HealthyThreshold   int    "healthy_threshold"
+
+	// Share of a route's endpoints that may be taken out of rotation for
+	// failing their health checks
+	MaxUnhealthyPercent int "max_unhealthy_percent"
+
+	// These fields are populated by the `Process` function.
+	Interval time.Duration "-"
+	Timeout  time.Duration "-"
+}
+
+var defaultHealthCheckConfig = HealthCheckConfig{
+	IntervalInSeconds:  0,
+	TimeoutInSeconds:   5,
+	Path:               "",
+	UnhealthyThreshold: 2,
+	HealthyThreshold:   2,
+
+	MaxUnhealthyPercent: 50,
+}
+
+type TLSCertificateConfig struct {
+	CertFile string "cert_file"
+	KeyFile  string "key_file"
+}
+
+type TLSConfig struct {
+	// Zero disables the TLS listener
+	Port uint16 "port"
+
+	// Served when the server name sent by the client matches none of the
+	// other certificates
+	DefaultCertificate TLSCertificateConfig "default_certificate"
+
+	// Selected by the server name sent by the client (SNI)
+	Certificates []TLSCertificateConfig "certificates"
+
+	// Offers HTTP/2 to clients through ALPN
+	HTTP2 bool "http2"
+}
+
+var defaultTLSConfig = TLSConfig{
+	Port:  0,
+	HTTP2: true,
+}
+
+type ProxyProtocolConfig struct {
+	Enabled bool "enabled"
+
+	// Connections without a header are rejected
+	Required bool "required"
+
+	// Networks the header is accepted from; required when enabled
+	TrustedCIDRs []string "trusted_cidrs"
+
+	// Populated by the `Process` function
+	TrustedNets []*net.IPNet "-"
+}
+
+var defaultProxyProtocolConfig = ProxyProtocolConfig{
+	Enabled: false,
+}
+
+type GzipConfig struct {
+	Enabled bool "enabled"
+
+	// Responses are compressed when their media type is listed, either
+	// exactly or as a type with a wildcard subtype, such as "text/*";
+	// defaults to defaultGzipContentTypes
+	ContentTypes []string "content_types"
+
+	// Responses known to be smaller than this many bytes are sent as they
+	// are; those of unknown length are always compressed
+	MinSize int "min_size"
+
+	// From 1, the fastest, to 9, the best compression
+	Level int "level"
+}
+
+var defaultGzipConfig = GzipConfig{
+	Enabled: false,
+	MinSize: 1024,
+	Level:   6,
+}
+
+var defaultGzipContentTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type ResponseCacheConfig struct {
+	Enabled bool "enabled"
+
+	// Total size of the cached responses, and the size of the largest
+	// response that is cached, in bytes
+	MaxSize      int64 "max_size"
+	MaxEntrySize int64 "max_entry_size"
+
+	// Only routes registered with the response_cache tag set to "true" are
+	// cached; otherwise all routes are, unless their tag is "false"
+	OptIn bool "opt_in"
+}
+
+var defaultResponseCacheConfig = ResponseCacheConfig{
+	Enabled:      false,
+	MaxSize:      64 * 1024 * 1024,
+	MaxEntrySize: 1024 * 1024,
+}
+
+type RouteServicesConfig struct {
+	// Key that requests sent to route services are signed with; route
+	// services are disabled when empty
+	Secret string "secret"
+
+	// Still accepted on requests coming back from route services, so that
+	// the key can be changed without failing requests in flight
+	PreviousSecret string "previous_secret"
+
+	// How long route services have to send a request back
+	TimeoutInSeconds int "timeout"
+
+	// Populated by the `Process` function
+	Timeout time.Duration "-"
+}
+
+var defaultRouteServicesConfig = RouteServicesConfig{
+	TimeoutInSeconds: 60,
+}
+
+type StickySessionsConfig struct {
+	// Cookies that applications keep sessions with; defaults to
+	// defaultStickySessionCookieNames
+	CookieNames []string "cookie_names"
+
+	// Key the instance IDs in __VCAP_ID__ cookies are encrypted with, which
+	// must be the same on every router; the router does not start without
+	// one
+	Secret string "secret"
+
+	// Still accepted, so that the key can be changed without clients losing
+	// their sessions
+	PreviousSecret string "previous_secret"
+}
+
+var defaultStickySessionCookieNames = []string{"JSESSIONID"}
+
+type TracingConfig struct {
+	// Spans of sampled requests are sent to this Zipkin collector, such as
+	// http://zipkin:9411/api/v2/spans; none are sent when empty
+	ZipkinUrl string "zipkin_url"
+
+	// Name the router's spans are reported under
+	ServiceName string "service_name"
+
+	// Share of new traces that are sampled, between 0 and 1
+	SampleRate float64 "sample_rate"
+}
+
+var defaultTracingConfig = TracingConfig{
+	ServiceName: "gorouter",
+	SampleRate:  0.01,
+}
+
+type HeaderRulesConfig struct {
+	// Headers are removed first, then set, replacing any values they have,
+	// and then added to
+	Remove []string          "remove"
+	Set    map[string]string "set"
+	Add    map[string]string "add"
+}
+
+type HeaderRewriteConfig struct {
+	// Applied to the requests sent to endpoints, and to their responses
+	Request  HeaderRulesConfig "request"
+	Response HeaderRulesConfig "response"
+}
+
 type Config struct {
-	Status            StatusConfig      "status"
-	Nats              []NatsConfig      "nats"
-	Logging           LoggingConfig     "logging"
-	LoggregatorConfig LoggregatorConfig "loggregatorConfig"
+	Status            StatusConfig           "status"
+	Nats              []NatsConfig           "nats"
+	Logging           LoggingConfig          "logging"
+	LoggregatorConfig LoggregatorConfig      "loggregatorConfig"
+	OutlierDetection  OutlierDetectionConfig "outlier_detection"
+	CircuitBreaker    CircuitBreakerConfig   "circuit_breaker"
+	HealthCheck       HealthCheckConfig      "health_check"
+	TLS               TLSConfig              "tls"
+	ProxyProtocol     ProxyProtocolConfig    "proxy_protocol"
+	RateLimit         RateLimitsConfig       "rate_limit"
+	Gzip              GzipConfig             "gzip"
+	ResponseCache     ResponseCacheConfig    "response_cache"
+	RouteServices     RouteServicesConfig    "route_services"
+	StickySessions    StickySessionsConfig   "sticky_sessions"
+	Tracing           TracingConfig          "tracing"
 
 	Port       uint16 "port"
 	Index      uint   "index"
@@ -65,12 +313,58 @@ type Config struct {
 	TraceKey   string "trace_key"
 	AccessLog  string "access_log"
 
+	// Serves HTTP/2 without TLS to clients that start with the HTTP/2
+	// connection preface (h2c with prior knowledge)
+	H2C bool "h2c"
+
 	PublishStartMessageIntervalInSeconds int "publish_start_message_interval"
 	PruneStaleDropletsIntervalInSeconds  int "prune_stale_droplets_interval"
 	DropletStaleThresholdInSeconds       int "droplet_stale_threshold"
 	PublishActiveAppsIntervalInSeconds   int "publish_active_apps_interval"
 	StartResponseDelayIntervalInSeconds  int "start_response_delay_interval"
 	EndpointTimeoutInSeconds             int "endpoint_timeout"
+	EndpointIdleTimeoutInSeconds         int "endpoint_idle_timeout"
+	DrainWaitInSeconds                   int "drain_wait"
+	DrainTimeoutInSeconds                int "drain_timeout"
+
+	// Limits on clients: how long they have to send a request's headers and
+	// the whole request, and how long a kept-alive connection may wait for
+	// the next request; zero disables the request timeout
+	RequestHeaderTimeoutInSeconds int "request_header_timeout"
+	RequestTimeoutInSeconds       int "request_timeout"
+	IdleTimeoutInSeconds          int "idle_timeout"
+
+	// Zero uses the server's default of 1MB for headers, and allows bodies of
+	// any size; routes can set their own body limit with a tag
+	MaxHeaderBytes     int   "max_header_bytes"
+	MaxRequestBodySize int64 "max_request_body_size"
+
+	MaxIdleConnsPerEndpoint int "max_idle_conns_per_endpoint"
+	MaxRetries              int "max_retries"
+
+	LoadBalancingStrategy string "load_balancing_strategy"
+
+	// PEM bundle of the CAs that endpoints served over TLS, but not route
+	// services, are verified against; the system's CAs are used when empty
+	BackendCACertsFile string "backend_ca_certs"
+
+	// Templates of the error pages sent to clients, by the error they report
+	// in X-Cf-RouterError, such as unknown_route; "default" is used for
+	// errors without a template of their own
+	ErrorPages map[string]string "error_pages"
+
+	// Networks of the proxies in front of the router, whose forwarding
+	// headers tell the client's address and protocol; those of other peers
+	// are replaced. No peer is trusted when empty.
+	TrustedProxyCIDRs []string "trusted_proxies"
+
+	// Header that carries the ID of each request to endpoints, and back to
+	// the client; the IDs trusted proxies send in it are kept
+	RequestIdHeader string "request_id_header"
+
+	// Header rewrites by host, or by host pattern such as "*.example.com"
+	// for all hosts under a domain; routes can add their own with tags
+	HeaderRewrites map[string]HeaderRewriteConfig "header_rewrites"
 
 	// These fields are populated by the `Process` function.
 	PruneStaleDropletsInterval time.Duration
@@ -78,22 +372,73 @@ type Config struct {
 	PublishActiveAppsInterval  time.Duration
 	StartResponseDelayInterval time.Duration
 	EndpointTimeout            time.Duration
+	EndpointIdleTimeout        time.Duration
+	DrainWait                  time.Duration
+	DrainTimeout               time.Duration
+	RequestHeaderTimeout       time.Duration
+	RequestTimeout             time.Duration
+	IdleTimeout                time.Duration
+	BackendRootCAs             *x509.CertPool
+	ErrorTemplates             map[string]*template.Template
+	TrustedProxies             []*net.IPNet
 
 	Ip string
 }
 
+type RateLimitConfig struct {
+	// Zero disables the limit
+	RequestsPerSecond int "requests_per_second"
+
+	// Requests allowed in a burst above the sustained rate; defaults to the
+	// requests per second
+	Burst int "burst"
+}
+
+type RateLimitsConfig struct {
+	// Each route, and each application across its routes
+	Route RateLimitConfig "route"
+	App   RateLimitConfig "app"
+
+	// Each client address, across all routes
+	ClientIp RateLimitConfig "client_ip"
+}
+
 var defaultConfig = Config{
 	Status:            defaultStatusConfig,
 	Nats:              []NatsConfig{defaultNatsConfig},
 	Logging:           defaultLoggingConfig,
 	LoggregatorConfig: defaultLoggregatorConfig,
+	OutlierDetection:  defaultOutlierDetectionConfig,
+	CircuitBreaker:    defaultCircuitBreakerConfig,
+	HealthCheck:       defaultHealthCheckConfig,
+	TLS:               defaultTLSConfig,
+	ProxyProtocol:     defaultProxyProtocolConfig,
+	Gzip:              defaultGzipConfig,
+	ResponseCache:     defaultResponseCacheConfig,
+	RouteServices:     defaultRouteServicesConfig,
+	Tracing:           defaultTracingConfig,
 
 	Port:       8081,
 	Index:      0,
 	Pidfile:    "",
 	GoMaxProcs: 8,
 
-	EndpointTimeoutInSeconds: 60,
+	EndpointTimeoutInSeconds:     60,
+	EndpointIdleTimeoutInSeconds: 90,
+
+	// Long enough for load balancers to see a few failed heartbeats
+	DrainWaitInSeconds:    20,
+	DrainTimeoutInSeconds: 60,
+
+	RequestHeaderTimeoutInSeconds: 30,
+	IdleTimeoutInSeconds:          90,
+
+	MaxIdleConnsPerEndpoint: 100,
+	MaxRetries:              1,
+
+	RequestIdHeader: "X-Vcap-Request-Id",
+
+	LoadBalancingStrategy: route.RoundRobinStrategy,
 
 	PublishStartMessageIntervalInSeconds: 30,
 	PruneStaleDropletsIntervalInSeconds:  30,
@@ -118,6 +463,108 @@ func (c *Config) Process() {
 	c.PublishActiveAppsInterval = time.Duration(c.PublishActiveAppsIntervalInSeconds) * time.Second
 	c.StartResponseDelayInterval = time.Duration(c.StartResponseDelayIntervalInSeconds) * time.Second
 	c.EndpointTimeout = time.Duration(c.EndpointTimeoutInSeconds) * time.Second
+	c.EndpointIdleTimeout = time.Duration(c.EndpointIdleTimeoutInSeconds) * time.Second
+	c.DrainWait = time.Duration(c.DrainWaitInSeconds) * time.Second
+	c.DrainTimeout = time.Duration(c.DrainTimeoutInSeconds) * time.Second
+	c.RequestHeaderTimeout = time.Duration(c.RequestHeaderTimeoutInSeconds) * time.Second
+	c.RequestTimeout = time.Duration(c.RequestTimeoutInSeconds) * time.Second
+	c.IdleTimeout = time.Duration(c.IdleTimeoutInSeconds) * time.Second
+	c.OutlierDetection.BaseEjectionTime = time.Duration(c.OutlierDetection.BaseEjectionTimeInSeconds) * time.Second
+	c.OutlierDetection.MaxEjectionTime = time.Duration(c.OutlierDetection.MaxEjectionTimeInSeconds) * time.Second
+	c.CircuitBreaker.Window = time.Duration(c.CircuitBreaker.WindowInSeconds) * time.Second
+	c.CircuitBreaker.OpenTime = time.Duration(c.CircuitBreaker.OpenTimeInSeconds) * time.Second
+	c.HealthCheck.Interval = time.Duration(c.HealthCheck.IntervalInSeconds) * time.Second
+	c.HealthCheck.Timeout = time.Duration(c.HealthCheck.TimeoutInSeconds) * time.Second
+	c.RouteServices.Timeout = time.Duration(c.RouteServices.TimeoutInSeconds) * time.Second
+
+	if c.TLS.Port != 0 && (c.TLS.DefaultCertificate.CertFile == "" || c.TLS.DefaultCertificate.KeyFile == "") {
+		panic("tls: a default certificate is required")
+	}
+
+	for _, l := range []*RateLimitConfig{&c.RateLimit.Route, &c.RateLimit.App, &c.RateLimit.ClientIp} {
+		if l.Burst == 0 {
+			l.Burst = l.RequestsPerSecond
+		}
+	}
+
+	if len(c.Gzip.ContentTypes) == 0 {
+		c.Gzip.ContentTypes = defaultGzipContentTypes
+	}
+	if c.Gzip.Level < 1 || c.Gzip.Level > 9 {
+		panic(fmt.Sprintf("gzip: level must be between 1 and 9, not %d", c.Gzip.Level))
+	}
+
+	if c.Tracing.SampleRate < 0 || c.Tracing.SampleRate > 1 {
+		panic(fmt.Sprintf("tracing: sample_rate must be between 0 and 1, not %g", c.Tracing.SampleRate))
+	}
+
+	if len(c.StickySessions.CookieNames) == 0 {
+		c.StickySessions.CookieNames = defaultStickySessionCookieNames
+	}
+
+	if c.RequestIdHeader == "" {
+		c.RequestIdHeader = defaultConfig.RequestIdHeader
+	}
+
+	c.TrustedProxies = nil
+	for _, cidr := range c.TrustedProxyCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		c.TrustedProxies = append(c.TrustedProxies, n)
+	}
+
+	c.ProxyProtocol.TrustedNets = nil
+	for _, cidr := range c.ProxyProtocol.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		c.ProxyProtocol.TrustedNets = append(c.ProxyProtocol.TrustedNets, n)
+	}
+
+	if c.ProxyProtocol.Enabled && len(c.ProxyProtocol.TrustedNets) == 0 {
+		panic("proxy_protocol: trusted_cidrs are required")
+	}
+
+	if _, ok := route.Strategies[c.LoadBalancingStrategy]; !ok {
+		panic(fmt.Sprintf("unknown load balancing strategy: %s", c.LoadBalancingStrategy))
+	}
+
+	c.BackendRootCAs = nil
+	if c.BackendCACertsFile != "" {
+		pem, err := ioutil.ReadFile(c.BackendCACertsFile)
+		if err != nil {
+			panic(err)
+		}
+
+		c.BackendRootCAs = x509.NewCertPool()
+		if !c.BackendRootCAs.AppendCertsFromPEM(pem) {
+			panic(fmt.Sprintf("no certificates found in %s", c.BackendCACertsFile))
+		}
+	}
+
+	for host := range c.HeaderRewrites {
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			panic(fmt.Sprintf("header_rewrites: invalid host pattern: %s", host))
+		}
+	}
+
+	c.ErrorTemplates = nil
+	for name, file := range c.ErrorPages {
+		t, err := template.ParseFiles(file)
+		if err != nil {
+			panic(err)
+		}
+
+		if c.ErrorTemplates == nil {
+			c.ErrorTemplates = make(map[string]*template.Template)
+		}
+		c.ErrorTemplates[name] = t
+	}
 
 	c.Ip, err = vcap.LocalIP()
 	if err != nil {
@@ -127,6 +574,8 @@ func (c *Config) Process() {
 
 func (c *Config) Initialize(configYAML []byte) error {
 	c.Nats = []NatsConfig{}
+	c.Gzip.ContentTypes = nil
+	c.StickySessions.CookieNames = nil
 	return goyaml.Unmarshal(configYAML, &c)
 }
 
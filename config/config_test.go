@@ -1,8 +1,13 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+
 	. "launchpad.net/gocheck"
 	"time"
+
+	"github.com/cloudfoundry/gorouter/test_util"
 )
 
 type ConfigSuite struct {
@@ -46,6 +51,527 @@ endpoint_timeout: 10
 	c.Check(s.EndpointTimeoutInSeconds, Equals, 10)
 }
 
+func (s *ConfigSuite) TestEndpointKeepAlive(c *C) {
+	var b = []byte(`
+endpoint_idle_timeout: 30
+max_idle_conns_per_endpoint: 5
+`)
+
+	c.Check(s.EndpointIdleTimeout, Equals, 90*time.Second)
+	c.Check(s.MaxIdleConnsPerEndpoint, Equals, 100)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.EndpointIdleTimeout, Equals, 30*time.Second)
+	c.Check(s.MaxIdleConnsPerEndpoint, Equals, 5)
+}
+
+func (s *ConfigSuite) TestDrain(c *C) {
+	var b = []byte(`
+drain_wait: 5
+drain_timeout: 120
+`)
+
+	c.Check(s.DrainWait, Equals, 20*time.Second)
+	c.Check(s.DrainTimeout, Equals, 60*time.Second)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.DrainWait, Equals, 5*time.Second)
+	c.Check(s.DrainTimeout, Equals, 120*time.Second)
+}
+
+func (s *ConfigSuite) TestClientLimits(c *C) {
+	var b = []byte(`
+request_header_timeout: 10
+request_timeout: 300
+idle_timeout: 60
+max_header_bytes: 65536
+max_request_body_size: 10485760
+`)
+
+	c.Check(s.RequestHeaderTimeout, Equals, 30*time.Second)
+	c.Check(s.RequestTimeout, Equals, time.Duration(0))
+	c.Check(s.IdleTimeout, Equals, 90*time.Second)
+	c.Check(s.MaxHeaderBytes, Equals, 0)
+	c.Check(s.MaxRequestBodySize, Equals, int64(0))
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.RequestHeaderTimeout, Equals, 10*time.Second)
+	c.Check(s.RequestTimeout, Equals, 300*time.Second)
+	c.Check(s.IdleTimeout, Equals, 60*time.Second)
+	c.Check(s.MaxHeaderBytes, Equals, 65536)
+	c.Check(s.MaxRequestBodySize, Equals, int64(10485760))
+}
+
+func (s *ConfigSuite) TestLoadBalancingStrategy(c *C) {
+	var b = []byte(`
+load_balancing_strategy: least-connections
+`)
+
+	c.Check(s.LoadBalancingStrategy, Equals, "round-robin")
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.LoadBalancingStrategy, Equals, "least-connections")
+}
+
+func (s *ConfigSuite) TestOutlierDetection(c *C) {
+	var b = []byte(`
+outlier_detection:
+  consecutive_failures: 3
+  base_ejection_time: 10
+  max_ejection_time: 60
+  max_ejection_percent: 20
+`)
+
+	c.Check(s.OutlierDetection.ConsecutiveFailures, Equals, 0)
+	c.Check(s.OutlierDetection.BaseEjectionTime, Equals, 30*time.Second)
+	c.Check(s.OutlierDetection.MaxEjectionTime, Equals, 300*time.Second)
+	c.Check(s.OutlierDetection.MaxEjectionPercent, Equals, 50)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.OutlierDetection.ConsecutiveFailures, Equals, 3)
+	c.Check(s.OutlierDetection.BaseEjectionTime, Equals, 10*time.Second)
+	c.Check(s.OutlierDetection.MaxEjectionTime, Equals, 60*time.Second)
+	c.Check(s.OutlierDetection.MaxEjectionPercent, Equals, 20)
+}
+
+func (s *ConfigSuite) TestHealthCheck(c *C) {
+	var b = []byte(`
+health_check:
+  interval: 10
+  timeout: 2
+  path: /healthz
+  unhealthy_threshold: 3
+  healthy_threshold: 1
+  max_unhealthy_percent: 30
+`)
+
+	c.Check(s.HealthCheck.Interval, Equals, time.Duration(0))
+	c.Check(s.HealthCheck.Timeout, Equals, 5*time.Second)
+	c.Check(s.HealthCheck.Path, Equals, "")
+	c.Check(s.HealthCheck.MaxUnhealthyPercent, Equals, 50)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.HealthCheck.Interval, Equals, 10*time.Second)
+	c.Check(s.HealthCheck.Timeout, Equals, 2*time.Second)
+	c.Check(s.HealthCheck.Path, Equals, "/healthz")
+	c.Check(s.HealthCheck.UnhealthyThreshold, Equals, 3)
+	c.Check(s.HealthCheck.HealthyThreshold, Equals, 1)
+	c.Check(s.HealthCheck.MaxUnhealthyPercent, Equals, 30)
+}
+
+func (s *ConfigSuite) TestTLS(c *C) {
+	var b = []byte(`
+tls:
+  port: 443
+  default_certificate:
+    cert_file: /etc/router/default.crt
+    key_file: /etc/router/default.key
+  certificates:
+    - cert_file: /etc/router/example.crt
+      key_file: /etc/router/example.key
+`)
+
+	c.Check(s.TLS.Port, Equals, uint16(0))
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.TLS.Port, Equals, uint16(443))
+	c.Check(s.TLS.DefaultCertificate, Equals, TLSCertificateConfig{"/etc/router/default.crt", "/etc/router/default.key"})
+	c.Check(s.TLS.Certificates, DeepEquals, []TLSCertificateConfig{{"/etc/router/example.crt", "/etc/router/example.key"}})
+	c.Check(s.TLS.HTTP2, Equals, true)
+}
+
+func (s *ConfigSuite) TestHTTP2(c *C) {
+	var b = []byte(`
+tls:
+  http2: false
+h2c: true
+`)
+
+	c.Check(s.H2C, Equals, false)
+
+	s.Config.Initialize(b)
+
+	c.Check(s.TLS.HTTP2, Equals, false)
+	c.Check(s.H2C, Equals, true)
+}
+
+func (s *ConfigSuite) TestTLSWithoutDefaultCertificate(c *C) {
+	var b = []byte(`
+tls:
+  port: 443
+`)
+
+	s.Config.Initialize(b)
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, "tls: a default certificate is required")
+}
+
+func (s *ConfigSuite) TestProxyProtocol(c *C) {
+	var b = []byte(`
+proxy_protocol:
+  enabled: true
+  required: true
+  trusted_cidrs:
+    - 10.0.0.0/8
+    - fd00::/8
+`)
+
+	c.Check(s.ProxyProtocol.Enabled, Equals, false)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.ProxyProtocol.Enabled, Equals, true)
+	c.Check(s.ProxyProtocol.Required, Equals, true)
+	c.Assert(s.ProxyProtocol.TrustedNets, HasLen, 2)
+	c.Check(s.ProxyProtocol.TrustedNets[0].String(), Equals, "10.0.0.0/8")
+	c.Check(s.ProxyProtocol.TrustedNets[1].String(), Equals, "fd00::/8")
+}
+
+func (s *ConfigSuite) TestCircuitBreaker(c *C) {
+	var b = []byte(`
+circuit_breaker:
+  timeout_percent: 10
+  window: 5
+  open_time: 60
+  max_open_percent: 30
+`)
+
+	c.Check(s.CircuitBreaker.TimeoutPercent, Equals, 0)
+	c.Check(s.CircuitBreaker.MaxOpenPercent, Equals, 50)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.CircuitBreaker.ErrorPercent, Equals, 0)
+	c.Check(s.CircuitBreaker.TimeoutPercent, Equals, 10)
+	c.Check(s.CircuitBreaker.MinRequests, Equals, 20)
+	c.Check(s.CircuitBreaker.MaxOpenPercent, Equals, 30)
+	c.Check(s.CircuitBreaker.Window, Equals, 5*time.Second)
+	c.Check(s.CircuitBreaker.OpenTime, Equals, 60*time.Second)
+}
+
+func (s *ConfigSuite) TestRateLimit(c *C) {
+	var b = []byte(`
+rate_limit:
+  route:
+    requests_per_second: 100
+    burst: 200
+  client_ip:
+    requests_per_second: 10
+`)
+
+	c.Check(s.RateLimit.Route.RequestsPerSecond, Equals, 0)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.RateLimit.Route.RequestsPerSecond, Equals, 100)
+	c.Check(s.RateLimit.Route.Burst, Equals, 200)
+	c.Check(s.RateLimit.App.RequestsPerSecond, Equals, 0)
+	c.Check(s.RateLimit.ClientIp.RequestsPerSecond, Equals, 10)
+	c.Check(s.RateLimit.ClientIp.Burst, Equals, 10)
+}
+
+func (s *ConfigSuite) TestGzip(c *C) {
+	var b = []byte(`
+gzip:
+  enabled: true
+  content_types:
+    - text/html
+    - application/json
+  min_size: 256
+  level: 9
+`)
+
+	c.Check(s.Gzip.Enabled, Equals, false)
+	c.Check(s.Gzip.ContentTypes, HasLen, 5)
+	c.Check(s.Gzip.MinSize, Equals, 1024)
+	c.Check(s.Gzip.Level, Equals, 6)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.Gzip.Enabled, Equals, true)
+	c.Check(s.Gzip.ContentTypes, DeepEquals, []string{"text/html", "application/json"})
+	c.Check(s.Gzip.MinSize, Equals, 256)
+	c.Check(s.Gzip.Level, Equals, 9)
+}
+
+func (s *ConfigSuite) TestResponseCache(c *C) {
+	var b = []byte(`
+response_cache:
+  enabled: true
+  max_size: 1048576
+  opt_in: true
+`)
+
+	c.Check(s.ResponseCache.Enabled, Equals, false)
+	c.Check(s.ResponseCache.MaxSize, Equals, int64(64*1024*1024))
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.ResponseCache.Enabled, Equals, true)
+	c.Check(s.ResponseCache.MaxSize, Equals, int64(1024*1024))
+	c.Check(s.ResponseCache.MaxEntrySize, Equals, int64(1024*1024))
+	c.Check(s.ResponseCache.OptIn, Equals, true)
+}
+
+func (s *ConfigSuite) TestRouteServices(c *C) {
+	var b = []byte(`
+route_services:
+  secret: new-secret
+  previous_secret: old-secret
+  timeout: 30
+`)
+
+	c.Check(s.RouteServices.Secret, Equals, "")
+	c.Check(s.RouteServices.Timeout, Equals, 60*time.Second)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.RouteServices.Secret, Equals, "new-secret")
+	c.Check(s.RouteServices.PreviousSecret, Equals, "old-secret")
+	c.Check(s.RouteServices.Timeout, Equals, 30*time.Second)
+}
+
+func (s *ConfigSuite) TestStickySessions(c *C) {
+	var b = []byte(`
+sticky_sessions:
+  cookie_names:
+    - JSESSIONID
+    - PHPSESSID
+  secret: new-secret
+  previous_secret: old-secret
+`)
+
+	c.Check(s.StickySessions.CookieNames, DeepEquals, []string{"JSESSIONID"})
+	c.Check(s.StickySessions.Secret, Equals, "")
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.StickySessions.CookieNames, DeepEquals, []string{"JSESSIONID", "PHPSESSID"})
+	c.Check(s.StickySessions.Secret, Equals, "new-secret")
+	c.Check(s.StickySessions.PreviousSecret, Equals, "old-secret")
+}
+
+func (s *ConfigSuite) TestTracing(c *C) {
+	var b = []byte(`
+tracing:
+  zipkin_url: http://zipkin:9411/api/v2/spans
+  service_name: edge-router
+  sample_rate: 0.5
+`)
+
+	c.Check(s.Tracing.ZipkinUrl, Equals, "")
+	c.Check(s.Tracing.ServiceName, Equals, "gorouter")
+	c.Check(s.Tracing.SampleRate, Equals, 0.01)
+
+	s.Config.Initialize(b)
+
+	c.Check(s.Tracing.ZipkinUrl, Equals, "http://zipkin:9411/api/v2/spans")
+	c.Check(s.Tracing.ServiceName, Equals, "edge-router")
+	c.Check(s.Tracing.SampleRate, Equals, 0.5)
+}
+
+func (s *ConfigSuite) TestHeaderRewrites(c *C) {
+	var b = []byte(`
+header_rewrites:
+  "*.example.com":
+    request:
+      set:
+        X-Internal-Auth: secret
+    response:
+      remove:
+        - Server
+        - X-Powered-By
+      add:
+        Strict-Transport-Security: max-age=31536000
+`)
+
+	c.Check(s.HeaderRewrites, HasLen, 0)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	rewrite, ok := s.HeaderRewrites["*.example.com"]
+	c.Assert(ok, Equals, true)
+	c.Check(rewrite.Request.Set, DeepEquals, map[string]string{"X-Internal-Auth": "secret"})
+	c.Check(rewrite.Response.Remove, DeepEquals, []string{"Server", "X-Powered-By"})
+	c.Check(rewrite.Response.Add, DeepEquals, map[string]string{"Strict-Transport-Security": "max-age=31536000"})
+}
+
+func (s *ConfigSuite) TestHeaderRewritesWithInvalidPattern(c *C) {
+	var b = []byte(`
+header_rewrites:
+  "api.*.com":
+    request:
+      remove:
+        - X-Debug
+`)
+
+	s.Config.Initialize(b)
+	c.Check(func() { s.Config.Process() }, PanicMatches, "header_rewrites: invalid host pattern: api.\\*.com")
+}
+
+func (s *ConfigSuite) TestGzipWithInvalidLevel(c *C) {
+	var b = []byte(`
+gzip:
+  level: 10
+`)
+
+	s.Config.Initialize(b)
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, "gzip: level must be between 1 and 9, not 10")
+}
+
+func (s *ConfigSuite) TestTracingWithInvalidSampleRate(c *C) {
+	var b = []byte(`
+tracing:
+  sample_rate: 2
+`)
+
+	s.Config.Initialize(b)
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, "tracing: sample_rate must be between 0 and 1, not 2")
+}
+
+func (s *ConfigSuite) TestTrustedProxies(c *C) {
+	var b = []byte(`
+trusted_proxies:
+  - 10.0.0.0/8
+  - 192.168.0.0/16
+`)
+
+	c.Check(s.TrustedProxies, HasLen, 0)
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Assert(s.TrustedProxies, HasLen, 2)
+	c.Check(s.TrustedProxies[0].String(), Equals, "10.0.0.0/8")
+	c.Check(s.TrustedProxies[1].String(), Equals, "192.168.0.0/16")
+}
+
+func (s *ConfigSuite) TestRequestIdHeader(c *C) {
+	var b = []byte(`
+request_id_header: X-Request-Id
+`)
+
+	c.Check(s.RequestIdHeader, Equals, "X-Vcap-Request-Id")
+
+	s.Config.Initialize(b)
+	s.Config.Process()
+
+	c.Check(s.RequestIdHeader, Equals, "X-Request-Id")
+
+	s.Config.Initialize([]byte(`request_id_header: ""`))
+	s.Config.Process()
+
+	c.Check(s.RequestIdHeader, Equals, "X-Vcap-Request-Id")
+}
+
+func (s *ConfigSuite) TestProxyProtocolWithoutTrustedCIDRs(c *C) {
+	var b = []byte(`
+proxy_protocol:
+  enabled: true
+`)
+
+	s.Config.Initialize(b)
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, "proxy_protocol: trusted_cidrs are required")
+}
+
+func (s *ConfigSuite) TestProxyProtocolWithInvalidCIDR(c *C) {
+	var b = []byte(`
+proxy_protocol:
+  trusted_cidrs:
+    - 10.0.0.0
+`)
+
+	s.Config.Initialize(b)
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, ".*invalid CIDR address.*")
+}
+
+func (s *ConfigSuite) TestBackendCACerts(c *C) {
+	c.Check(s.BackendRootCAs, IsNil)
+
+	f, err := ioutil.TempFile("", "ca")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	certPEM, _ := test_util.CreateCertificate("ca.example.com")
+	f.Write(certPEM)
+	f.Close()
+
+	s.Config.Initialize([]byte("backend_ca_certs: " + f.Name()))
+	s.Config.Process()
+
+	c.Check(s.BackendRootCAs, NotNil)
+}
+
+func (s *ConfigSuite) TestBackendCACertsWithoutCertificates(c *C) {
+	f, err := ioutil.TempFile("", "ca")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	s.Config.Initialize([]byte("backend_ca_certs: " + f.Name()))
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, "no certificates found in .*")
+}
+
+func (s *ConfigSuite) TestErrorPages(c *C) {
+	c.Check(s.ErrorTemplates, IsNil)
+
+	f, err := ioutil.TempFile("", "error")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	f.WriteString("<h1>{{.Status}} {{.Message}}</h1>")
+	f.Close()
+
+	s.Config.Initialize([]byte("error_pages:\n  unknown_route: " + f.Name()))
+	s.Config.Process()
+
+	c.Assert(s.ErrorTemplates, HasLen, 1)
+	c.Check(s.ErrorTemplates["unknown_route"], NotNil)
+}
+
+func (s *ConfigSuite) TestErrorPagesWithMissingTemplate(c *C) {
+	s.Config.Initialize([]byte("error_pages:\n  default: /nonexistent/error.html"))
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, ".*no such file or directory")
+}
+
+func (s *ConfigSuite) TestUnknownLoadBalancingStrategy(c *C) {
+	var b = []byte(`
+load_balancing_strategy: fastest
+`)
+
+	s.Config.Initialize(b)
+
+	c.Check(func() { s.Config.Process() }, PanicMatches, "unknown load balancing strategy: fastest")
+}
+
 func (s *ConfigSuite) TestNats(c *C) {
 	var b = []byte(`
 nats:
@@ -0,0 +1,227 @@
+package healthcheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/log"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// Endpoints registered with this tag are probed at the given path instead of
+// the configured one.
+const PathTag = "health_check_path"
+
+type Registry interface {
+	Endpoints() []*route.Endpoint
+}
+
+type HealthChecker struct {
+	registry Registry
+
+	interval           time.Duration
+	timeout            time.Duration
+	path               string
+	unhealthyThreshold int
+	healthyThreshold   int
+
+	// CAs that endpoints served over TLS are verified against
+	rootCAs *x509.CertPool
+
+	// Only touched by Check
+	targets map[target]*targetState
+}
+
+// A target is probed once per check, however many routes its address is
+// registered for.
+type target struct {
+	addr string
+	path string
+
+	tls        bool
+	serverName string
+}
+
+type targetState struct {
+	healthy bool
+
+	// Consecutive probes contradicting the current state
+	count int
+}
+
+func NewHealthChecker(c *config.Config, registry Registry) *HealthChecker {
+	return &HealthChecker{
+		registry: registry,
+
+		interval:           c.HealthCheck.Interval,
+		timeout:            c.HealthCheck.Timeout,
+		path:               c.HealthCheck.Path,
+		unhealthyThreshold: c.HealthCheck.UnhealthyThreshold,
+		healthyThreshold:   c.HealthCheck.HealthyThreshold,
+
+		rootCAs: c.BackendRootCAs,
+
+		targets: make(map[target]*targetState),
+	}
+}
+
+// Start probes all endpoints every interval until the process exits. It does
+// nothing if no interval is configured.
+func (h *HealthChecker) Start() {
+	if h.interval == 0 {
+		return
+	}
+
+	go func() {
+		tick := time.Tick(h.interval)
+		for {
+			select {
+			case <-tick:
+				h.Check()
+			}
+		}
+	}()
+}
+
+// Check probes every endpoint that has a health check path once and updates
+// the endpoints whose health changed. It must not be called concurrently.
+func (h *HealthChecker) Check() {
+	endpointsByTarget := make(map[target][]*route.Endpoint)
+
+	for _, endpoint := range h.registry.Endpoints() {
+		path := h.pathFor(endpoint)
+		if path == "" {
+			continue
+		}
+
+		t := target{addr: endpoint.CanonicalAddr(), path: path}
+		if endpoint.TLS {
+			t.tls = true
+			t.serverName = endpoint.TLSServerName()
+		}
+
+		endpointsByTarget[t] = append(endpointsByTarget[t], endpoint)
+	}
+
+	// Forget targets that are gone
+	for t := range h.targets {
+		if _, ok := endpointsByTarget[t]; !ok {
+			delete(h.targets, t)
+		}
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	results := make(map[target]bool, len(endpointsByTarget))
+
+	for t := range endpointsByTarget {
+		wg.Add(1)
+
+		go func(t target) {
+			defer wg.Done()
+
+			ok := h.probe(t)
+
+			mutex.Lock()
+			results[t] = ok
+			mutex.Unlock()
+		}(t)
+	}
+
+	wg.Wait()
+
+	for t, ok := range results {
+		healthy := h.update(t, ok)
+
+		for _, endpoint := range endpointsByTarget[t] {
+			endpoint.SetHealthy(healthy)
+		}
+	}
+}
+
+func (h *HealthChecker) pathFor(endpoint *route.Endpoint) string {
+	path, ok := endpoint.Tags[PathTag]
+	if !ok {
+		path = h.path
+	}
+
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path
+}
+
+func (h *HealthChecker) probe(t target) bool {
+	transport := &http.Transport{DisableKeepAlives: true}
+	scheme := "http"
+
+	if t.tls {
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    h.rootCAs,
+			ServerName: t.serverName,
+		}
+		scheme = "https"
+	}
+
+	client := &http.Client{
+		Timeout:   h.timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(scheme + "://" + t.addr + t.path)
+	if err != nil {
+		return false
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// update records the outcome of a probe and returns whether the target is
+// now considered healthy.
+func (h *HealthChecker) update(t target, ok bool) bool {
+	state, found := h.targets[t]
+	if !found {
+		// New endpoints are given the benefit of the doubt
+		state = &targetState{healthy: true}
+		h.targets[t] = state
+	}
+
+	if ok == state.healthy {
+		state.count = 0
+		return state.healthy
+	}
+
+	state.count++
+
+	threshold := h.unhealthyThreshold
+	if !state.healthy {
+		threshold = h.healthyThreshold
+	}
+
+	if state.count < threshold {
+		return state.healthy
+	}
+
+	state.healthy = ok
+	state.count = 0
+
+	if ok {
+		log.Infof("Endpoint %s is healthy again, path: %s", t.addr, t.path)
+	} else {
+		log.Warnf("Endpoint %s is unhealthy, path: %s", t.addr, t.path)
+	}
+
+	return state.healthy
+}
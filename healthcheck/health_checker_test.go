@@ -0,0 +1,191 @@
+package healthcheck
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+type fakeRegistry struct {
+	endpoints []*route.Endpoint
+}
+
+func (r *fakeRegistry) Endpoints() []*route.Endpoint {
+	return r.endpoints
+}
+
+type HealthCheckerSuite struct {
+	registry *fakeRegistry
+	checker  *HealthChecker
+
+	sync.Mutex
+	status int
+	paths  []string
+
+	server *httptest.Server
+}
+
+var _ = Suite(&HealthCheckerSuite{})
+
+func (s *HealthCheckerSuite) SetUpTest(c *C) {
+	s.status = http.StatusOK
+	s.paths = []string{}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+
+		s.paths = append(s.paths, r.URL.Path)
+		w.WriteHeader(s.status)
+	}))
+
+	conf := config.DefaultConfig()
+	conf.HealthCheck.Path = "/health"
+	conf.HealthCheck.Timeout = 100 * time.Millisecond
+	conf.HealthCheck.UnhealthyThreshold = 2
+	conf.HealthCheck.HealthyThreshold = 3
+
+	s.registry = &fakeRegistry{}
+	s.checker = NewHealthChecker(conf, s.registry)
+}
+
+func (s *HealthCheckerSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *HealthCheckerSuite) endpointFor(addr string, tags map[string]string) *route.Endpoint {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic(err)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		panic(err)
+	}
+
+	return &route.Endpoint{Host: host, Port: uint16(p), Tags: tags}
+}
+
+func (s *HealthCheckerSuite) setStatus(status int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.status = status
+}
+
+func (s *HealthCheckerSuite) probedPaths() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.paths
+}
+
+func (s *HealthCheckerSuite) TestEndpointBecomesUnhealthyAndRecovers(c *C) {
+	endpoint := s.endpointFor(s.server.Listener.Addr().String(), nil)
+	s.registry.endpoints = []*route.Endpoint{endpoint}
+
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, true)
+
+	s.setStatus(http.StatusServiceUnavailable)
+
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, true)
+
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, false)
+
+	s.setStatus(http.StatusOK)
+
+	s.checker.Check()
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, false)
+
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, true)
+}
+
+func (s *HealthCheckerSuite) TestUnreachableEndpointBecomesUnhealthy(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	ln.Close()
+
+	endpoint := s.endpointFor(ln.Addr().String(), nil)
+	s.registry.endpoints = []*route.Endpoint{endpoint}
+
+	s.checker.Check()
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, false)
+}
+
+func (s *HealthCheckerSuite) TestPathTagOverridesConfiguredPath(c *C) {
+	endpoint := s.endpointFor(s.server.Listener.Addr().String(), map[string]string{PathTag: "status"})
+	s.registry.endpoints = []*route.Endpoint{endpoint}
+
+	s.checker.Check()
+	c.Check(s.probedPaths(), DeepEquals, []string{"/status"})
+}
+
+func (s *HealthCheckerSuite) TestAddressIsProbedOncePerPath(c *C) {
+	addr := s.server.Listener.Addr().String()
+	e1 := s.endpointFor(addr, nil)
+	e2 := s.endpointFor(addr, nil)
+	s.registry.endpoints = []*route.Endpoint{e1, e2}
+
+	s.setStatus(http.StatusInternalServerError)
+
+	s.checker.Check()
+	s.checker.Check()
+	c.Check(s.probedPaths(), DeepEquals, []string{"/health", "/health"})
+	c.Check(e1.Healthy(), Equals, false)
+	c.Check(e2.Healthy(), Equals, false)
+}
+
+func (s *HealthCheckerSuite) TestEndpointsWithoutPathAreNotProbed(c *C) {
+	conf := config.DefaultConfig()
+	s.checker = NewHealthChecker(conf, s.registry)
+
+	endpoint := s.endpointFor(s.server.Listener.Addr().String(), nil)
+	s.registry.endpoints = []*route.Endpoint{endpoint}
+
+	s.checker.Check()
+	c.Check(s.probedPaths(), HasLen, 0)
+}
+
+func (s *HealthCheckerSuite) TestTLSEndpointIsProbedOverTLS(c *C) {
+	server := httptest.NewTLSServer(s.server.Config.Handler)
+	defer server.Close()
+
+	conf := config.DefaultConfig()
+	conf.HealthCheck.Path = "/health"
+	conf.HealthCheck.UnhealthyThreshold = 1
+
+	conf.BackendRootCAs = x509.NewCertPool()
+	conf.BackendRootCAs.AddCert(server.Certificate())
+
+	s.checker = NewHealthChecker(conf, s.registry)
+
+	endpoint := s.endpointFor(server.Listener.Addr().String(), nil)
+	endpoint.TLS = true
+	endpoint.ServerName = "example.com"
+	s.registry.endpoints = []*route.Endpoint{endpoint}
+
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, true)
+	c.Check(s.probedPaths(), DeepEquals, []string{"/health"})
+
+	endpoint.ServerName = "other.com"
+
+	s.checker.Check()
+	c.Check(endpoint.Healthy(), Equals, false)
+}
@@ -0,0 +1,8 @@
+package healthcheck
+
+import (
+	. "launchpad.net/gocheck"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/cloudfoundry/gorouter/config"
 	"github.com/cloudfoundry/gorouter/log"
@@ -24,7 +27,28 @@ func main() {
 
 	log.SetupLoggerFromConfig(c)
 
-	router.NewRouter(c).Run()
+	r := router.NewRouter(c)
 
-	select {}
+	// SIGUSR1 drains the router before stopping it, other signals stop it
+	// right away; either way requests in flight are waited for. Signals are
+	// handled from the start, so that a router still connecting to NATS or
+	// waiting to listen stops cleanly as well.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				go r.Drain()
+			} else {
+				go r.Stop()
+			}
+		}
+	}()
+
+	go r.Run()
+
+	<-r.Stopped()
+
+	log.Infof("Stopped")
 }
@@ -44,3 +44,27 @@ func BenchmarkRegister(b *testing.B) {
 		)
 	}
 }
+
+func BenchmarkLookupWildcard(b *testing.B) {
+	c := config.DefaultConfig()
+	mbus := fakeyagnats.New()
+	r := registry.NewCFRegistry(c, mbus)
+
+	for i := 0; i < 100000; i++ {
+		str := strconv.Itoa(i)
+
+		r.Register(
+			route.Uri("*.bench"+str+".vcap.me"),
+			&route.Endpoint{
+				Host: "localhost",
+				Port: uint16(i),
+			},
+		)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.Lookup(route.Uri("tenant.bench" + strconv.Itoa(i%100000) + ".vcap.me/some/path"))
+	}
+}
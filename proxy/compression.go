@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compression gzips responses whose media type is in ContentTypes for
+// clients that accept it, unless the endpoint already encoded them. Responses
+// known to be smaller than MinSize bytes are sent as they are. No responses
+// are compressed when ContentTypes is empty.
+type Compression struct {
+	// Media types, such as "text/html", or types with a wildcard subtype,
+	// such as "text/*"
+	ContentTypes []string
+	MinSize      int64
+	Level        int
+}
+
+func (c Compression) enabled() bool {
+	return len(c.ContentTypes) > 0
+}
+
+// applies reports whether the response to request is to be compressed.
+func (c Compression) applies(request *http.Request, response *http.Response) bool {
+	if !c.enabled() || request.Method == "HEAD" || !acceptsGzip(request.Header) {
+		return false
+	}
+
+	switch {
+	case response.StatusCode < http.StatusOK,
+		response.StatusCode == http.StatusNoContent,
+		response.StatusCode == http.StatusPartialContent,
+		response.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	header := response.Header
+	if e := header.Get("Content-Encoding"); e != "" && !strings.EqualFold(e, "identity") {
+		return false
+	}
+	if hasToken(header.Get("Cache-Control"), "no-transform") || header.Get("Content-Range") != "" {
+		return false
+	}
+
+	if response.ContentLength >= 0 && response.ContentLength < c.MinSize {
+		return false
+	}
+
+	return c.compressible(header.Get("Content-Type"))
+}
+
+func (c Compression) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range c.ContentTypes {
+		t = strings.ToLower(t)
+		if t == mediaType {
+			return true
+		}
+
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsGzip reports whether the Accept-Encoding header lists gzip with a
+// non-zero quality.
+func acceptsGzip(header http.Header) bool {
+	for _, v := range header["Accept-Encoding"] {
+		for _, coding := range strings.Split(v, ",") {
+			params := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+				continue
+			}
+
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				if !strings.HasPrefix(p, "q=") {
+					continue
+				}
+
+				q, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil || q == 0 {
+					return false
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// gzipWriter compresses what is written to it into dst. Flushing it sends
+// everything written so far on to the client.
+type gzipWriter struct {
+	gz  *gzip.Writer
+	dst *countingWriter
+
+	// Set when there is data to flush; flushing the compressor writes a
+	// marker even when there is none
+	pending bool
+}
+
+func newGzipWriter(dst io.Writer, level int) *gzipWriter {
+	w := &gzipWriter{dst: &countingWriter{Writer: dst}}
+
+	gz, err := gzip.NewWriterLevel(w.dst, level)
+	if err != nil {
+		gz = gzip.NewWriter(w.dst)
+	}
+	w.gz = gz
+
+	return w
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	w.pending = true
+	return w.gz.Write(p)
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.pending {
+		return
+	}
+
+	w.gz.Flush()
+	w.pending = false
+
+	if f, ok := w.dst.Writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipWriter) Close() error {
+	return w.gz.Close()
+}
+
+// written returns the number of compressed bytes written to dst.
+func (w *gzipWriter) written() int64 {
+	return w.dst.n
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http"
+)
+
+type CompressionSuite struct {
+	compression Compression
+}
+
+var _ = Suite(&CompressionSuite{})
+
+func (s *CompressionSuite) SetUpTest(c *C) {
+	s.compression = Compression{
+		ContentTypes: []string{"text/*", "application/json"},
+		MinSize:      100,
+		Level:        6,
+	}
+}
+
+func (s *CompressionSuite) check(c *C, acceptEncoding string, response *http.Response, expected bool) {
+	request := &http.Request{Method: "GET", Header: make(http.Header)}
+	if acceptEncoding != "" {
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	c.Check(s.compression.applies(request, response), Equals, expected, Commentf("Accept-Encoding: %s, %v", acceptEncoding, response.Header))
+}
+
+func response(status int, contentLength int64, header ...string) *http.Response {
+	r := &http.Response{StatusCode: status, ContentLength: contentLength, Header: make(http.Header)}
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	return r
+}
+
+func (s *CompressionSuite) TestAcceptEncoding(c *C) {
+	r := response(http.StatusOK, 1000, "Content-Type", "text/html")
+
+	s.check(c, "gzip", r, true)
+	s.check(c, "deflate, GZIP;q=0.5", r, true)
+	s.check(c, "gzip;q=0", r, false)
+	s.check(c, "deflate", r, false)
+	s.check(c, "", r, false)
+}
+
+func (s *CompressionSuite) TestContentType(c *C) {
+	s.check(c, "gzip", response(http.StatusOK, 1000, "Content-Type", "text/css"), true)
+	s.check(c, "gzip", response(http.StatusOK, 1000, "Content-Type", "application/json; charset=utf-8"), true)
+	s.check(c, "gzip", response(http.StatusOK, 1000, "Content-Type", "application/javascript"), false)
+	s.check(c, "gzip", response(http.StatusOK, 1000, "Content-Type", "textual/html"), false)
+	s.check(c, "gzip", response(http.StatusOK, 1000), false)
+}
+
+func (s *CompressionSuite) TestSize(c *C) {
+	s.check(c, "gzip", response(http.StatusOK, 99, "Content-Type", "text/html"), false)
+	s.check(c, "gzip", response(http.StatusOK, 100, "Content-Type", "text/html"), true)
+	s.check(c, "gzip", response(http.StatusOK, -1, "Content-Type", "text/html"), true)
+}
+
+func (s *CompressionSuite) TestResponsesLeftAlone(c *C) {
+	s.check(c, "gzip", response(http.StatusOK, 1000, "Content-Type", "text/html", "Content-Encoding", "gzip"), false)
+	s.check(c, "gzip", response(http.StatusOK, 1000, "Content-Type", "text/html", "Cache-Control", "public, no-transform"), false)
+	s.check(c, "gzip", response(http.StatusPartialContent, 1000, "Content-Type", "text/html"), false)
+	s.check(c, "gzip", response(http.StatusNotModified, -1, "Content-Type", "text/html"), false)
+}
+
+func (s *CompressionSuite) TestDisabled(c *C) {
+	s.compression = Compression{}
+	s.check(c, "gzip", response(http.StatusOK, 1000, "Content-Type", "text/html"), false)
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// endpointTransports hands out one http.Transport per endpoint address, so
+// that the idle connections kept alive for an endpoint can be closed once the
+// endpoint goes away without disturbing connections to other endpoints.
+type endpointTransports struct {
+	sync.Mutex
+
+	responseHeaderTimeout time.Duration
+	maxIdleConns          int
+	idleTimeout           time.Duration
+
+	// CAs that endpoints served over TLS are verified against; the system's
+	// when nil
+	rootCAs *x509.CertPool
+
+	transports map[transportKey]*http.Transport
+}
+
+// Endpoints sharing an address may differ in whether and how they are
+// connected to over TLS
+type transportKey struct {
+	addr       string
+	tls        bool
+	serverName string
+}
+
+func newEndpointTransports(responseHeaderTimeout time.Duration, maxIdleConns int, idleTimeout time.Duration, rootCAs *x509.CertPool) *endpointTransports {
+	return &endpointTransports{
+		responseHeaderTimeout: responseHeaderTimeout,
+		maxIdleConns:          maxIdleConns,
+		idleTimeout:           idleTimeout,
+
+		rootCAs: rootCAs,
+
+		transports: make(map[transportKey]*http.Transport),
+	}
+}
+
+func (t *endpointTransports) get(endpoint *route.Endpoint) *http.Transport {
+	t.Lock()
+	defer t.Unlock()
+
+	key := transportKey{addr: endpoint.CanonicalAddr()}
+	if endpoint.TLS {
+		key.tls = true
+		key.serverName = endpoint.TLSServerName()
+	}
+
+	transport, ok := t.transports[key]
+	if !ok {
+		transport = &http.Transport{
+			ResponseHeaderTimeout: t.responseHeaderTimeout,
+			// A limit of zero disables keep-alive to endpoints
+			DisableKeepAlives:   t.maxIdleConns == 0,
+			MaxIdleConnsPerHost: t.maxIdleConns,
+			IdleConnTimeout:     t.idleTimeout,
+		}
+
+		if endpoint.TLS {
+			transport.TLSClientConfig = t.tlsConfig(endpoint)
+		}
+
+		t.transports[key] = transport
+	}
+
+	return transport
+}
+
+// dial opens a connection to the endpoint for forwarding raw TCP and
+// WebSocket traffic, over TLS if the endpoint requires it.
+func (t *endpointTransports) dial(endpoint *route.Endpoint) (net.Conn, error) {
+	if endpoint.TLS {
+		return tls.Dial("tcp", endpoint.CanonicalAddr(), t.tlsConfig(endpoint))
+	}
+
+	return net.Dial("tcp", endpoint.CanonicalAddr())
+}
+
+func (t *endpointTransports) tlsConfig(endpoint *route.Endpoint) *tls.Config {
+	return &tls.Config{
+		RootCAs:    t.rootCAs,
+		ServerName: endpoint.TLSServerName(),
+	}
+}
+
+func (t *endpointTransports) closeIdleConnections(endpoint *route.Endpoint) {
+	t.Lock()
+	defer t.Unlock()
+
+	addr := endpoint.CanonicalAddr()
+
+	for key, transport := range t.transports {
+		if key.addr != addr {
+			continue
+		}
+
+		transport.CloseIdleConnections()
+		delete(t.transports, key)
+	}
+}
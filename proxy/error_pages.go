@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// ErrorPage is what the templates of error pages are executed with.
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Message    string
+
+	// As reported in the X-Cf-RouterError header, such as unknown_route
+	RouterError string
+
+	RequestId string
+	Host      string
+}
+
+// The template used for errors without a template of their own
+const DefaultErrorPage = "default"
+
+type errorJSON struct {
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Message   string `json:"message"`
+	RequestId string `json:"request_id,omitempty"`
+}
+
+// renderErrorPage returns the body of an error response and its content type.
+// Clients that ask for JSON get JSON; others get the error's template, if
+// there is one, or else plain text.
+func renderErrorPage(templates map[string]*template.Template, accept string, page ErrorPage) (string, []byte, error) {
+	if prefersJSON(accept) {
+		b, err := json.Marshal(errorJSON{
+			Status:    page.Status,
+			Error:     page.RouterError,
+			Message:   page.Message,
+			RequestId: page.RequestId,
+		})
+		return "application/json", b, err
+	}
+
+	t, ok := templates[page.RouterError]
+	if !ok {
+		t, ok = templates[DefaultErrorPage]
+	}
+
+	if ok {
+		var b bytes.Buffer
+		if err := t.Execute(&b, page); err != nil {
+			return "", nil, err
+		}
+
+		return "text/html; charset=utf-8", b.Bytes(), nil
+	}
+
+	body := fmt.Sprintf("%d %s: %s\n", page.Status, page.StatusText, page.Message)
+	return "text/plain; charset=utf-8", []byte(body), nil
+}
+
+// prefersJSON reports whether the Accept header lists application/json, and
+// ranks it at least as high as HTML. Wildcards alone don't count, since
+// browsers send them too.
+func prefersJSON(accept string) bool {
+	var jsonQ, htmlQ float64
+
+	for _, r := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			jsonQ = q
+		case "text/html":
+			htmlQ = q
+		}
+	}
+
+	return jsonQ > 0 && jsonQ >= htmlQ
+}
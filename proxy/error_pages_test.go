@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	. "launchpad.net/gocheck"
+)
+
+type ErrorPagesSuite struct {
+	page ErrorPage
+}
+
+var _ = Suite(&ErrorPagesSuite{})
+
+func (s *ErrorPagesSuite) SetUpTest(c *C) {
+	s.page = ErrorPage{
+		Status:      404,
+		StatusText:  "Not Found",
+		Message:     "Requested route ('unknown') does not exist.",
+		RouterError: "unknown_route",
+		RequestId:   "some-request-id",
+		Host:        "unknown",
+	}
+}
+
+func (s *ErrorPagesSuite) TestPrefersJSON(c *C) {
+	c.Check(prefersJSON("application/json"), Equals, true)
+	c.Check(prefersJSON("application/json, text/plain"), Equals, true)
+	c.Check(prefersJSON("text/html;q=0.5, application/json"), Equals, true)
+	c.Check(prefersJSON("text/html, application/json;q=0.9"), Equals, false)
+	c.Check(prefersJSON("application/json;q=0"), Equals, false)
+	c.Check(prefersJSON("text/html,application/xhtml+xml,*/*;q=0.8"), Equals, false)
+	c.Check(prefersJSON("*/*"), Equals, false)
+	c.Check(prefersJSON(""), Equals, false)
+}
+
+func (s *ErrorPagesSuite) TestRendersPlainTextWithoutTemplates(c *C) {
+	contentType, body, err := renderErrorPage(nil, "text/html", s.page)
+	c.Assert(err, IsNil)
+	c.Check(contentType, Equals, "text/plain; charset=utf-8")
+	c.Check(string(body), Equals, "404 Not Found: Requested route ('unknown') does not exist.\n")
+}
+
+func (s *ErrorPagesSuite) TestRendersJSON(c *C) {
+	contentType, body, err := renderErrorPage(nil, "application/json", s.page)
+	c.Assert(err, IsNil)
+	c.Check(contentType, Equals, "application/json")
+
+	var e map[string]interface{}
+	c.Assert(json.Unmarshal(body, &e), IsNil)
+	c.Check(e["status"], Equals, 404.0)
+	c.Check(e["error"], Equals, "unknown_route")
+	c.Check(e["message"], Equals, "Requested route ('unknown') does not exist.")
+	c.Check(e["request_id"], Equals, "some-request-id")
+}
+
+func (s *ErrorPagesSuite) TestRendersTemplateOfError(c *C) {
+	templates := map[string]*template.Template{
+		"unknown_route":  template.Must(template.New("").Parse("<p>{{.Host}} is unknown ({{.RouterError}}, {{.RequestId}})</p>")),
+		DefaultErrorPage: template.Must(template.New("").Parse("<p>{{.Status}}</p>")),
+	}
+
+	contentType, body, err := renderErrorPage(templates, "text/html", s.page)
+	c.Assert(err, IsNil)
+	c.Check(contentType, Equals, "text/html; charset=utf-8")
+	c.Check(string(body), Equals, "<p>unknown is unknown (unknown_route, some-request-id)</p>")
+
+	s.page.RouterError = "endpoint_failure"
+	_, body, err = renderErrorPage(templates, "text/html", s.page)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, "<p>404</p>")
+}
+
+func (s *ErrorPagesSuite) TestTemplatesEscapeHTML(c *C) {
+	templates := map[string]*template.Template{
+		DefaultErrorPage: template.Must(template.New("").Parse("<p>{{.Host}}</p>")),
+	}
+
+	s.page.Host = "<script>"
+	_, body, err := renderErrorPage(templates, "", s.page)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, "<p>&lt;script&gt;</p>")
+}
+
+func (s *ErrorPagesSuite) TestReturnsTemplateErrors(c *C) {
+	templates := map[string]*template.Template{
+		DefaultErrorPage: template.Must(template.New("").Parse("{{.Missing}}")),
+	}
+
+	_, _, err := renderErrorPage(templates, "", s.page)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwarding describes where a request came from: the client, as told by the
+// trusted proxies the request passed through, and the request the client
+// sent them.
+type forwarding struct {
+	clientIp string
+
+	// The addresses the request was forwarded for, from the client's to that
+	// of the peer the router received it from
+	chain []string
+
+	proto string
+	host  string
+	port  string
+
+	// Elements of the Forwarded header added by the trusted proxies
+	elements []string
+
+	// The request as the router received it
+	receivedHost  string
+	receivedProto string
+}
+
+// newForwarding works out where the request came from. The forwarding headers
+// of peers that are not trusted are ignored, since clients can send any they
+// like; nor are the addresses a trusted proxy got from an untrusted one. No
+// peer is trusted when there are no trusted networks.
+func newForwarding(request *http.Request, trustedProxies []*net.IPNet) forwarding {
+	peer, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		peer = request.RemoteAddr
+	}
+
+	f := forwarding{
+		clientIp:      peer,
+		chain:         []string{peer},
+		proto:         "http",
+		host:          request.Host,
+		receivedHost:  request.Host,
+		receivedProto: "http",
+	}
+
+	if request.TLS != nil {
+		f.proto = "https"
+		f.receivedProto = "https"
+	}
+
+	if trusts(trustedProxies, peer) {
+		header := request.Header
+
+		f.elements = headerValues(header["Forwarded"])
+
+		upstream := headerValues(header["X-Forwarded-For"])
+		if len(upstream) == 0 {
+			for _, element := range f.elements {
+				if v, ok := forwardedParam(element, "for"); ok {
+					upstream = append(upstream, v)
+				}
+			}
+		}
+
+		chain := append(upstream, peer)
+
+		i := len(chain) - 1
+		for i > 0 && trusts(trustedProxies, chain[i]) {
+			i--
+		}
+
+		f.clientIp = chain[i]
+		f.chain = chain[i:]
+
+		// Each proxy adds one element, for the address it received the
+		// request from
+		if n := len(f.chain) - 1; len(f.elements) > n {
+			f.elements = f.elements[len(f.elements)-n:]
+		}
+
+		// Requests the router received over TLS are known to be secure
+		if request.TLS == nil {
+			if v := headerValues(header["X-Forwarded-Proto"]); len(v) > 0 {
+				f.proto = strings.ToLower(v[0])
+			} else if len(f.elements) > 0 {
+				if v, ok := forwardedParam(f.elements[0], "proto"); ok {
+					f.proto = strings.ToLower(v)
+				}
+			}
+		}
+
+		if v := headerValues(header["X-Forwarded-Host"]); len(v) > 0 {
+			f.host = v[0]
+		}
+
+		if v := headerValues(header["X-Forwarded-Port"]); len(v) > 0 {
+			f.port = v[0]
+		}
+	}
+
+	if f.port == "" {
+		f.port = "80"
+		if f.proto == "https" {
+			f.port = "443"
+		}
+
+		if _, port, err := net.SplitHostPort(f.host); err == nil {
+			f.port = port
+		}
+	}
+
+	return f
+}
+
+// setHeaders replaces the forwarding headers of the request with those
+// describing where it came from, adding the router's own Forwarded element.
+func (f forwarding) setHeaders(request *http.Request) {
+	header := request.Header
+
+	header.Set("X-Forwarded-For", strings.Join(f.chain, ", "))
+	header.Set("X-Forwarded-Proto", f.proto)
+	header.Set("X-Forwarded-Host", f.host)
+	header.Set("X-Forwarded-Port", f.port)
+
+	elements := f.elements
+	if len(elements) == 0 {
+		for _, addr := range f.chain[:len(f.chain)-1] {
+			elements = append(elements, "for="+forwardedNode(addr))
+		}
+	}
+
+	own := "for=" + forwardedNode(f.peer()) + ";host=" + quoteForwarded(f.receivedHost) + ";proto=" + f.receivedProto
+
+	header.Set("Forwarded", strings.Join(append(elements, own), ", "))
+}
+
+// peer returns the address the router received the request from.
+func (f forwarding) peer() string {
+	return f.chain[len(f.chain)-1]
+}
+
+func trusts(trustedProxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerValues returns the comma separated values of a header that may be
+// repeated.
+func headerValues(values []string) []string {
+	var all []string
+	for _, v := range values {
+		for _, value := range strings.Split(v, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				all = append(all, value)
+			}
+		}
+	}
+
+	return all
+}
+
+// forwardedParam returns the value of a parameter of a Forwarded header
+// element (RFC 7239, section 4), unquoted and, for node names, without
+// brackets or port.
+func forwardedParam(element, name string) (string, bool) {
+	for _, pair := range strings.Split(element, ";") {
+		i := strings.Index(pair, "=")
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(pair[:i]), name) {
+			continue
+		}
+
+		value := strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+		if name == "for" || name == "by" {
+			if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+			value = strings.Trim(value, "[]")
+		}
+
+		return value, true
+	}
+
+	return "", false
+}
+
+// forwardedNode formats an address as a node name of a Forwarded header
+// element; IPv6 addresses are bracketed and quoted.
+func forwardedNode(addr string) string {
+	if strings.Contains(addr, ":") {
+		return `"[` + addr + `]"`
+	}
+
+	return addr
+}
+
+func quoteForwarded(v string) string {
+	if strings.ContainsAny(v, `:;,=" `) {
+		return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+	}
+
+	return v
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	. "launchpad.net/gocheck"
+)
+
+type ForwardedSuite struct {
+	trusted []*net.IPNet
+}
+
+var _ = Suite(&ForwardedSuite{})
+
+func (s *ForwardedSuite) SetUpTest(c *C) {
+	s.trusted = nil
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, n, err := net.ParseCIDR(cidr)
+		c.Assert(err, IsNil)
+		s.trusted = append(s.trusted, n)
+	}
+}
+
+func forwardedRequest(remoteAddr string, header ...string) *http.Request {
+	r := &http.Request{Host: "app.example.com", RemoteAddr: remoteAddr, Header: make(http.Header)}
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Add(header[i], header[i+1])
+	}
+
+	return r
+}
+
+func (s *ForwardedSuite) TestIgnoresHeadersOfUntrustedPeers(c *C) {
+	f := newForwarding(forwardedRequest("1.2.3.4:5678",
+		"X-Forwarded-For", "6.6.6.6",
+		"X-Forwarded-Proto", "https",
+		"X-Forwarded-Host", "evil.example.com",
+		"X-Forwarded-Port", "8443",
+		"Forwarded", "for=6.6.6.6"), s.trusted)
+
+	c.Check(f.clientIp, Equals, "1.2.3.4")
+	c.Check(f.chain, DeepEquals, []string{"1.2.3.4"})
+	c.Check(f.proto, Equals, "http")
+	c.Check(f.host, Equals, "app.example.com")
+	c.Check(f.port, Equals, "80")
+	c.Check(f.elements, HasLen, 0)
+}
+
+func (s *ForwardedSuite) TestFindsClientBehindTrustedProxies(c *C) {
+	f := newForwarding(forwardedRequest("10.0.0.1:5678",
+		"X-Forwarded-For", "6.6.6.6, 1.2.3.4",
+		"X-Forwarded-For", "10.0.0.2",
+		"X-Forwarded-Proto", "HTTPS",
+		"X-Forwarded-Host", "www.example.com"), s.trusted)
+
+	c.Check(f.clientIp, Equals, "1.2.3.4")
+	c.Check(f.chain, DeepEquals, []string{"1.2.3.4", "10.0.0.2", "10.0.0.1"})
+	c.Check(f.proto, Equals, "https")
+	c.Check(f.host, Equals, "www.example.com")
+	c.Check(f.port, Equals, "443")
+}
+
+func (s *ForwardedSuite) TestUsesForwardedHeaderWithoutXForwardedFor(c *C) {
+	f := newForwarding(forwardedRequest("[fd00::1]:5678",
+		"Forwarded", `for=6.6.6.6, for="[2001:db8::1]:1234";proto=https, for=10.0.0.2`), s.trusted)
+
+	c.Check(f.clientIp, Equals, "2001:db8::1")
+	c.Check(f.chain, DeepEquals, []string{"2001:db8::1", "10.0.0.2", "fd00::1"})
+	c.Check(f.elements, DeepEquals, []string{`for="[2001:db8::1]:1234";proto=https`, "for=10.0.0.2"})
+	c.Check(f.proto, Equals, "https")
+}
+
+func (s *ForwardedSuite) TestTrustsNoPeerWithoutTrustedNetworks(c *C) {
+	f := newForwarding(forwardedRequest("10.0.0.1:5678",
+		"X-Forwarded-For", "5.6.7.8",
+		"X-Forwarded-Proto", "https"), nil)
+
+	c.Check(f.clientIp, Equals, "10.0.0.1")
+	c.Check(f.chain, DeepEquals, []string{"10.0.0.1"})
+	c.Check(f.proto, Equals, "http")
+}
+
+func (s *ForwardedSuite) TestTLSRequestsAreSecure(c *C) {
+	request := forwardedRequest("10.0.0.1:5678", "X-Forwarded-Proto", "http")
+	request.TLS = &tls.ConnectionState{}
+
+	f := newForwarding(request, s.trusted)
+	c.Check(f.proto, Equals, "https")
+	c.Check(f.receivedProto, Equals, "https")
+	c.Check(f.port, Equals, "443")
+}
+
+func (s *ForwardedSuite) TestTakesPortFromHost(c *C) {
+	request := forwardedRequest("1.2.3.4:5678")
+	request.Host = "app.example.com:8080"
+
+	c.Check(newForwarding(request, s.trusted).port, Equals, "8080")
+}
+
+func (s *ForwardedSuite) TestSetsHeaders(c *C) {
+	request := forwardedRequest("[fd00::1]:5678", "X-Forwarded-For", "2001:db8::1, 10.0.0.2")
+
+	newForwarding(request, s.trusted).setHeaders(request)
+
+	c.Check(request.Header.Get("X-Forwarded-For"), Equals, "2001:db8::1, 10.0.0.2, fd00::1")
+	c.Check(request.Header.Get("X-Forwarded-Proto"), Equals, "http")
+	c.Check(request.Header.Get("X-Forwarded-Host"), Equals, "app.example.com")
+	c.Check(request.Header.Get("X-Forwarded-Port"), Equals, "80")
+	c.Check(request.Header.Get("Forwarded"), Equals, `for="[2001:db8::1]", for=10.0.0.2, for="[fd00::1]";host=app.example.com;proto=http`)
+}
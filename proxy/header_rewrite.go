@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// Endpoints registered with tags named with these prefixes set, or add a
+// value to, the header named after the prefix on the requests sent to them or
+// on their responses. The remove tags list the headers to remove, separated by
+// commas.
+const (
+	SetRequestHeaderTagPrefix  = "set_request_header."
+	AddRequestHeaderTagPrefix  = "add_request_header."
+	RemoveRequestHeadersTag    = "remove_request_headers"
+	SetResponseHeaderTagPrefix = "set_response_header."
+	AddResponseHeaderTagPrefix = "add_response_header."
+	RemoveResponseHeadersTag   = "remove_response_headers"
+)
+
+// HeaderRules change the headers of a request or response: the headers in
+// Remove are removed first, then those in Set are overwritten, and finally
+// the values in Add are added to those already there.
+type HeaderRules struct {
+	Remove []string
+	Set    map[string]string
+	Add    map[string]string
+}
+
+func (r HeaderRules) apply(header http.Header) {
+	for _, name := range r.Remove {
+		header.Del(name)
+	}
+
+	for name, value := range r.Set {
+		header.Set(name, value)
+	}
+
+	for name, value := range r.Add {
+		header.Add(name, value)
+	}
+}
+
+// HeaderRewrite holds the rules for the requests sent to the endpoints of a
+// route, and for the responses they send back.
+type HeaderRewrite struct {
+	Request  HeaderRules
+	Response HeaderRules
+}
+
+// HeaderRewrites holds rewrites by lower case host, or by host pattern such as
+// "*.example.com" for all hosts under a domain. A host's own rewrite is used
+// over that of a pattern, and the pattern for the closest domain is used over
+// those for the domains above it.
+type HeaderRewrites map[string]HeaderRewrite
+
+func (r HeaderRewrites) lookup(host string) (HeaderRewrite, bool) {
+	host = strings.ToLower(host)
+
+	if rewrite, ok := r[host]; ok {
+		return rewrite, true
+	}
+
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+
+		if rewrite, ok := r["*."+host]; ok {
+			return rewrite, true
+		}
+	}
+
+	return HeaderRewrite{}, false
+}
+
+// tagHeaderRewrite returns the rewrite the endpoint's tags ask for.
+func tagHeaderRewrite(endpoint *route.Endpoint) (HeaderRewrite, bool) {
+	var rewrite HeaderRewrite
+	found := false
+
+	for name, value := range endpoint.Tags {
+		switch {
+		case strings.HasPrefix(name, SetRequestHeaderTagPrefix):
+			rewrite.Request.Set = addRule(rewrite.Request.Set, name[len(SetRequestHeaderTagPrefix):], value)
+		case strings.HasPrefix(name, AddRequestHeaderTagPrefix):
+			rewrite.Request.Add = addRule(rewrite.Request.Add, name[len(AddRequestHeaderTagPrefix):], value)
+		case name == RemoveRequestHeadersTag:
+			rewrite.Request.Remove = headerList(value)
+		case strings.HasPrefix(name, SetResponseHeaderTagPrefix):
+			rewrite.Response.Set = addRule(rewrite.Response.Set, name[len(SetResponseHeaderTagPrefix):], value)
+		case strings.HasPrefix(name, AddResponseHeaderTagPrefix):
+			rewrite.Response.Add = addRule(rewrite.Response.Add, name[len(AddResponseHeaderTagPrefix):], value)
+		case name == RemoveResponseHeadersTag:
+			rewrite.Response.Remove = headerList(value)
+		default:
+			continue
+		}
+
+		found = true
+	}
+
+	return rewrite, found
+}
+
+func addRule(rules map[string]string, name, value string) map[string]string {
+	if rules == nil {
+		rules = make(map[string]string)
+	}
+
+	rules[name] = value
+	return rules
+}
+
+func headerList(v string) []string {
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/cloudfoundry/gorouter/route"
+	. "launchpad.net/gocheck"
+)
+
+type HeaderRewriteSuite struct{}
+
+var _ = Suite(&HeaderRewriteSuite{})
+
+func (s *HeaderRewriteSuite) TestAppliesRules(c *C) {
+	header := make(http.Header)
+	header.Set("Server", "nginx")
+	header.Set("X-Frame-Options", "SAMEORIGIN")
+	header.Set("Cache-Control", "no-cache")
+
+	HeaderRules{
+		Remove: []string{"server"},
+		Set:    map[string]string{"X-Frame-Options": "DENY"},
+		Add:    map[string]string{"Cache-Control": "no-transform"},
+	}.apply(header)
+
+	c.Check(header.Get("Server"), Equals, "")
+	c.Check(header["X-Frame-Options"], DeepEquals, []string{"DENY"})
+	c.Check(header["Cache-Control"], DeepEquals, []string{"no-cache", "no-transform"})
+}
+
+func (s *HeaderRewriteSuite) TestLooksUpMostSpecificHost(c *C) {
+	rewrites := HeaderRewrites{
+		"api.example.com":   HeaderRewrite{Request: HeaderRules{Remove: []string{"api"}}},
+		"*.api.example.com": HeaderRewrite{Request: HeaderRules{Remove: []string{"api-wildcard"}}},
+		"*.example.com":     HeaderRewrite{Request: HeaderRules{Remove: []string{"wildcard"}}},
+	}
+
+	for host, expected := range map[string]string{
+		"api.example.com":    "api",
+		"API.Example.com":    "api",
+		"v1.api.example.com": "api-wildcard",
+		"www.example.com":    "wildcard",
+		"a.b.example.com":    "wildcard",
+	} {
+		rewrite, ok := rewrites.lookup(host)
+		c.Assert(ok, Equals, true, Commentf("host: %s", host))
+		c.Check(rewrite.Request.Remove, DeepEquals, []string{expected}, Commentf("host: %s", host))
+	}
+
+	_, ok := rewrites.lookup("example.com")
+	c.Check(ok, Equals, false)
+
+	_, ok = rewrites.lookup("example.org")
+	c.Check(ok, Equals, false)
+}
+
+func (s *HeaderRewriteSuite) TestTagHeaderRewrite(c *C) {
+	endpoint := &route.Endpoint{Tags: map[string]string{
+		"component":                            "app",
+		SetRequestHeaderTagPrefix + "X-Auth":   "token",
+		AddRequestHeaderTagPrefix + "Via":      "router",
+		RemoveRequestHeadersTag:                "X-Debug, X-Trace",
+		SetResponseHeaderTagPrefix + "X-Frame": "DENY",
+		AddResponseHeaderTagPrefix + "Vary":    "Origin",
+		RemoveResponseHeadersTag:               "Server",
+	}}
+
+	rewrite, ok := tagHeaderRewrite(endpoint)
+	c.Assert(ok, Equals, true)
+	c.Check(rewrite.Request.Set, DeepEquals, map[string]string{"X-Auth": "token"})
+	c.Check(rewrite.Request.Add, DeepEquals, map[string]string{"Via": "router"})
+	c.Check(rewrite.Request.Remove, DeepEquals, []string{"X-Debug", "X-Trace"})
+	c.Check(rewrite.Response.Set, DeepEquals, map[string]string{"X-Frame": "DENY"})
+	c.Check(rewrite.Response.Add, DeepEquals, map[string]string{"Vary": "Origin"})
+	c.Check(rewrite.Response.Remove, DeepEquals, []string{"Server"})
+
+	_, ok = tagHeaderRewrite(&route.Endpoint{Tags: map[string]string{"component": "app"}})
+	c.Check(ok, Equals, false)
+}
@@ -1,9 +1,14 @@
 package proxy
 
 import (
+	"crypto/x509"
+	"html/template"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	steno "github.com/cloudfoundry/gosteno"
@@ -18,51 +23,214 @@ const (
 	StickyCookieKey = "JSESSIONID"
 )
 
+// Endpoints registered with these tags override the configured rate limits,
+// in requests per second, of their route and of their application.
+const (
+	RouteRateLimitTag = "rate_limit"
+	AppRateLimitTag   = "app_rate_limit"
+)
+
+// Endpoints registered with this tag override the configured limit on the
+// size of request bodies to their route, in bytes.
+const MaxRequestBodySizeTag = "max_request_body_size"
+
 type LookupRegistry interface {
 	Lookup(uri route.Uri) (*route.Endpoint, bool)
+	LookupExcept(uri route.Uri, excluded ...*route.Endpoint) (*route.Endpoint, bool)
 	LookupByPrivateInstanceId(uri route.Uri, p string) (*route.Endpoint, bool)
+	RouteUri(uri route.Uri) (route.Uri, bool)
 }
 
 type Reporter interface {
 	CaptureBadRequest(req *http.Request)
 	CaptureBadGateway(req *http.Request)
+	CaptureRetry(b *route.Endpoint, req *http.Request)
+	CaptureEndpointEjection(b *route.Endpoint)
+	CaptureRateLimited(b *route.Endpoint, req *http.Request)
+	CaptureRejectedRequest(status int)
+	CaptureCacheHit(b *route.Endpoint, req *http.Request)
+	CaptureCacheMiss(b *route.Endpoint, req *http.Request)
+	CaptureCacheEviction()
 	CaptureRoutingRequest(b *route.Endpoint, req *http.Request)
 	CaptureRoutingResponse(b *route.Endpoint, res *http.Response, t time.Time, d time.Duration)
 }
 
 type Proxy interface {
 	ServeHTTP(responseWriter http.ResponseWriter, request *http.Request)
+	CloseIdleConnections(endpoint *route.Endpoint)
+	Drain()
 }
 
 type ProxyArgs struct {
-	EndpointTimeout time.Duration
-	Ip              string
-	TraceKey        string
-	Registry        LookupRegistry
-	Reporter        Reporter
-	Logger          access_log.AccessLogger
+	EndpointTimeout         time.Duration
+	EndpointIdleTimeout     time.Duration
+	MaxIdleConnsPerEndpoint int
+	MaxRetries              int
+	BackendRootCAs          *x509.CertPool
+	Ip                      string
+	TraceKey                string
+	RouteRateLimit          RateLimit
+	AppRateLimit            RateLimit
+	ClientIpRateLimit       RateLimit
+	MaxRequestBodySize      int64
+	Compression             Compression
+	ResponseCaching         ResponseCaching
+	ErrorTemplates          map[string]*template.Template
+	RouteServices           RouteServices
+	HeaderRewrites          HeaderRewrites
+	TrustedProxies          []*net.IPNet
+	RequestIdHeader         string
+	StickySessions          StickySessions
+	SpanExporter            SpanExporter
+	TraceSampleRate         float64
+	Registry                LookupRegistry
+	Reporter                Reporter
+	Logger                  access_log.AccessLogger
 }
 
 type proxy struct {
 	ip           string
 	traceKey     string
+	maxRetries   int
 	logger       *steno.Logger
 	registry     LookupRegistry
 	reporter     Reporter
 	accessLogger access_log.AccessLogger
-	transport    *http.Transport
+	transports   *endpointTransports
+
+	// Route services are verified against the system's CAs, as
+	// BackendRootCAs are only meant for endpoints
+	routeServiceTransports *endpointTransports
+
+	routeRateLimit    RateLimit
+	appRateLimit      RateLimit
+	clientIpRateLimit RateLimit
+
+	routeRateLimiter    *rateLimiter
+	appRateLimiter      *rateLimiter
+	clientIpRateLimiter *rateLimiter
+
+	maxRequestBodySize int64
+	compression        Compression
+
+	caching ResponseCaching
+	cache   *responseCache // nil when disabled
+
+	errorTemplates map[string]*template.Template
+	routeServices  RouteServices
+	headerRewrites HeaderRewrites
+	trustedProxies []*net.IPNet
+
+	requestIdHeader string
+	stickySessions  StickySessions
+	spanExporter    SpanExporter // nil when spans are not exported
+	traceSampleRate float64
+
+	draining int32 // accessed atomically
 }
 
 func NewProxy(args ProxyArgs) Proxy {
-	return &proxy{
+	p := &proxy{
 		accessLogger: args.Logger,
 		traceKey:     args.TraceKey,
+		maxRetries:   args.MaxRetries,
 		ip:           args.Ip,
 		logger:       steno.NewLogger("router.proxy"),
 		registry:     args.Registry,
 		reporter:     args.Reporter,
-		transport:    &http.Transport{ResponseHeaderTimeout: args.EndpointTimeout},
+		transports:   newEndpointTransports(args.EndpointTimeout, args.MaxIdleConnsPerEndpoint, args.EndpointIdleTimeout, args.BackendRootCAs),
+
+		routeServiceTransports: newEndpointTransports(args.EndpointTimeout, args.MaxIdleConnsPerEndpoint, args.EndpointIdleTimeout, nil),
+
+		routeRateLimit:    args.RouteRateLimit,
+		appRateLimit:      args.AppRateLimit,
+		clientIpRateLimit: args.ClientIpRateLimit,
+
+		routeRateLimiter:    newRateLimiter(),
+		appRateLimiter:      newRateLimiter(),
+		clientIpRateLimiter: newRateLimiter(),
+
+		maxRequestBodySize: args.MaxRequestBodySize,
+		compression:        args.Compression,
+
+		caching: args.ResponseCaching,
+
+		errorTemplates: args.ErrorTemplates,
+		routeServices:  args.RouteServices,
+		headerRewrites: args.HeaderRewrites,
+		trustedProxies: args.TrustedProxies,
+		spanExporter:   args.SpanExporter,
+
+		requestIdHeader: args.RequestIdHeader,
+		traceSampleRate: args.TraceSampleRate,
+		stickySessions:  args.StickySessions,
+	}
+
+	if p.requestIdHeader == "" {
+		p.requestIdHeader = router_http.VcapRequestIdHeader
+	}
+	if len(p.stickySessions.CookieNames) == 0 {
+		p.stickySessions.CookieNames = []string{StickyCookieKey}
 	}
+
+	if p.caching.enabled() {
+		p.cache = newResponseCache(p.caching, p.reporter.CaptureCacheEviction)
+	}
+
+	return p
+}
+
+// exportSpan sends the router's span of a sampled request to the exporter.
+// Load balancer heartbeats are not traced.
+func (p *proxy) exportSpan(trace traceContext, path string, accessLog access_log.AccessLogRecord) {
+	request := accessLog.Request
+	if p.spanExporter == nil || !trace.sampled || isLoadBalancerHeartbeat(request) {
+		return
+	}
+
+	finishedAt := accessLog.FinishedAt
+	if finishedAt.IsZero() {
+		finishedAt = time.Now()
+	}
+
+	tags := map[string]string{
+		"http.method": request.Method,
+		"http.host":   request.Host,
+		"http.path":   path,
+	}
+
+	if accessLog.Response != nil {
+		tags["http.status_code"] = strconv.Itoa(accessLog.Response.StatusCode)
+	}
+
+	if endpoint := accessLog.RouteEndpoint; endpoint != nil {
+		tags["app_id"] = endpoint.ApplicationId
+		tags["endpoint"] = endpoint.CanonicalAddr()
+	}
+
+	p.spanExporter.Export(Span{
+		TraceId:  trace.traceId,
+		Id:       trace.spanId,
+		ParentId: trace.parentSpanId,
+		Name:     strings.ToLower(request.Method),
+		Start:    accessLog.StartedAt,
+		Duration: finishedAt.Sub(accessLog.StartedAt),
+		Tags:     tags,
+	})
+}
+
+func (p *proxy) CloseIdleConnections(endpoint *route.Endpoint) {
+	p.transports.closeIdleConnections(endpoint)
+}
+
+// Drain makes the load balancer heartbeat fail from now on, while requests
+// keep being proxied.
+func (p *proxy) Drain() {
+	atomic.StoreInt32(&p.draining, 1)
+}
+
+func (p *proxy) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
 }
 
 func hostWithoutPort(req *http.Request) string {
@@ -77,20 +245,22 @@ func hostWithoutPort(req *http.Request) string {
 	return host
 }
 
-func (p *proxy) lookup(request *http.Request) (*route.Endpoint, bool) {
-	uri := route.Uri(hostWithoutPort(request))
+// routeUri returns the URI that routes are looked up by: the host and path
+// of the request.
+func routeUri(request *http.Request, path string) route.Uri {
+	return route.Uri(hostWithoutPort(request) + path)
+}
 
+func (p *proxy) lookup(request *http.Request, uri route.Uri) (*route.Endpoint, bool) {
 	// Try choosing a backend using sticky session
-	if _, err := request.Cookie(StickyCookieKey); err == nil {
-		if sticky, err := request.Cookie(VcapCookieId); err == nil {
-			routeEndpoint, ok := p.registry.LookupByPrivateInstanceId(uri, sticky.Value)
-			if ok {
-				return routeEndpoint, ok
-			}
+	if instanceId, ok := p.stickySessions.instanceId(request); ok {
+		routeEndpoint, ok := p.registry.LookupByPrivateInstanceId(uri, instanceId)
+		if ok {
+			return routeEndpoint, ok
 		}
 	}
 
-	// Choose backend using host alone
+	// Choose backend using host and path alone
 	return p.registry.Lookup(uri)
 }
 
@@ -99,14 +269,31 @@ func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Requ
 	originalURL := request.URL
 	request.URL = &url.URL{Host: originalURL.Host, Opaque: request.RequestURI}
 	handler := NewRequestHandler(request, responseWriter)
+	handler.errorTemplates = p.errorTemplates
+	handler.headerRewrites = p.headerRewrites
+	handler.stickySessions = p.stickySessions
+	handler.SetupForwarding(p.trustedProxies)
+	handler.SetupTrace(p.traceSampleRate, p.trustedProxies)
+
+	// Error pages show the request ID, so it is set before the request is
+	// even routed
+	handler.SetupRequestId(p.requestIdHeader, p.trustedProxies)
 
 	accessLog := access_log.AccessLogRecord{
 		Request:   request,
 		StartedAt: startedAt,
+		RequestId: handler.RequestId(),
+		TraceId:   handler.trace.traceId,
+		SpanId:    handler.trace.spanId,
+	}
+
+	if peer, _, err := net.SplitHostPort(request.RemoteAddr); err != nil || peer != handler.ClientIp() {
+		accessLog.ClientIp = handler.ClientIp()
 	}
 
 	defer func() {
 		p.accessLogger.Log(accessLog)
+		p.exportSpan(handler.trace, originalURL.Path, accessLog)
 	}()
 
 	if !isProtocolSupported(request) {
@@ -115,12 +302,27 @@ func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Requ
 	}
 
 	if isLoadBalancerHeartbeat(request) {
+		if p.isDraining() {
+			handler.HandleDrainingHeartbeat()
+			return
+		}
+
 		handler.HandleHeartbeat()
 		return
 	}
 
-	routeEndpoint, found := p.lookup(request)
+	uri := routeUri(request, originalURL.Path)
+
+	routeEndpoint, found := p.lookup(request, uri)
 	if !found {
+		// The route exists, but all of its endpoints are unhealthy, ejected
+		// or have an open circuit
+		if _, ok := p.registry.RouteUri(uri); ok {
+			p.reporter.CaptureRejectedRequest(http.StatusServiceUnavailable)
+			handler.HandleNoAvailableEndpoints()
+			return
+		}
+
 		p.reporter.CaptureBadRequest(request)
 		handler.HandleMissingRoute()
 		return
@@ -130,47 +332,369 @@ func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Requ
 
 	accessLog.RouteEndpoint = routeEndpoint
 
+	// Only the outcome of HTTP requests sent to the endpoint decides the
+	// trial of a half-open circuit, so other requests give it back
+	picked := routeEndpoint
+	reported := false
+	skipped := func() {
+		if !reported {
+			picked.RequestSkipped(startedAt)
+			reported = true
+		}
+	}
+	defer skipped()
+
+	// Requests sent back by a route service were rate limited on their way
+	// to it, and come from the service's address rather than the client's
+	fromRouteService := false
+	if routeEndpoint.RouteServiceUrl != "" && p.routeServices.enabled() && request.Header.Get(RouteServiceSignature) != "" {
+		if err := p.routeServices.verifyRequest(request, startedAt); err != nil {
+			p.reporter.CaptureBadRequest(request)
+			handler.HandleInvalidRouteServiceRequest(err)
+			return
+		}
+
+		handler.ClearRouteServiceHeaders()
+		fromRouteService = true
+	}
+
+	if !fromRouteService {
+		if limited, retryAfter := p.rateLimited(handler.ClientIp(), uri, routeEndpoint); limited != "" {
+			accessLog.RateLimited = limited
+			p.reporter.CaptureRateLimited(routeEndpoint, request)
+			handler.HandleRateLimited(limited, retryAfter)
+			return
+		}
+	}
+
+	if limit := tagBodySizeLimit(routeEndpoint, p.maxRequestBodySize); limit > 0 {
+		// Bodies of unknown length are cut off once they exceed the limit
+		if request.ContentLength > limit {
+			p.reporter.CaptureRejectedRequest(http.StatusRequestEntityTooLarge)
+			handler.HandleRequestBodyFailed(http.StatusRequestEntityTooLarge, errRequestBodyTooLarge)
+			return
+		}
+
+		handler.LimitRequestBody(limit)
+	}
+
+	if routeEndpoint.RouteServiceUrl != "" && !fromRouteService {
+		// Upgraded connections cannot be passed through route services
+		if !p.routeServices.enabled() || isTcpUpgrade(request) || isWebSocketUpgrade(request) {
+			p.reporter.CaptureBadGateway(request)
+			handler.HandleRouteServiceUnsupported()
+			return
+		}
+
+		// The route service sends the request back for the endpoint
+		skipped()
+
+		p.serveRouteService(&handler, routeEndpoint, &accessLog)
+		return
+	}
+
 	p.reporter.CaptureRoutingRequest(routeEndpoint, handler.request)
 
 	if isTcpUpgrade(request) {
-		handler.HandleTcpRequest(routeEndpoint)
+		// Upgraded connections may last for hours
+		skipped()
+
+		routeEndpoint.RequestStarted()
+		defer routeEndpoint.RequestFinished()
+
+		handler.HandleTcpRequest(routeEndpoint, p.transports.dial)
 		return
 	}
 
 	if isWebSocketUpgrade(request) {
-		handler.HandleWebSocketRequest(routeEndpoint)
+		skipped()
+
+		routeEndpoint.RequestStarted()
+		defer routeEndpoint.RequestFinished()
+
+		handler.HandleWebSocketRequest(routeEndpoint, p.transports.dial)
 		return
 	}
 
-	endpointResponse, err := handler.HandleHttpRequest(p.transport, routeEndpoint)
+	var cached *cacheEntry
+	var revalidating bool
+
+	caching := p.cache != nil && p.caching.enabledFor(routeEndpoint) && cacheableRequest(request)
+	if caching {
+		cached = p.cache.get(request)
+		if cached != nil && cached.fresh(startedAt) && !revalidates(request) {
+			accessLog.CacheStatus = "hit"
+			p.reporter.CaptureCacheHit(routeEndpoint, request)
+
+			response := cached.response(request, time.Now())
+			handler.ForwardCachedResponseHeaders(response)
+
+			p.reporter.CaptureRoutingResponse(routeEndpoint, response, startedAt, time.Since(startedAt))
+			p.writeResponse(&handler, routeEndpoint, response, &accessLog)
+			return
+		}
+
+		accessLog.CacheStatus = "miss"
+		p.reporter.CaptureCacheMiss(routeEndpoint, request)
+
+		// Stored responses are checked with the endpoint, unless the
+		// client is checking its own copy
+		h := request.Header
+		revalidating = cached != nil && cached.etag() != "" && h.Get("If-None-Match") == "" && h.Get("If-Modified-Since") == ""
+		if revalidating {
+			h.Set("If-None-Match", cached.etag())
+		}
+	}
+
+	var endpointResponse *http.Response
+	var err error
+
+	tried := []*route.Endpoint{}
+
+	// The time the endpoint tried was picked at, which tells the circuit
+	// breaker whether the request is the trial of a half-open circuit
+	pickedAt := startedAt
+
+	for {
+		routeEndpoint.RequestStarted()
+
+		endpointResponse, err = handler.HandleHttpRequest(p.transports.get(routeEndpoint), routeEndpoint)
+		accessLog.Attempts++
+
+		// Endpoints aren't to blame for clients failing to send the body
+		clientFailed := err != nil && handler.RequestBodyErr() != nil
+		if clientFailed {
+			routeEndpoint.RequestSkipped(pickedAt)
+		} else {
+			p.reportOutcome(handler, routeEndpoint, pickedAt, endpointResponse, err)
+		}
+		reported = true
+
+		if err == nil {
+			// The endpoint is busy until its response has been written
+			defer routeEndpoint.RequestFinished()
+			break
+		}
+
+		routeEndpoint.RequestFinished()
+
+		if clientFailed || len(tried) >= p.maxRetries || !handler.CanRetry(err) {
+			break
+		}
+
+		tried = append(tried, routeEndpoint)
+
+		pickedAt = time.Now()
+		nextEndpoint, found := p.registry.LookupExcept(uri, tried...)
+		if !found {
+			break
+		}
+
+		handler.HandleRetry(routeEndpoint, err)
+		p.reporter.CaptureRetry(routeEndpoint, request)
+
+		routeEndpoint = nextEndpoint
+		handler.logger.Set("RouteEndpoint", routeEndpoint.ToLogData())
+		accessLog.RouteEndpoint = routeEndpoint
+	}
+
+	handler.releaseBody()
 
 	latency := time.Since(startedAt)
 
 	p.reporter.CaptureRoutingResponse(routeEndpoint, endpointResponse, startedAt, latency)
 
+	if err != nil && handler.RequestBodyErr() != nil {
+		p.requestBodyFailed(&handler)
+		return
+	}
+
 	if err != nil {
 		p.reporter.CaptureBadGateway(request)
 		handler.HandleBadGateway(err)
 		return
 	}
 
+	if revalidating {
+		request.Header.Del("If-None-Match")
+	}
+
+	if revalidating && endpointResponse.StatusCode == http.StatusNotModified {
+		endpointResponse.Body.Close()
+		accessLog.CacheStatus = "revalidated"
+
+		now := time.Now()
+		endpointResponse = p.cache.refresh(cached, endpointResponse, now).response(request, now)
+		handler.ForwardCachedResponseHeaders(endpointResponse)
+	} else if caching {
+		p.cache.store(request, endpointResponse, time.Now())
+	}
+
+	p.writeResponse(&handler, routeEndpoint, endpointResponse, &accessLog)
+}
+
+// serveRouteService sends the request to the route's route service, which
+// sends it back through the router once it is done with it.
+func (p *proxy) serveRouteService(handler *RequestHandler, endpoint *route.Endpoint, accessLog *access_log.AccessLogRecord) {
+	request := handler.request
+
+	serviceEndpoint, serviceUrl, err := routeServiceEndpoint(endpoint.RouteServiceUrl)
+	if err != nil {
+		p.reporter.CaptureBadGateway(request)
+		handler.HandleRouteServiceFailure(err)
+		return
+	}
+
+	forwarded := forwardedUrl(handler.ForwardedProto(), request)
+	handler.SetupRouteServiceRequest(serviceUrl, forwarded, p.routeServices.sign(forwarded, time.Now()))
+
+	response, err := handler.HandleHttpRequest(p.routeServiceTransports.get(serviceEndpoint), serviceEndpoint)
+	accessLog.Attempts++
+
+	handler.releaseBody()
+
+	if err != nil && handler.RequestBodyErr() != nil {
+		p.requestBodyFailed(handler)
+		return
+	}
+
+	if err != nil {
+		p.reporter.CaptureBadGateway(request)
+		handler.HandleRouteServiceFailure(err)
+		return
+	}
+
+	p.writeResponse(handler, serviceEndpoint, response, accessLog)
+}
+
+// requestBodyFailed answers a request whose body could not be read from the
+// client.
+func (p *proxy) requestBodyFailed(handler *RequestHandler) {
+	status := http.StatusBadRequest
+	if _, ok := handler.RequestBodyErr().(*http.MaxBytesError); ok {
+		status = http.StatusRequestEntityTooLarge
+	} else if isTimeout(handler.RequestBodyErr()) {
+		status = http.StatusRequestTimeout
+	}
+
+	p.reporter.CaptureRejectedRequest(status)
+	handler.HandleRequestBodyFailed(status, handler.RequestBodyErr())
+}
+
+func (p *proxy) writeResponse(handler *RequestHandler, endpoint *route.Endpoint, response *http.Response, accessLog *access_log.AccessLogRecord) {
+	request := handler.request
+
 	accessLog.FirstByteAt = time.Now()
-	accessLog.Response = endpointResponse
+	accessLog.Response = response
 
 	if p.traceKey != "" && request.Header.Get(router_http.VcapTraceHeader) == p.traceKey {
-		handler.SetTraceHeaders(p.ip, routeEndpoint.CanonicalAddr())
+		handler.SetTraceHeaders(p.ip, endpoint.CanonicalAddr())
 	}
 
-	bytesSent := handler.WriteResponse(endpointResponse)
+	if p.compression.applies(request, response) {
+		accessLog.Compressed = true
+		accessLog.BodyBytesSent, accessLog.UncompressedBodyBytes = handler.WriteCompressedResponse(response, p.compression.Level)
+	} else {
+		accessLog.BodyBytesSent = handler.WriteResponse(response)
+	}
 
 	accessLog.FinishedAt = time.Now()
-	accessLog.BodyBytesSent = bytesSent
+}
+
+// rateLimited takes a token for the request from the buckets of its client's
+// address, route and application. It returns which of them is over its limit,
+// if any, and when the request may be retried.
+func (p *proxy) rateLimited(clientIp string, uri route.Uri, endpoint *route.Endpoint) (string, time.Duration) {
+	var buckets []rateLimitBucket
+
+	if p.clientIpRateLimit.enabled() {
+		buckets = append(buckets, rateLimitBucket{"client_ip", p.clientIpRateLimiter, clientIp, p.clientIpRateLimit})
+	}
+
+	limit := tagRateLimit(endpoint, RouteRateLimitTag, p.routeRateLimit)
+	if limit.enabled() {
+		if routeUri, ok := p.registry.RouteUri(uri); ok {
+			buckets = append(buckets, rateLimitBucket{"route", p.routeRateLimiter, routeUri, limit})
+		}
+	}
+
+	limit = tagRateLimit(endpoint, AppRateLimitTag, p.appRateLimit)
+	if endpoint.ApplicationId != "" && limit.enabled() {
+		buckets = append(buckets, rateLimitBucket{"app", p.appRateLimiter, endpoint.ApplicationId, limit})
+	}
+
+	return takeAll(buckets, time.Now())
+}
+
+// tagRateLimit returns the rate limit set by the endpoint's tag, allowing
+// bursts of a second's worth of requests, or else the configured one.
+func tagRateLimit(endpoint *route.Endpoint, tag string, configured RateLimit) RateLimit {
+	value, ok := endpoint.Tags[tag]
+	if !ok {
+		return configured
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return configured
+	}
+
+	return RateLimit{RequestsPerSecond: n, Burst: n}
+}
+
+// tagBodySizeLimit returns the request body size limit set by the endpoint's
+// tag, or else the configured one.
+func tagBodySizeLimit(endpoint *route.Endpoint, configured int64) int64 {
+	value, ok := endpoint.Tags[MaxRequestBodySizeTag]
+	if !ok {
+		return configured
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return configured
+	}
+
+	return n
+}
+
+// reportOutcome feeds the outcome of a request to the endpoint's outlier
+// detection and circuit breaker; server errors count as failures just like
+// unreachable endpoints. The endpoint was picked for the request at pickedAt.
+func (p *proxy) reportOutcome(handler RequestHandler, endpoint *route.Endpoint, pickedAt time.Time, response *http.Response, err error) {
+	if err == nil && response.StatusCode < http.StatusInternalServerError {
+		endpoint.RequestSucceeded(pickedAt)
+		return
+	}
+
+	var ejectionTime time.Duration
+	var ejected bool
+
+	if isTimeout(err) {
+		ejectionTime, ejected = endpoint.RequestTimedOut(pickedAt)
+	} else {
+		ejectionTime, ejected = endpoint.RequestFailed(pickedAt)
+	}
+
+	if ejected {
+		handler.HandleEjection(endpoint, ejectionTime)
+		p.reporter.CaptureEndpointEjection(endpoint)
+	}
 }
 
 func isProtocolSupported(request *http.Request) bool {
+	if request.ProtoMajor == 2 && request.ProtoMinor == 0 {
+		return true
+	}
+
 	return request.ProtoMajor == 1 && (request.ProtoMinor == 0 || request.ProtoMinor == 1)
 }
 
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 func isLoadBalancerHeartbeat(request *http.Request) bool {
 	return request.UserAgent() == "HTTP-Monitor/1.1"
 }
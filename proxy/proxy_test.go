@@ -2,6 +2,9 @@ package proxy
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -35,10 +38,30 @@ func (_ nullVarz) MarshalJSON() ([]byte, error)                               {
 func (_ nullVarz) ActiveApps() *stats.ActiveApps                              { return stats.NewActiveApps() }
 func (_ nullVarz) CaptureBadRequest(req *http.Request)                        {}
 func (_ nullVarz) CaptureBadGateway(req *http.Request)                        {}
+func (_ nullVarz) CaptureRetry(b *route.Endpoint, req *http.Request)          {}
+func (_ nullVarz) CaptureEndpointEjection(b *route.Endpoint)                  {}
+func (_ nullVarz) CaptureRateLimited(b *route.Endpoint, req *http.Request)    {}
+func (_ nullVarz) CaptureRejectedRequest(status int)                          {}
+func (_ nullVarz) CaptureCacheHit(b *route.Endpoint, req *http.Request)       {}
+func (_ nullVarz) CaptureCacheMiss(b *route.Endpoint, req *http.Request)      {}
+func (_ nullVarz) CaptureCacheEviction()                                      {}
 func (_ nullVarz) CaptureRoutingRequest(b *route.Endpoint, req *http.Request) {}
 func (_ nullVarz) CaptureRoutingResponse(b *route.Endpoint, res *http.Response, t time.Time, d time.Duration) {
 }
 
+// rejectionVarz reports the requests counted as bad or rejected
+type rejectionVarz struct {
+	nullVarz
+	rejections chan string
+}
+
+func (v rejectionVarz) CaptureBadRequest(req *http.Request) { v.rejections <- "bad_request" }
+func (v rejectionVarz) CaptureRejectedRequest(status int)   { v.rejections <- strconv.Itoa(status) }
+
+type spanChan chan Span
+
+func (s spanChan) Export(span Span) { s <- span }
+
 type httpConn struct {
 	net.Conn
 
@@ -134,6 +157,9 @@ func (x *httpConn) WriteLines(lines []string) {
 }
 
 type ProxySuite struct {
+	backendCertificate tls.Certificate
+	backendRootCAs     *x509.CertPool
+
 	r             *registry.CFRegistry
 	p             Proxy
 	conf          *config.Config
@@ -145,6 +171,16 @@ type ProxySuite struct {
 
 var _ = Suite(&ProxySuite{})
 
+func (s *ProxySuite) SetUpSuite(c *C) {
+	s.backendCertificate = test_util.CreateTLSCertificate("backend.example.com")
+
+	leaf, err := x509.ParseCertificate(s.backendCertificate.Certificate[0])
+	c.Assert(err, IsNil)
+
+	s.backendRootCAs = x509.NewCertPool()
+	s.backendRootCAs.AddCert(leaf)
+}
+
 func (s *ProxySuite) SetUpTest(c *C) {
 	s.conf = config.DefaultConfig()
 	s.conf.TraceKey = "my_trace_key"
@@ -160,20 +196,34 @@ func (s *ProxySuite) SetUpTest(c *C) {
 	go accessLog.Run()
 
 	s.p = NewProxy(ProxyArgs{
-		EndpointTimeout: s.conf.EndpointTimeout,
-		Ip:              s.conf.Ip,
-		TraceKey:        s.conf.TraceKey,
-		Registry:        s.r,
-		Reporter:        nullVarz{},
-		Logger:          accessLog,
+		EndpointTimeout:         s.conf.EndpointTimeout,
+		EndpointIdleTimeout:     s.conf.EndpointIdleTimeout,
+		MaxIdleConnsPerEndpoint: s.conf.MaxIdleConnsPerEndpoint,
+		MaxRetries:              s.conf.MaxRetries,
+		BackendRootCAs:          s.backendRootCAs,
+		Ip:                      s.conf.Ip,
+		TraceKey:                s.conf.TraceKey,
+		Compression:             Compression{ContentTypes: []string{"text/*"}, MinSize: 10, Level: 6},
+		ResponseCaching:         ResponseCaching{MaxSize: 1024 * 1024, OptIn: true},
+		RouteServices:           RouteServices{Key: []byte("secret"), Timeout: time.Minute},
+		HeaderRewrites: HeaderRewrites{
+			"*.rewritten": HeaderRewrite{
+				Request:  HeaderRules{Set: map[string]string{"X-Internal-Auth": "secret"}},
+				Response: HeaderRules{Remove: []string{"Server"}},
+			},
+		},
+		Registry: s.r,
+		Reporter: nullVarz{},
+		Logger:   accessLog,
 	})
+	s.r.OnEndpointRemoved(s.p.CloseIdleConnections)
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		panic(err)
 	}
 
-	server := server.Server{Handler: s.p}
+	server := server.Server{Handler: s.p, H2C: true}
 	go server.Serve(ln)
 
 	s.proxyServer = ln
@@ -203,12 +253,82 @@ func (s *ProxySuite) registerAddr(u string, a net.Addr) {
 	)
 }
 
+func (s *ProxySuite) registerTagged(c *C, u string, a net.Addr, tags map[string]string) {
+	host, port, err := net.SplitHostPort(a.String())
+	c.Assert(err, IsNil)
+
+	x, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+
+	s.r.Register(
+		route.Uri(u),
+		&route.Endpoint{
+			Host: host,
+			Port: uint16(x),
+			Tags: tags,
+		},
+	)
+}
+
+func (s *ProxySuite) registerRouteService(c *C, u string, a net.Addr, serviceUrl string) {
+	host, port, err := net.SplitHostPort(a.String())
+	c.Assert(err, IsNil)
+
+	x, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+
+	s.r.Register(
+		route.Uri(u),
+		&route.Endpoint{
+			Host:            host,
+			Port:            uint16(x),
+			RouteServiceUrl: serviceUrl,
+		},
+	)
+}
+
 func (s *ProxySuite) RegisterHandler(c *C, u string, h connHandler) net.Listener {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		panic(err)
 	}
 
+	s.serve(c, ln, h)
+	s.registerAddr(u, ln.Addr())
+
+	return ln
+}
+
+// RegisterTLSHandler registers an endpoint that is served over TLS with a
+// certificate for serverName.
+func (s *ProxySuite) RegisterTLSHandler(c *C, u string, serverName string, h connHandler) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{s.backendCertificate}})
+	if err != nil {
+		panic(err)
+	}
+
+	s.serve(c, ln, h)
+
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	c.Assert(err, IsNil)
+
+	x, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+
+	s.r.Register(
+		route.Uri(u),
+		&route.Endpoint{
+			Host:       host,
+			Port:       uint16(x),
+			TLS:        true,
+			ServerName: serverName,
+		},
+	)
+
+	return ln
+}
+
+func (s *ProxySuite) serve(c *C, ln net.Listener, h connHandler) {
 	go func() {
 		for {
 			conn, err := ln.Accept()
@@ -223,10 +343,15 @@ func (s *ProxySuite) RegisterHandler(c *C, u string, h connHandler) net.Listener
 			go h(newConn(conn, c))
 		}
 	}()
+}
 
-	s.registerAddr(u, ln.Addr())
+// checkAccessLog waits for the access log record that ends with suffix.
+func (s *ProxySuite) checkAccessLog(c *C, suffix string) {
+	for i := 0; i < 20 && !strings.HasSuffix(string(s.accessLogFile.Payload), suffix); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
 
-	return ln
+	c.Check(string(s.accessLogFile.Payload), Matches, ".*"+suffix)
 }
 
 func (s *ProxySuite) DialProxy(c *C) *httpConn {
@@ -341,6 +466,20 @@ func (s *ProxySuite) TestRespondsToLoadBalancerCheck(c *C) {
 	c.Check(body, Equals, "ok\n")
 }
 
+func (s *ProxySuite) TestLoadBalancerCheckFailsWhileDraining(c *C) {
+	s.p.Drain()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "HTTP-Monitor/1.1")
+	x.WriteRequest(req)
+
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Check(body, Equals, "draining\n")
+}
+
 func (s *ProxySuite) TestRespondsToUnknownHostWith404(c *C) {
 	x := s.DialProxy(c)
 
@@ -354,6 +493,52 @@ func (s *ProxySuite) TestRespondsToUnknownHostWith404(c *C) {
 	c.Check(body, Equals, "404 Not Found: Requested route ('unknown') does not exist.\n")
 }
 
+func (s *ProxySuite) TestRespondsToUnknownHostWithJSON(c *C) {
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "unknown"
+	req.Header.Set("Accept", "application/json")
+	x.WriteRequest(req)
+
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "application/json")
+
+	var e map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(body), &e), IsNil)
+	c.Check(e["error"], Equals, "unknown_route")
+	c.Check(e["message"], Equals, "Requested route ('unknown') does not exist.")
+	c.Check(e["request_id"], Matches, "[0-9a-f]{32}")
+	c.Check(e["request_id"], Equals, resp.Header.Get(router_http.VcapRequestIdHeader))
+}
+
+func (s *ProxySuite) TestRespondsWith503WhenNoEndpointIsAvailable(c *C) {
+	s.conf.HealthCheck.MaxUnhealthyPercent = 100
+	s.r = registry.NewCFRegistry(s.conf, fakeyagnats.New())
+
+	rejections := make(chan string, 1)
+	s.p.(*proxy).registry = s.r
+	s.p.(*proxy).reporter = rejectionVarz{rejections: rejections}
+
+	unhealthy := &route.Endpoint{Host: "127.0.0.1", Port: 1}
+	unhealthy.SetHealthy(false)
+	s.r.Register("down", unhealthy)
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "down"
+	x.WriteRequest(req)
+
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "no_available_endpoints")
+	c.Check(body, Equals, "503 Service Unavailable: Requested route ('down') has no available endpoints.\n")
+
+	c.Check(<-rejections, Equals, "503")
+}
+
 func (s *ProxySuite) TestRespondsToMisbehavingHostWith502(c *C) {
 	ln := s.RegisterHandler(c, "enfant-terrible", func(x *httpConn) {
 		x.Close()
@@ -434,6 +619,9 @@ func (s *ProxySuite) TestXFFIsAdded(c *C) {
 }
 
 func (s *ProxySuite) TestXFFIsAppended(c *C) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
+
 	done := make(chan bool)
 
 	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
@@ -453,12 +641,15 @@ func (s *ProxySuite) TestXFFIsAppended(c *C) {
 	<-done
 }
 
-func (s *ProxySuite) TestXRequestStartIsAppended(c *C) {
+func (s *ProxySuite) TestForwardingHeadersAreReplacedWithoutTrustedProxies(c *C) {
 	done := make(chan bool)
 
 	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
 		req, _ := x.ReadRequest()
-		c.Check(req.Header.Get("X-Request-Start"), Matches, "^\\d{10}\\d{3}$") // unix timestamp millis
+		c.Check(req.Header.Get("X-Forwarded-For"), Equals, "127.0.0.1")
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "http")
+		c.Check(req.Header.Get("Forwarded"), Equals, "for=127.0.0.1;host=app;proto=http")
+		x.WriteResponse(newResponse(http.StatusOK))
 		done <- true
 	})
 	defer ln.Close()
@@ -467,17 +658,30 @@ func (s *ProxySuite) TestXRequestStartIsAppended(c *C) {
 
 	req := x.NewRequest("GET", "/", nil)
 	req.Host = "app"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
 	x.WriteRequest(req)
 
 	<-done
+
+	x.ReadResponse()
+	s.checkAccessLog(c, " attempts:1 trace_id:[0-9a-f]{32} span_id:[0-9a-f]{16}\n")
 }
 
-func (s *ProxySuite) TestXRequestStartIsNotOverwritten(c *C) {
+func (s *ProxySuite) TestForwardingHeadersOfUntrustedPeersAreReplaced(c *C) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
+
 	done := make(chan bool)
 
 	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
 		req, _ := x.ReadRequest()
-		c.Check(req.Header[http.CanonicalHeaderKey("X-Request-Start")], DeepEquals, []string{"", "user-set2"})
+		c.Check(req.Header.Get("X-Forwarded-For"), Equals, "127.0.0.1")
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "http")
+		c.Check(req.Header.Get("X-Forwarded-Host"), Equals, "app")
+		c.Check(req.Header.Get("X-Forwarded-Port"), Equals, "80")
+		c.Check(req.Header.Get("Forwarded"), Equals, "for=127.0.0.1;host=app;proto=http")
 		done <- true
 	})
 	defer ln.Close()
@@ -486,19 +690,29 @@ func (s *ProxySuite) TestXRequestStartIsNotOverwritten(c *C) {
 
 	req := x.NewRequest("GET", "/", nil)
 	req.Host = "app"
-	req.Header.Add("X-Request-Start", "") // impl cannot just check for empty string
-	req.Header.Add("X-Request-Start", "user-set2")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
 	x.WriteRequest(req)
 
 	<-done
 }
 
-func (s *ProxySuite) TestXVcapRequestIdHeaderIsAdded(c *C) {
+func (s *ProxySuite) TestForwardingHeadersOfTrustedPeersAreKept(c *C) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
+
 	done := make(chan bool)
 
 	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
 		req, _ := x.ReadRequest()
-		c.Check(req.Header.Get(router_http.VcapRequestIdHeader), Matches, "^[0-9a-f]{32}$")
+		c.Check(req.Header.Get("X-Forwarded-For"), Equals, "1.2.3.4, 127.0.0.2, 127.0.0.1")
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "https")
+		c.Check(req.Header.Get("X-Forwarded-Host"), Equals, "app.example.com")
+		c.Check(req.Header.Get("X-Forwarded-Port"), Equals, "443")
+		c.Check(req.Header.Get("Forwarded"), Equals, "for=1.2.3.4, for=127.0.0.2, for=127.0.0.1;host=app;proto=http")
+		x.WriteResponse(newResponse(http.StatusOK))
 		done <- true
 	})
 	defer ln.Close()
@@ -507,176 +721,1402 @@ func (s *ProxySuite) TestXVcapRequestIdHeaderIsAdded(c *C) {
 
 	req := x.NewRequest("GET", "/", nil)
 	req.Host = "app"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 127.0.0.2")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
 	x.WriteRequest(req)
 
 	<-done
+
+	x.ReadResponse()
+	s.checkAccessLog(c, " client_ip:1.2.3.4\n")
 }
 
-func (s *ProxySuite) TestXVcapRequestIdHeaderIsOverwritten(c *C) {
-	done := make(chan bool)
+func (s *ProxySuite) TestJoinsClientTrace(c *C) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
+
+	spans := make(spanChan, 1)
+	s.p.(*proxy).spanExporter = spans
+
+	spanIds := make(chan string, 1)
 
 	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
 		req, _ := x.ReadRequest()
-		c.Check(req.Header.Get(router_http.VcapRequestIdHeader), Matches, "^[0-9a-f]{32}$")
-		done <- true
+
+		traceparent := strings.Split(req.Header.Get(TraceparentHeader), "-")
+		c.Assert(traceparent, HasLen, 4)
+		c.Check(traceparent[1], Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+		c.Check(traceparent[3], Equals, "01")
+		c.Check(req.Header.Get(TracestateHeader), Equals, "congo=t61rcWkgMzE")
+
+		c.Check(req.Header.Get(B3TraceIdHeader), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+		c.Check(req.Header.Get(B3SpanIdHeader), Equals, traceparent[2])
+		c.Check(req.Header.Get(B3ParentSpanIdHeader), Equals, "00f067aa0ba902b7")
+
+		spanIds <- traceparent[2]
+		x.WriteResponse(newResponse(http.StatusOK))
 	})
 	defer ln.Close()
 
 	x := s.DialProxy(c)
 
-	req := x.NewRequest("GET", "/", nil)
+	req := x.NewRequest("GET", "/path?q=1", nil)
 	req.Host = "app"
-	req.Header.Add(router_http.VcapRequestIdHeader, "A-BOGUS-REQUEST-ID")
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(TracestateHeader, "congo=t61rcWkgMzE")
 	x.WriteRequest(req)
 
-	<-done
+	spanId := <-spanIds
+	c.Check(spanId, Not(Equals), "00f067aa0ba902b7")
+
+	x.ReadResponse()
+	s.checkAccessLog(c, " trace_id:4bf92f3577b34da6a3ce929d0e0e4736 span_id:"+spanId+"\n")
+
+	select {
+	case span := <-spans:
+		c.Check(span.TraceId, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+		c.Check(span.Id, Equals, spanId)
+		c.Check(span.ParentId, Equals, "00f067aa0ba902b7")
+		c.Check(span.Name, Equals, "get")
+		c.Check(span.Tags["http.path"], Equals, "/path")
+		c.Check(span.Tags["http.status_code"], Equals, "200")
+	case <-time.After(time.Second):
+		c.Fatal("no span was exported")
+	}
 }
 
-func (s *ProxySuite) TestWebSocketUpgrade(c *C) {
-	ln := s.RegisterHandler(c, "ws", func(x *httpConn) {
-		req, _ := x.ReadRequest()
-		c.Check(req.Header.Get("Upgrade"), Equals, "WebsockeT")
-		c.Check(req.Header.Get("Connection"), Equals, "UpgradE")
+func (s *ProxySuite) TestSamplingDecisionOfUntrustedPeerIsIgnored(c *C) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
 
-		resp := newResponse(http.StatusSwitchingProtocols)
-		resp.Header.Set("Upgrade", "WebsockeT")
-		resp.Header.Set("Connection", "UpgradE")
+	spans := make(spanChan, 1)
+	s.p.(*proxy).spanExporter = spans
 
-		x.WriteResponse(resp)
+	headers := make(chan http.Header, 1)
 
-		x.CheckLine("hello from client")
-		x.WriteLine("hello from server")
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		headers <- req.Header
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
 	})
 	defer ln.Close()
 
 	x := s.DialProxy(c)
 
-	req := x.NewRequest("GET", "/chat", nil)
-	req.Host = "ws"
-	req.Header.Set("Upgrade", "WebsockeT")
-	req.Header.Set("Connection", "UpgradE")
-
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(B3SampledHeader, "1")
 	x.WriteRequest(req)
 
-	resp, _ := x.ReadResponse()
-	c.Check(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
-	c.Check(resp.Header.Get("Upgrade"), Equals, "WebsockeT")
-	c.Check(resp.Header.Get("Connection"), Equals, "UpgradE")
+	header := <-headers
+	c.Check(header.Get(TraceparentHeader), Matches, "00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-00")
+	c.Check(header.Get(B3SampledHeader), Equals, "0")
 
-	x.WriteLine("hello from client")
-	x.CheckLine("hello from server")
-}
+	x.ReadResponse()
+	s.checkAccessLog(c, " trace_id:4bf92f3577b34da6a3ce929d0e0e4736 span_id:[0-9a-f]{16}\n")
 
-func (s *ProxySuite) TestTcpUpgrade(c *C) {
-	ln := s.RegisterHandler(c, "tcp-handler", func(x *httpConn) {
-		x.WriteLine("hello")
-		x.CheckLine("hello from client")
-		x.WriteLine("hello from server")
-	})
-	defer ln.Close()
+	c.Check(spans, HasLen, 0)
 
-	x := s.DialProxy(c)
+	// New traces are sampled at the configured rate
+	s.p.(*proxy).traceSampleRate = 1
 
-	req := x.NewRequest("GET", "/chat", nil)
-	req.Host = "tcp-handler"
-	req.Header.Set("Upgrade", "tcp")
+	req = x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	x.WriteRequest(req)
 
-	req.Header.Set("Connection", "UpgradE")
+	header = <-headers
+	c.Check(header.Get(B3SampledHeader), Equals, "1")
 
-	x.WriteRequest(req)
+	x.ReadResponse()
 
-	x.CheckLine("hello")
-	x.WriteLine("hello from client")
-	x.CheckLine("hello from server")
+	select {
+	case <-spans:
+	case <-time.After(time.Second):
+		c.Fatal("no span was exported")
+	}
 }
 
-func (s *ProxySuite) TestTransferEncodingChunked(c *C) {
-	ln := s.RegisterHandler(c, "chunk", func(responseDestination *httpConn) {
-		r, w := io.Pipe()
-
-		// Write 3 times on a 100ms interval
-		go func() {
-			t := time.NewTicker(100 * time.Millisecond)
-			defer t.Stop()
-			defer w.Close()
+func (s *ProxySuite) TestDoesNotExportUnsampledTraces(c *C) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
 
-			for i := 0; i < 3; i++ {
-				<-t.C
-				_, err := w.Write([]byte("hello"))
-				c.Assert(err, IsNil)
-			}
-		}()
+	spans := make(spanChan, 1)
+	s.p.(*proxy).spanExporter = spans
 
-		resp := newResponse(http.StatusOK)
-		resp.TransferEncoding = []string{"chunked"}
-		resp.Body = r
-		resp.Write(responseDestination)
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get(B3SampledHeader), Equals, "0")
+		c.Check(req.Header.Get(B3Header), Matches, "80f198ee56343ba864fe8b2a57d3eff7-[0-9a-f]{16}-0-e457b5a2e4d86bd1")
+		x.WriteResponse(newResponse(http.StatusOK))
 	})
 	defer ln.Close()
 
 	x := s.DialProxy(c)
 
 	req := x.NewRequest("GET", "/", nil)
-	req.Host = "chunk"
-
-	err := req.Write(x)
-	c.Assert(err, IsNil)
-
-	resp, err := http.ReadResponse(x.reader, &http.Request{})
-	c.Assert(err, IsNil)
-
-	c.Assert(resp.StatusCode, Equals, http.StatusOK)
-	c.Assert(resp.TransferEncoding, DeepEquals, []string{"chunked"})
+	req.Host = "app"
+	req.Header.Set(B3Header, "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-0")
+	x.WriteRequest(req)
 
-	// Expect 3 individual reads to complete
-	for i := 0; i < 3; i++ {
-		var b [16]byte
+	x.ReadResponse()
+	s.checkAccessLog(c, " trace_id:80f198ee56343ba864fe8b2a57d3eff7 span_id:[0-9a-f]{16}\n")
 
-		n, err := resp.Body.Read(b[0:])
-		c.Assert(err, IsNil)
-		c.Check(n, Equals, 5)
-		c.Check(string(b[0:n]), Equals, "hello")
-	}
+	c.Check(spans, HasLen, 0)
 }
 
-func (s *ProxySuite) TestStatusNoContentHasNoTransferEncodingInResponse(c *C) {
-	ln := s.RegisterHandler(c, "not-modified", func(x *httpConn) {
-		resp := newResponse(http.StatusNoContent)
-		resp.Header.Set("Connection", "close")
-		x.WriteResponse(resp)
-		x.Close()
+func (s *ProxySuite) TestXRequestStartIsAppended(c *C) {
+	done := make(chan bool)
+
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Request-Start"), Matches, "^\\d{10}\\d{3}$") // unix timestamp millis
+		done <- true
 	})
 	defer ln.Close()
 
 	x := s.DialProxy(c)
 
 	req := x.NewRequest("GET", "/", nil)
-
-	req.Header.Set("Connection", "close")
-	req.Host = "not-modified"
+	req.Host = "app"
 	x.WriteRequest(req)
 
-	resp, _ := x.ReadResponse()
-	fmt.Printf("response: %#v\n", resp)
-	c.Check(resp.StatusCode, Equals, http.StatusNoContent)
-	c.Check(resp.TransferEncoding, IsNil)
+	<-done
 }
 
-func (s *ProxySuite) TestRequestIsOkWithEncodedString(c *C) {
-	ln := s.RegisterHandler(c, "encoding", func(x *httpConn) {
-		x.CheckLine("GET /hello%2Bworld?inline-depth=1 HTTP/1.1")
-		resp := newResponse(http.StatusOK)
-		x.WriteResponse(resp)
-		x.Close()
+func (s *ProxySuite) TestXRequestStartIsNotOverwritten(c *C) {
+	done := make(chan bool)
+
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header[http.CanonicalHeaderKey("X-Request-Start")], DeepEquals, []string{"", "user-set2"})
+		done <- true
 	})
 	defer ln.Close()
 
 	x := s.DialProxy(c)
 
-	req := x.NewRequest("GET", "/hello%2Bworld?inline-depth=1", nil)
-	req.Host = "encoding"
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Add("X-Request-Start", "") // impl cannot just check for empty string
+	req.Header.Add("X-Request-Start", "user-set2")
 	x.WriteRequest(req)
-	resp, _ := x.ReadResponse()
+
+	<-done
+}
+
+func (s *ProxySuite) TestXVcapRequestIdHeaderIsAdded(c *C) {
+	requestIds := make(chan string, 1)
+
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get(router_http.VcapRequestIdHeader), Matches, "^[0-9a-f]{32}$")
+		requestIds <- req.Header.Get(router_http.VcapRequestIdHeader)
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set(router_http.VcapRequestIdHeader, "endpoint-request-id")
+		x.WriteResponse(resp)
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	x.WriteRequest(req)
+
+	requestId := <-requestIds
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.Header[router_http.VcapRequestIdHeader], DeepEquals, []string{requestId})
+	s.checkAccessLog(c, "vcap_request_id:"+requestId+" .*\n")
+}
+
+func (s *ProxySuite) TestXVcapRequestIdHeaderIsOverwritten(c *C) {
+	done := make(chan bool)
+
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get(router_http.VcapRequestIdHeader), Matches, "^[0-9a-f]{32}$")
+		done <- true
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Add(router_http.VcapRequestIdHeader, "A-BOGUS-REQUEST-ID")
+	x.WriteRequest(req)
+
+	<-done
+}
+
+func (s *ProxySuite) TestXVcapRequestIdHeaderOfTrustedPeerIsKept(c *C) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
+
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get(router_http.VcapRequestIdHeader), Equals, "Root=1-67891233-abcdef012345678912345678")
+		x.WriteResponse(newResponse(http.StatusOK))
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set(router_http.VcapRequestIdHeader, "Root=1-67891233-abcdef012345678912345678")
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.Header.Get(router_http.VcapRequestIdHeader), Equals, "Root=1-67891233-abcdef012345678912345678")
+	s.checkAccessLog(c, "vcap_request_id:Root=1-67891233-abcdef012345678912345678 .*\n")
+}
+
+func (s *ProxySuite) TestInvalidXVcapRequestIdHeaderOfTrustedPeerIsReplaced(c *C) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
+
+	for _, requestId := range []string{"has spaces", "has\"quotes\"", strings.Repeat("a", 129)} {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "unknown"
+		req.Header.Set(router_http.VcapRequestIdHeader, requestId)
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.Header.Get(router_http.VcapRequestIdHeader), Matches, "^[0-9a-f]{32}$")
+		x.Close()
+	}
+}
+
+func (s *ProxySuite) TestRequestIdHeaderIsConfigurable(c *C) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	s.p.(*proxy).trustedProxies = []*net.IPNet{trusted}
+	s.p.(*proxy).requestIdHeader = "X-Request-Id"
+
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Request-Id"), Equals, "lb-1234")
+		c.Check(req.Header.Get(router_http.VcapRequestIdHeader), Equals, "lb-1234")
+		x.WriteResponse(newResponse(http.StatusOK))
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set("X-Request-Id", "lb-1234")
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.Header.Get("X-Request-Id"), Equals, "lb-1234")
+	s.checkAccessLog(c, "vcap_request_id:lb-1234 .*\n")
+}
+
+func (s *ProxySuite) TestForgedXVcapRequestIdIsReplacedWithCustomHeader(c *C) {
+	s.p.(*proxy).requestIdHeader = "X-Request-Id"
+
+	requestIds := make(chan string, 1)
+
+	ln := s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Request-Id"), Matches, "^[0-9a-f]{32}$")
+		c.Check(req.Header[router_http.VcapRequestIdHeader], DeepEquals, []string{req.Header.Get("X-Request-Id")})
+		requestIds <- req.Header.Get("X-Request-Id")
+		x.WriteResponse(newResponse(http.StatusOK))
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set("X-Request-Id", "forged-1234")
+	req.Header.Set(router_http.VcapRequestIdHeader, "forged-5678")
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.Header.Get("X-Request-Id"), Equals, <-requestIds)
+}
+
+// registerInstance registers an endpoint for an instance that starts a
+// session for clients without one, and responds with its instance ID.
+func (s *ProxySuite) registerInstance(c *C, u string, instanceId string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logout" {
+			http.SetCookie(w, &http.Cookie{Name: "PHPSESSID", MaxAge: -1})
+		} else if _, err := r.Cookie("PHPSESSID"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "PHPSESSID", Value: "abc", MaxAge: 3600, Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		}
+
+		w.Write([]byte(instanceId))
+	}))
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	x, _ := strconv.Atoi(port)
+
+	s.r.Register(route.Uri(u), &route.Endpoint{
+		Host:              host,
+		Port:              uint16(x),
+		PrivateInstanceId: instanceId,
+	})
+
+	return ln
+}
+
+func (s *ProxySuite) TestStickySessionsPinClientsToInstance(c *C) {
+	s.p.(*proxy).stickySessions = StickySessions{CookieNames: []string{"PHPSESSID"}, Key: []byte("secret")}
+
+	for _, instanceId := range []string{"instance-1", "instance-2"} {
+		ln := s.registerInstance(c, "sticky", instanceId)
+		defer ln.Close()
+	}
+
+	get := func(path string, cookies ...*http.Cookie) (*http.Response, string) {
+		x := s.DialProxy(c)
+		defer x.Close()
+
+		req := x.NewRequest("GET", path, nil)
+		req.Host = "sticky"
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		x.WriteRequest(req)
+
+		return x.ReadResponse()
+	}
+
+	resp, instanceId := get("/")
+
+	var session, affinity *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		switch cookie.Name {
+		case "PHPSESSID":
+			session = cookie
+		case VcapCookieId:
+			affinity = cookie
+		}
+	}
+
+	c.Assert(session, NotNil)
+	c.Assert(affinity, NotNil)
+	c.Check(strings.Contains(affinity.Value, instanceId), Equals, false)
+	c.Check(affinity.MaxAge, Equals, 3600)
+	c.Check(affinity.Secure, Equals, true)
+	c.Check(affinity.HttpOnly, Equals, true)
+	c.Check(affinity.SameSite, Equals, http.SameSiteLaxMode)
+
+	for i := 0; i < 5; i++ {
+		_, body := get("/", session, affinity)
+		c.Check(body, Equals, instanceId)
+	}
+
+	resp, _ = get("/logout", session, affinity)
+
+	expired := false
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == VcapCookieId {
+			expired = cookie.MaxAge < 0
+		}
+	}
+	c.Check(expired, Equals, true)
+}
+
+func (s *ProxySuite) TestWebSocketUpgrade(c *C) {
+	ln := s.RegisterHandler(c, "ws", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("Upgrade"), Equals, "WebsockeT")
+		c.Check(req.Header.Get("Connection"), Equals, "UpgradE")
+
+		resp := newResponse(http.StatusSwitchingProtocols)
+		resp.Header.Set("Upgrade", "WebsockeT")
+		resp.Header.Set("Connection", "UpgradE")
+
+		x.WriteResponse(resp)
+
+		x.CheckLine("hello from client")
+		x.WriteLine("hello from server")
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/chat", nil)
+	req.Host = "ws"
+	req.Header.Set("Upgrade", "WebsockeT")
+	req.Header.Set("Connection", "UpgradE")
+
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Check(resp.Header.Get("Upgrade"), Equals, "WebsockeT")
+	c.Check(resp.Header.Get("Connection"), Equals, "UpgradE")
+
+	x.WriteLine("hello from client")
+	x.CheckLine("hello from server")
+}
+
+func (s *ProxySuite) TestTcpUpgrade(c *C) {
+	ln := s.RegisterHandler(c, "tcp-handler", func(x *httpConn) {
+		x.WriteLine("hello")
+		x.CheckLine("hello from client")
+		x.WriteLine("hello from server")
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/chat", nil)
+	req.Host = "tcp-handler"
+	req.Header.Set("Upgrade", "tcp")
+
+	req.Header.Set("Connection", "UpgradE")
+
+	x.WriteRequest(req)
+
+	x.CheckLine("hello")
+	x.WriteLine("hello from client")
+	x.CheckLine("hello from server")
+}
+
+func (s *ProxySuite) TestTLSEndpoint(c *C) {
+	ln := s.RegisterTLSHandler(c, "tls-endpoint", "backend.example.com", func(x *httpConn) {
+		x.ReadRequest()
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "tls-endpoint"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ProxySuite) TestTLSEndpointWithUnexpectedServerName(c *C) {
+	// The proxy rejects the certificate, so the handshake never completes
+	ln := s.RegisterTLSHandler(c, "tls-endpoint", "other.example.com", func(x *httpConn) {
+		x.Close()
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "tls-endpoint"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusBadGateway)
+}
+
+func (s *ProxySuite) TestWebSocketUpgradeToTLSEndpoint(c *C) {
+	ln := s.RegisterTLSHandler(c, "ws-tls", "backend.example.com", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("Upgrade"), Equals, "websocket")
+
+		resp := newResponse(http.StatusSwitchingProtocols)
+		resp.Header.Set("Upgrade", "websocket")
+		resp.Header.Set("Connection", "Upgrade")
+
+		x.WriteResponse(resp)
+
+		x.CheckLine("hello from client")
+		x.WriteLine("hello from server")
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/chat", nil)
+	req.Host = "ws-tls"
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	x.WriteLine("hello from client")
+	x.CheckLine("hello from server")
+}
+
+func (s *ProxySuite) TestTcpUpgradeToTLSEndpoint(c *C) {
+	ln := s.RegisterTLSHandler(c, "tcp-tls", "backend.example.com", func(x *httpConn) {
+		x.WriteLine("hello")
+		x.CheckLine("hello from client")
+		x.WriteLine("hello from server")
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/chat", nil)
+	req.Host = "tcp-tls"
+	req.Header.Set("Upgrade", "tcp")
+	req.Header.Set("Connection", "UpgradE")
+
+	x.WriteRequest(req)
+
+	x.CheckLine("hello")
+	x.WriteLine("hello from client")
+	x.CheckLine("hello from server")
+}
+
+func (s *ProxySuite) TestTrailersAreForwarded(c *C) {
+	ln := s.RegisterHandler(c, "trailers", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("Te"), Equals, "trailers")
+
+		x.WriteLines([]string{
+			"HTTP/1.1 200 OK",
+			"Transfer-Encoding: chunked",
+			"Trailer: Grpc-Status",
+		})
+
+		x.WriteLine("5")
+		x.WriteLine("hello")
+		x.WriteLine("0")
+		x.WriteLine("Grpc-Status: 0")
+		x.WriteLine("")
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "trailers"
+	req.Header.Set("Te", "trailers")
+	x.WriteRequest(req)
+
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(body, Equals, "hello")
+	c.Check(resp.Trailer.Get("Grpc-Status"), Equals, "0")
+}
+
+func (s *ProxySuite) TestHTTP2Request(c *C) {
+	firstChunkRead := make(chan bool)
+
+	ln := s.RegisterHandler(c, "http2", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.RequestURI, Equals, "/stream")
+
+		x.WriteLines([]string{
+			"HTTP/1.1 200 OK",
+			"Transfer-Encoding: chunked",
+			"Trailer: Grpc-Status",
+		})
+
+		x.WriteLine("5")
+		x.WriteLine("hello")
+
+		// The first chunk must reach the client before the response ends
+		<-firstChunkRead
+
+		x.WriteLine("6")
+		x.WriteLine(" world")
+		x.WriteLine("0")
+		x.WriteLine("Grpc-Status: 0")
+		x.WriteLine("")
+	})
+	defer ln.Close()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	req, err := http.NewRequest("GET", "http://"+s.proxyServer.Addr().String()+"/stream", nil)
+	c.Assert(err, IsNil)
+	req.Host = "http2"
+
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	c.Check(resp.Proto, Equals, "HTTP/2.0")
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	first := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, first)
+	c.Assert(err, IsNil)
+	c.Check(string(first), Equals, "hello")
+
+	close(firstChunkRead)
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Check(string(rest), Equals, " world")
+	c.Check(resp.Trailer.Get("Grpc-Status"), Equals, "0")
+
+	// The request is logged once the handler returns
+	for i := 0; i < 20 && len(s.accessLogFile.Payload) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Check(string(s.accessLogFile.Payload), Matches, `^http2 .*"GET /stream HTTP/2.0" 200 .*\n`)
+}
+
+func (s *ProxySuite) TestRateLimitedByRouteTag(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		x.ReadRequest()
+
+		resp := newResponse(http.StatusOK)
+		resp.ContentLength = 0
+		x.WriteResponse(resp)
+	})
+
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	c.Assert(err, IsNil)
+	p, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+
+	s.r.Register("limited", &route.Endpoint{
+		Host: host,
+		Port: uint16(p),
+		Tags: map[string]string{RouteRateLimitTag: "1"},
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "limited"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	x.WriteRequest(req)
+
+	resp, _ = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Check(resp.Header.Get("Retry-After"), Equals, "1")
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "rate_limited")
+
+	for i := 0; i < 20 && !strings.Contains(string(s.accessLogFile.Payload), "rate_limited"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Check(string(s.accessLogFile.Payload), Matches, `(?s).* rate_limited:route\n`)
+}
+
+func (s *ProxySuite) TestRouteRateLimitOutlivesRegistration(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		x.ReadRequest()
+
+		resp := newResponse(http.StatusOK)
+		resp.ContentLength = 0
+		x.WriteResponse(resp)
+	})
+
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	c.Assert(err, IsNil)
+	p, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+
+	endpoint := &route.Endpoint{
+		Host: host,
+		Port: uint16(p),
+		Tags: map[string]string{RouteRateLimitTag: "1"},
+	}
+	s.r.Register("*.limited", endpoint)
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "a.limited"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	// The route's bucket is kept when its last endpoint is unregistered,
+	// and is shared by all hosts of a wildcard route
+	s.r.Unregister("*.limited", endpoint)
+	s.r.Register("*.limited", endpoint)
+
+	req.Host = "b.limited"
+	x.WriteRequest(req)
+
+	resp, _ = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusTooManyRequests)
+}
+
+func (s *ProxySuite) TestRequestNotSentToEndpointGivesTrialBack(c *C) {
+	s.conf.CircuitBreaker.Window = 10 * time.Second
+	s.conf.CircuitBreaker.MinRequests = 1
+	s.conf.CircuitBreaker.OpenTime = 100 * time.Millisecond
+	s.conf.CircuitBreaker.ErrorPercent = 50
+	s.conf.CircuitBreaker.MaxOpenPercent = 100
+	s.r = registry.NewCFRegistry(s.conf, fakeyagnats.New())
+	s.p.(*proxy).registry = s.r
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		x.ReadRequest()
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	s.registerTagged(c, "trial", ln.Addr(), map[string]string{MaxRequestBodySizeTag: "8"})
+
+	endpoint, ok := s.r.Lookup("trial")
+	c.Assert(ok, Equals, true)
+
+	endpoint.RequestFailed(time.Now())
+	c.Assert(endpoint.CircuitState(), Equals, route.CircuitOpen)
+
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(endpoint.CircuitState(), Equals, route.CircuitHalfOpen)
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", strings.NewReader("some body"))
+	req.Host = "trial"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+
+	// The rejected request did not use up the trial
+	x = s.DialProxy(c)
+
+	req = x.NewRequest("GET", "/", nil)
+	req.Host = "trial"
+	x.WriteRequest(req)
+
+	resp, _ = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(endpoint.CircuitState(), Equals, route.CircuitClosed)
+}
+
+func (s *ProxySuite) TestRequestBodyOverContentLengthLimit(c *C) {
+	requested := make(chan bool, 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		requested <- true
+	})
+
+	s.registerTagged(c, "limited", ln.Addr(), map[string]string{MaxRequestBodySizeTag: "8"})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", strings.NewReader("some body"))
+	req.Host = "limited"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "request_body_too_large")
+	c.Check(resp.Close, Equals, true)
+
+	select {
+	case <-requested:
+		c.Error("endpoint was contacted")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *ProxySuite) TestChunkedRequestBodyOverLimit(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		req, err := http.ReadRequest(x.reader)
+		if err == nil {
+			ioutil.ReadAll(req.Body)
+		}
+	})
+
+	s.registerTagged(c, "limited", ln.Addr(), map[string]string{MaxRequestBodySizeTag: "8"})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", strings.NewReader("some body that is too large"))
+	req.Host = "limited"
+	req.ContentLength = -1
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "request_body_too_large")
+}
+
+func (s *ProxySuite) TestRequestBodyUnderLimit(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		_, body := x.ReadRequest()
+		c.Check(body, Equals, "some body")
+
+		resp := newResponse(http.StatusOK)
+		resp.ContentLength = 0
+		x.WriteResponse(resp)
+	})
+
+	s.registerTagged(c, "limited", ln.Addr(), map[string]string{MaxRequestBodySizeTag: "9"})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", strings.NewReader("some body"))
+	req.Host = "limited"
+	req.ContentLength = -1
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ProxySuite) TestGzipsResponse(c *C) {
+	body := strings.Repeat("hello ", 20)
+
+	ln := s.RegisterHandler(c, "gzip", func(x *httpConn) {
+		x.ReadRequest()
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header.Set("ETag", `"abc"`)
+		resp.Body = ioutil.NopCloser(strings.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		x.WriteResponse(resp)
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "gzip"
+	req.Header.Set("Accept-Encoding", "deflate, gzip")
+	x.WriteRequest(req)
+
+	resp, compressed := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Check(resp.Header.Get("Vary"), Equals, "Accept-Encoding")
+	c.Check(resp.Header.Get("ETag"), Equals, `W/"abc"`)
+	c.Check(resp.Header.Get("Content-Length"), Equals, "")
+
+	r, err := gzip.NewReader(strings.NewReader(compressed))
+	c.Assert(err, IsNil)
+	b, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, body)
+
+	for i := 0; i < 20 && !strings.Contains(string(s.accessLogFile.Payload), "uncompressed_body_bytes"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := fmt.Sprintf(`(?s).* 200 %d .* uncompressed_body_bytes:%d\n`, len(compressed), len(body))
+	c.Check(string(s.accessLogFile.Payload), Matches, expected)
+}
+
+func (s *ProxySuite) TestDoesNotGzipResponse(c *C) {
+	responses := []struct {
+		contentType     string
+		contentEncoding string
+		body            string
+	}{
+		{"text/plain", "", "tiny"},
+		{"image/png", "", strings.Repeat("x", 100)},
+		{"text/plain", "br", strings.Repeat("x", 100)},
+	}
+
+	for i, r := range responses {
+		r := r
+		host := fmt.Sprintf("gzip%d", i)
+
+		ln := s.RegisterHandler(c, host, func(x *httpConn) {
+			x.ReadRequest()
+
+			resp := newResponse(http.StatusOK)
+			resp.Header.Set("Content-Type", r.contentType)
+			if r.contentEncoding != "" {
+				resp.Header.Set("Content-Encoding", r.contentEncoding)
+			}
+			resp.Body = ioutil.NopCloser(strings.NewReader(r.body))
+			resp.ContentLength = int64(len(r.body))
+			x.WriteResponse(resp)
+		})
+
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = host
+		req.Header.Set("Accept-Encoding", "gzip")
+		x.WriteRequest(req)
+
+		resp, body := x.ReadResponse()
+		c.Check(resp.Header.Get("Content-Encoding"), Equals, r.contentEncoding)
+		c.Check(body, Equals, r.body)
+
+		x.Close()
+		ln.Close()
+	}
+}
+
+func (s *ProxySuite) TestRewritesHeaders(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Internal-Auth"), Equals, "secret")
+		c.Check(req.Header.Get("X-Debug"), Equals, "")
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Server", "nginx")
+		resp.Header.Set("X-Powered-By", "PHP")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	s.registerTagged(c, "app.rewritten", ln.Addr(), map[string]string{
+		RemoveRequestHeadersTag:                        "X-Debug",
+		SetResponseHeaderTagPrefix + "X-Frame-Options": "DENY",
+		RemoveResponseHeadersTag:                       "X-Powered-By",
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app.rewritten"
+	req.Header.Set("X-Debug", "1")
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Server"), Equals, "")
+	c.Check(resp.Header.Get("X-Powered-By"), Equals, "")
+	c.Check(resp.Header.Get("X-Frame-Options"), Equals, "DENY")
+}
+
+func (s *ProxySuite) TestSendsRequestsThroughRouteService(c *C) {
+	app, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer app.Close()
+
+	s.serve(c, app, func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.RequestURI, Equals, "/path?x=1")
+		c.Check(req.Header.Get(RouteServiceForwardedUrl), Equals, "")
+		c.Check(req.Header.Get(RouteServiceSignature), Equals, "")
+
+		resp := newResponse(http.StatusOK)
+		resp.Body = ioutil.NopCloser(strings.NewReader("app"))
+		resp.ContentLength = 3
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer service.Close()
+
+	s.serve(c, service, func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Host, Equals, service.Addr().String())
+		c.Check(req.RequestURI, Equals, "/check")
+		c.Check(req.Header.Get(RouteServiceForwardedUrl), Equals, "http://app/path?x=1")
+
+		// Send the request on to the app through the router
+		y := s.DialProxy(c)
+		out := y.NewRequest("GET", "/path?x=1", nil)
+		out.Host = "app"
+		out.Header.Set(RouteServiceForwardedUrl, req.Header.Get(RouteServiceForwardedUrl))
+		out.Header.Set(RouteServiceSignature, req.Header.Get(RouteServiceSignature))
+		y.WriteRequest(out)
+
+		resp, body := y.ReadResponse()
+		resp.Header.Set("X-Route-Service", "checked")
+		resp.Body = ioutil.NopCloser(strings.NewReader(body))
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	s.registerRouteService(c, "app", app.Addr(), "http://"+service.Addr().String()+"/check")
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/path?x=1", nil)
+	req.Host = "app"
+	x.WriteRequest(req)
+
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("X-Route-Service"), Equals, "checked")
+	c.Check(body, Equals, "app")
+}
+
+func (s *ProxySuite) TestRejectsRequestsWithInvalidRouteServiceSignature(c *C) {
+	app, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer app.Close()
+
+	s.serve(c, app, func(x *httpConn) {
+		c.Error("request reached the app")
+		x.Close()
+	})
+
+	s.registerRouteService(c, "app", app.Addr(), "http://127.0.0.1:1/check")
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set(RouteServiceForwardedUrl, "http://app/")
+	req.Header.Set(RouteServiceSignature, RouteServices{Key: []byte("other")}.sign("http://app/", time.Now()))
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "route_service_request_invalid")
+}
+
+func (s *ProxySuite) TestRespondsWith502WhenRouteServiceFails(c *C) {
+	app, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer app.Close()
+
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	service.Close()
+
+	s.registerRouteService(c, "app", app.Addr(), "http://"+service.Addr().String()+"/check")
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "route_service_failure")
+}
+
+func (s *ProxySuite) TestRouteServiceIsNotVerifiedAgainstBackendCAs(c *C) {
+	certificate := test_util.CreateTLSCertificate("localhost")
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	c.Assert(err, IsNil)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(leaf)
+	s.p.(*proxy).transports = newEndpointTransports(s.conf.EndpointTimeout, 0, 0, rootCAs)
+
+	app, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer app.Close()
+
+	service, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	c.Assert(err, IsNil)
+	defer service.Close()
+
+	s.serve(c, service, func(x *httpConn) {
+		// The handshake fails when the router doesn't trust the certificate
+		if _, err := http.ReadRequest(x.reader); err == nil {
+			c.Error("request reached the route service")
+		}
+		x.Close()
+	})
+
+	_, port, _ := net.SplitHostPort(service.Addr().String())
+	s.registerRouteService(c, "app", app.Addr(), "https://localhost:"+port+"/check")
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "route_service_failure")
+}
+
+func (s *ProxySuite) TestCachesResponse(c *C) {
+	requests := make(chan *http.Request, 10)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		for {
+			req, err := http.ReadRequest(x.reader)
+			if err != nil {
+				return
+			}
+			requests <- req
+
+			resp := newResponse(http.StatusOK)
+			resp.Header.Set("Cache-Control", "max-age=60")
+			resp.Header.Set("ETag", `"v1"`)
+			resp.Body = ioutil.NopCloser(strings.NewReader("cached"))
+			resp.ContentLength = 6
+			x.WriteResponse(resp)
+		}
+	})
+
+	s.registerTagged(c, "cached", ln.Addr(), map[string]string{ResponseCacheTag: "true"})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/asset", nil)
+	req.Host = "cached"
+
+	x.WriteRequest(req)
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(body, Equals, "cached")
+	s.checkAccessLog(c, " cache:miss\n")
+
+	x.WriteRequest(req)
+	resp, body = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Age"), Equals, "0")
+	c.Check(body, Equals, "cached")
+	s.checkAccessLog(c, " cache:hit\n")
+
+	req.Header.Set("If-None-Match", `"v1"`)
+	x.WriteRequest(req)
+	resp, body = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusNotModified)
+	c.Check(body, Equals, "")
+
+	c.Check(requests, HasLen, 1)
+}
+
+func (s *ProxySuite) TestRevalidatesStaleResponse(c *C) {
+	requests := make(chan *http.Request, 10)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		for {
+			req, err := http.ReadRequest(x.reader)
+			if err != nil {
+				return
+			}
+			requests <- req
+
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				resp := newResponse(http.StatusNotModified)
+				resp.Header.Set("Cache-Control", "max-age=60")
+				x.WriteResponse(resp)
+				continue
+			}
+
+			resp := newResponse(http.StatusOK)
+			resp.Header.Set("Cache-Control", "max-age=1")
+			resp.Header.Set("ETag", `"v1"`)
+			resp.Body = ioutil.NopCloser(strings.NewReader("cached"))
+			resp.ContentLength = 6
+			x.WriteResponse(resp)
+		}
+	})
+
+	s.registerTagged(c, "cached", ln.Addr(), map[string]string{ResponseCacheTag: "true"})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/asset", nil)
+	req.Host = "cached"
+
+	x.WriteRequest(req)
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(body, Equals, "cached")
+	s.checkAccessLog(c, " cache:miss\n")
+
+	time.Sleep(1100 * time.Millisecond)
+
+	x.WriteRequest(req)
+	resp, body = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Cache-Control"), Equals, "max-age=60")
+	c.Check(body, Equals, "cached")
+	s.checkAccessLog(c, " cache:revalidated\n")
+
+	x.WriteRequest(req)
+	resp, body = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(body, Equals, "cached")
+	s.checkAccessLog(c, " cache:hit\n")
+
+	c.Assert(requests, HasLen, 2)
+	<-requests
+	revalidation := <-requests
+	c.Check(revalidation.Header.Get("If-None-Match"), Equals, `"v1"`)
+}
+
+func (s *ProxySuite) TestDoesNotCacheRoutesWithoutTag(c *C) {
+	requests := make(chan *http.Request, 10)
+
+	ln := s.RegisterHandler(c, "uncached", func(x *httpConn) {
+		for {
+			req, err := http.ReadRequest(x.reader)
+			if err != nil {
+				return
+			}
+			requests <- req
+
+			resp := newResponse(http.StatusOK)
+			resp.Header.Set("Cache-Control", "max-age=60")
+			resp.ContentLength = 0
+			x.WriteResponse(resp)
+		}
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "uncached"
+
+	for i := 0; i < 2; i++ {
+		x.WriteRequest(req)
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusOK)
+	}
+
+	c.Check(requests, HasLen, 2)
+}
+
+func (s *ProxySuite) TestTransferEncodingChunked(c *C) {
+	ln := s.RegisterHandler(c, "chunk", func(responseDestination *httpConn) {
+		r, w := io.Pipe()
+
+		// Write 3 times on a 100ms interval
+		go func() {
+			t := time.NewTicker(100 * time.Millisecond)
+			defer t.Stop()
+			defer w.Close()
+
+			for i := 0; i < 3; i++ {
+				<-t.C
+				_, err := w.Write([]byte("hello"))
+				c.Assert(err, IsNil)
+			}
+		}()
+
+		resp := newResponse(http.StatusOK)
+		resp.TransferEncoding = []string{"chunked"}
+		resp.Body = r
+		resp.Write(responseDestination)
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "chunk"
+
+	err := req.Write(x)
+	c.Assert(err, IsNil)
+
+	resp, err := http.ReadResponse(x.reader, &http.Request{})
+	c.Assert(err, IsNil)
+
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.TransferEncoding, DeepEquals, []string{"chunked"})
+
+	// Expect 3 individual reads to complete
+	for i := 0; i < 3; i++ {
+		var b [16]byte
+
+		n, err := resp.Body.Read(b[0:])
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, 5)
+		c.Check(string(b[0:n]), Equals, "hello")
+	}
+}
+
+func (s *ProxySuite) TestStatusNoContentHasNoTransferEncodingInResponse(c *C) {
+	ln := s.RegisterHandler(c, "not-modified", func(x *httpConn) {
+		resp := newResponse(http.StatusNoContent)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+
+	req.Header.Set("Connection", "close")
+	req.Host = "not-modified"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	fmt.Printf("response: %#v\n", resp)
+	c.Check(resp.StatusCode, Equals, http.StatusNoContent)
+	c.Check(resp.TransferEncoding, IsNil)
+}
+
+func (s *ProxySuite) TestRequestIsOkWithEncodedString(c *C) {
+	ln := s.RegisterHandler(c, "encoding", func(x *httpConn) {
+		x.CheckLine("GET /hello%2Bworld?inline-depth=1 HTTP/1.1")
+		resp := newResponse(http.StatusOK)
+		x.WriteResponse(resp)
+		x.Close()
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/hello%2Bworld?inline-depth=1", nil)
+	req.Host = "encoding"
+	x.WriteRequest(req)
+	resp, _ := x.ReadResponse()
 	fmt.Printf("response: %#v\n", resp)
 	c.Check(resp.StatusCode, Equals, http.StatusOK)
 }
@@ -738,3 +2178,371 @@ func (s *ProxySuite) TestRequestTerminatedWhenClientClosesConnection(c *C) {
 
 	c.Assert(<-serverResult, NotNil)
 }
+
+func (s *ProxySuite) TestEndpointConnectionIsKeptAlive(c *C) {
+	accepted := make(chan bool, 2)
+
+	ln := s.RegisterHandler(c, "keep-alive", func(x *httpConn) {
+		accepted <- true
+
+		for i := 0; i < 2; i++ {
+			req, _ := x.ReadRequest()
+			c.Check(req.Close, Equals, false)
+
+			resp := newResponse(http.StatusOK)
+			resp.Header.Set("Connection", "keep-alive")
+			resp.Header.Set("Keep-Alive", "timeout=5")
+			x.WriteResponse(resp)
+		}
+	})
+	defer ln.Close()
+
+	for i := 0; i < 2; i++ {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "keep-alive"
+		req.Header.Set("Connection", "close")
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusOK)
+		c.Check(resp.Header.Get("Keep-Alive"), Equals, "")
+	}
+
+	c.Check(len(accepted), Equals, 1)
+}
+
+func (s *ProxySuite) TestIdleEndpointConnectionIsClosedOnUnregister(c *C) {
+	closed := make(chan bool)
+
+	ln := s.RegisterHandler(c, "keep-alive", func(x *httpConn) {
+		x.ReadRequest()
+		x.WriteResponse(newResponse(http.StatusOK))
+
+		_, err := x.reader.ReadByte()
+		c.Check(err, Equals, io.EOF)
+		closed <- true
+	})
+	defer ln.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "keep-alive"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	h, p, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(p)
+	s.r.Unregister("keep-alive", &route.Endpoint{Host: h, Port: uint16(port)})
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		c.Error("idle connection to endpoint was not closed")
+	}
+}
+
+func (s *ProxySuite) TestDialFailureIsRetriedOnAnotherEndpoint(c *C) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.registerAddr("retry", dead.Addr())
+	dead.Close()
+
+	ln := s.RegisterHandler(c, "retry", func(x *httpConn) {
+		req, body := x.ReadRequest()
+		c.Check(req.Method, Equals, "POST")
+		c.Check(body, Equals, "some body")
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+	defer ln.Close()
+
+	for i := 0; i < 5; i++ {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("POST", "/", strings.NewReader("some body"))
+		req.Host = "retry"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusOK)
+	}
+}
+
+func (s *ProxySuite) TestRetryOnlyRewritesHeadersForTheNextEndpoint(c *C) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.registerTagged(c, "retry", dead.Addr(), map[string]string{
+		SetRequestHeaderTagPrefix + "X-Endpoint": "dead",
+		RemoveRequestHeadersTag:                  "X-Debug",
+	})
+	dead.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	s.serve(c, ln, func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Endpoint"), Equals, "live")
+		c.Check(req.Header.Get("X-Debug"), Equals, "1")
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	s.registerTagged(c, "retry", ln.Addr(), map[string]string{
+		AddRequestHeaderTagPrefix + "X-Endpoint": "live",
+	})
+
+	for i := 0; i < 5; i++ {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "retry"
+		req.Header.Set("X-Debug", "1")
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusOK)
+	}
+}
+
+func (s *ProxySuite) TestSetsXForwardedProtoForTLSRequests(c *C) {
+	ln := s.RegisterHandler(c, "tls", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "https")
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+	defer ln.Close()
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{test_util.CreateTLSCertificate("tls")}}
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	c.Assert(err, IsNil)
+	defer tlsListener.Close()
+
+	go (&server.Server{Handler: s.p}).Serve(tlsListener)
+
+	conn, err := tls.Dial("tcp", tlsListener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+
+	x := newConn(conn, c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "tls"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ProxySuite) TestRoutesByLongestPathPrefix(c *C) {
+	respondWith := func(body string) connHandler {
+		return func(x *httpConn) {
+			x.ReadRequest()
+
+			resp := newResponse(http.StatusOK)
+			resp.Header.Set("Connection", "close")
+			resp.Body = ioutil.NopCloser(strings.NewReader(body))
+			x.WriteResponse(resp)
+			x.Close()
+		}
+	}
+
+	ln1 := s.RegisterHandler(c, "paths", respondWith("root"))
+	defer ln1.Close()
+
+	ln2 := s.RegisterHandler(c, "paths/api", respondWith("api"))
+	defer ln2.Close()
+
+	for path, expected := range map[string]string{
+		"/":              "root",
+		"/apidocs":       "root",
+		"/api":           "api",
+		"/api/users?q=1": "api",
+	} {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", path, nil)
+		req.Host = "paths"
+		x.WriteRequest(req)
+
+		_, body := x.ReadResponse()
+		c.Check(body, Equals, expected, Commentf("path: %s", path))
+	}
+}
+
+func (s *ProxySuite) TestEndpointReturningServerErrorsIsEjected(c *C) {
+	s.conf.OutlierDetection.ConsecutiveFailures = 5
+	s.r = registry.NewCFRegistry(s.conf, fakeyagnats.New())
+	s.p.(*proxy).registry = s.r
+
+	respondWith := func(status int) connHandler {
+		return func(x *httpConn) {
+			x.ReadRequest()
+
+			resp := newResponse(status)
+			resp.Header.Set("Connection", "close")
+			x.WriteResponse(resp)
+			x.Close()
+		}
+	}
+
+	ln1 := s.RegisterHandler(c, "outlier", respondWith(http.StatusInternalServerError))
+	defer ln1.Close()
+
+	ln2 := s.RegisterHandler(c, "outlier", respondWith(http.StatusOK))
+	defer ln2.Close()
+
+	serverErrors := 0
+	for i := 0; i < 20; i++ {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "outlier"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		if resp.StatusCode == http.StatusInternalServerError {
+			serverErrors++
+		}
+	}
+
+	c.Check(serverErrors, Equals, 5)
+}
+
+func (s *ProxySuite) TestIdempotentRequestIsRetriedOnAnotherEndpoint(c *C) {
+	hangUp := func(x *httpConn) {
+		x.ReadRequest()
+		x.Close()
+	}
+
+	respond := func(x *httpConn) {
+		x.ReadRequest()
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	}
+
+	ln1 := s.RegisterHandler(c, "retry", hangUp)
+	defer ln1.Close()
+	ln2 := s.RegisterHandler(c, "retry", respond)
+	defer ln2.Close()
+
+	for i := 0; i < 5; i++ {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "retry"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusOK)
+	}
+}
+
+func (s *ProxySuite) TestNonIdempotentRequestIsNotRetriedOnceSent(c *C) {
+	received := make(chan bool, 2)
+
+	hangUp := func(x *httpConn) {
+		x.ReadRequest()
+		received <- true
+		x.Close()
+	}
+
+	ln1 := s.RegisterHandler(c, "no-retry", hangUp)
+	defer ln1.Close()
+	ln2 := s.RegisterHandler(c, "no-retry", hangUp)
+	defer ln2.Close()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", strings.NewReader("some body"))
+	req.Host = "no-retry"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Check(len(received), Equals, 1)
+}
+
+func (s *ProxySuite) TestTimedOutRequestIsNotRetried(c *C) {
+	received := make(chan string, 4)
+	release := make(chan bool)
+	defer close(release)
+
+	hang := func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		received <- req.Method
+		<-release
+		x.Close()
+	}
+
+	ln1 := s.RegisterHandler(c, "timeout", hang)
+	defer ln1.Close()
+	ln2 := s.RegisterHandler(c, "timeout", hang)
+	defer ln2.Close()
+
+	for _, method := range []string{"POST", "GET"} {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest(method, "/", nil)
+		req.Host = "timeout"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusBadGateway)
+		c.Check(<-received, Equals, method)
+		c.Check(len(received), Equals, 0)
+	}
+}
+
+func (s *ProxySuite) TestInFlightRequestsAreCounted(c *C) {
+	respond := make(chan bool)
+
+	ln := s.RegisterHandler(c, "in-flight", func(x *httpConn) {
+		x.ReadRequest()
+		<-respond
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+	defer ln.Close()
+
+	endpoint, found := s.r.Lookup("in-flight")
+	c.Assert(found, Equals, true)
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "in-flight"
+	x.WriteRequest(req)
+
+	time.Sleep(100 * time.Millisecond)
+	c.Check(endpoint.InFlight(), Equals, int32(1))
+
+	respond <- true
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	time.Sleep(10 * time.Millisecond)
+	c.Check(endpoint.InFlight(), Equals, int32(0))
+}
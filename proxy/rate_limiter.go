@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Buckets that have been full since the last pruning are dropped; a new
+// bucket starts out full anyway.
+const rateLimiterPruneInterval = time.Minute
+
+// A RateLimit allows requests at a sustained rate, and in bursts of up to
+// Burst requests above it. A zero rate allows any number of requests.
+type RateLimit struct {
+	RequestsPerSecond int
+	Burst             int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.RequestsPerSecond > 0
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+
+	return float64(l.Burst)
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+
+	// When the bucket will have refilled if no more tokens are taken
+	full time.Time
+}
+
+// rateLimiter keeps a token bucket per key, such as a route or a client's
+// address.
+type rateLimiter struct {
+	sync.Mutex
+
+	buckets map[interface{}]*tokenBucket
+	pruned  time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[interface{}]*tokenBucket),
+		pruned:  time.Now(),
+	}
+}
+
+// take takes a token from the key's bucket. If the bucket is empty it returns
+// false, along with how long it takes until a token is available.
+func (r *rateLimiter) take(key interface{}, limit RateLimit, now time.Time) (bool, time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	if now.Sub(r.pruned) >= rateLimiterPruneInterval {
+		r.prune(now)
+	}
+
+	rate := float64(limit.RequestsPerSecond)
+	burst := limit.burst()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, updated: now}
+		r.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.updated).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+
+	b.tokens--
+	b.full = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+
+	return true, 0
+}
+
+// giveBack returns a token taken from the key's bucket at the same time.
+func (r *rateLimiter) giveBack(key interface{}, limit RateLimit) {
+	r.Lock()
+	defer r.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		return
+	}
+
+	rate := float64(limit.RequestsPerSecond)
+	burst := limit.burst()
+
+	b.tokens++
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.full = b.updated.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+}
+
+func (r *rateLimiter) prune(now time.Time) {
+	for key, b := range r.buckets {
+		if !now.Before(b.full) {
+			delete(r.buckets, key)
+		}
+	}
+
+	r.pruned = now
+}
+
+// A rateLimitBucket is one of the buckets a request takes a token from,
+// named after the limit it enforces.
+type rateLimitBucket struct {
+	name    string
+	limiter *rateLimiter
+	key     interface{}
+	limit   RateLimit
+}
+
+// takeAll takes a token from each bucket. If one of them is empty, it gives
+// back the tokens already taken, so that requests turned away by one limit
+// are not counted against the others, and returns the name of the limit
+// along with how long it takes until a token is available.
+func takeAll(buckets []rateLimitBucket, now time.Time) (string, time.Duration) {
+	for i, b := range buckets {
+		ok, retryAfter := b.limiter.take(b.key, b.limit, now)
+		if ok {
+			continue
+		}
+
+		for _, taken := range buckets[:i] {
+			taken.limiter.giveBack(taken.key, taken.limit)
+		}
+
+		return b.name, retryAfter
+	}
+
+	return "", 0
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type RateLimiterSuite struct{}
+
+var _ = Suite(&RateLimiterSuite{})
+
+func (s *RateLimiterSuite) TestBurstThenRate(c *C) {
+	r := newRateLimiter()
+	limit := RateLimit{RequestsPerSecond: 2, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := r.take("key", limit, now)
+		c.Check(ok, Equals, true)
+	}
+
+	ok, retryAfter := r.take("key", limit, now)
+	c.Check(ok, Equals, false)
+	c.Check(retryAfter, Equals, 500*time.Millisecond)
+
+	ok, _ = r.take("key", limit, now.Add(500*time.Millisecond))
+	c.Check(ok, Equals, true)
+
+	ok, _ = r.take("key", limit, now.Add(500*time.Millisecond))
+	c.Check(ok, Equals, false)
+}
+
+func (s *RateLimiterSuite) TestKeysHaveTheirOwnBuckets(c *C) {
+	r := newRateLimiter()
+	limit := RateLimit{RequestsPerSecond: 1, Burst: 1}
+	now := time.Now()
+
+	ok, _ := r.take("a", limit, now)
+	c.Check(ok, Equals, true)
+
+	ok, _ = r.take("a", limit, now)
+	c.Check(ok, Equals, false)
+
+	ok, _ = r.take("b", limit, now)
+	c.Check(ok, Equals, true)
+}
+
+func (s *RateLimiterSuite) TestFullBucketsArePruned(c *C) {
+	r := newRateLimiter()
+	limit := RateLimit{RequestsPerSecond: 1, Burst: 10}
+	now := time.Now()
+
+	r.take("a", limit, now)
+	r.take("b", limit, now.Add(rateLimiterPruneInterval))
+	c.Check(r.buckets, HasLen, 1)
+
+	_, ok := r.buckets["b"]
+	c.Check(ok, Equals, true)
+}
+
+func (s *RateLimiterSuite) TestTakeAllGivesBackTokensWhenALimitIsExceeded(c *C) {
+	client := newRateLimiter()
+	route := newRateLimiter()
+	now := time.Now()
+
+	buckets := []rateLimitBucket{
+		{"client_ip", client, "1.2.3.4", RateLimit{RequestsPerSecond: 1, Burst: 2}},
+		{"route", route, "foo", RateLimit{RequestsPerSecond: 1, Burst: 1}},
+	}
+
+	limited, _ := takeAll(buckets, now)
+	c.Check(limited, Equals, "")
+
+	limited, retryAfter := takeAll(buckets, now)
+	c.Check(limited, Equals, "route")
+	c.Check(retryAfter, Equals, time.Second)
+
+	// The client's token was given back
+	ok, _ := client.take("1.2.3.4", buckets[0].limit, now)
+	c.Check(ok, Equals, true)
+
+	ok, _ = client.take("1.2.3.4", buckets[0].limit, now)
+	c.Check(ok, Equals, false)
+}
@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +19,20 @@ import (
 	steno "github.com/cloudfoundry/gosteno"
 )
 
+// Hop-by-hop headers, which are meaningful only for a single connection and
+// must not be forwarded by proxies (RFC 2616, section 13.5.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
 type RequestHandler struct {
 	logger *steno.Logger
 
@@ -23,6 +40,51 @@ type RequestHandler struct {
 	response http.ResponseWriter
 
 	transport *http.Transport
+
+	body     *retryableBody
+	attempts int
+
+	// The request's headers before the rewrites for the endpoint, which are
+	// applied again to them when the request is retried
+	header http.Header
+
+	errorTemplates map[string]*template.Template
+	headerRewrites HeaderRewrites
+	stickySessions StickySessions
+
+	forwarding forwarding
+	trace      traceContext
+
+	requestId       string
+	requestIdHeader string
+}
+
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// retryableBody keeps the transport from closing the client's request body
+// after a failed attempt, and records whether any of the body was sent, in
+// which case the request can no longer be replayed against another endpoint.
+// It also records why reading the body failed, if it did.
+type retryableBody struct {
+	io.ReadCloser
+	consumed bool
+	err      error
+}
+
+func (b *retryableBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.consumed = true
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+
+	return n, err
+}
+
+func (b *retryableBody) Close() error {
+	return nil
 }
 
 func NewRequestHandler(request *http.Request, response http.ResponseWriter) RequestHandler {
@@ -34,12 +96,75 @@ func NewRequestHandler(request *http.Request, response http.ResponseWriter) Requ
 	logger.Set("X-Forwarded-For", request.Header["X-Forwarded-For"])
 	logger.Set("X-Forwarded-Proto", request.Header["X-Forwarded-Proto"])
 
-	return RequestHandler{
+	h := RequestHandler{
 		logger: logger,
 
 		request:  request,
 		response: response,
 	}
+
+	return h
+}
+
+// SetupForwarding works out where the request came from, trusting the
+// forwarding headers of peers in trustedProxies.
+func (h *RequestHandler) SetupForwarding(trustedProxies []*net.IPNet) {
+	h.forwarding = newForwarding(h.request, trustedProxies)
+	h.logger.Set("ClientIp", h.forwarding.clientIp)
+}
+
+// SetupTrace joins the trace the request belongs to or starts a new one,
+// keeping the sampling decision of peers in trustedProxies and sampling
+// sampleRate of the other traces.
+func (h *RequestHandler) SetupTrace(sampleRate float64, trustedProxies []*net.IPNet) {
+	trusted := trusts(trustedProxies, h.forwarding.peer())
+
+	h.trace = newTraceContext(h.request.Header, trusted, sampleRate)
+	h.logger.Set("TraceId", h.trace.traceId)
+	h.logger.Set("SpanId", h.trace.spanId)
+}
+
+// SetupRequestId gives the request its ID, which is sent to endpoints and
+// back to the client in the named header. A valid ID sent by a peer in
+// trustedProxies is kept, so that the request can be followed through the
+// proxies in front of the router; otherwise a new one is generated.
+// Endpoints always get the ID in X-Vcap-Request-Id as well, so that they
+// never see one the client made up there.
+func (h *RequestHandler) SetupRequestId(header string, trustedProxies []*net.IPNet) {
+	id := h.request.Header.Get(header)
+	if !trusts(trustedProxies, h.forwarding.peer()) || !isRequestId(id) {
+		id = common.GenerateUUID()
+	}
+
+	h.requestId = id
+	h.requestIdHeader = header
+
+	h.request.Header.Set(header, id)
+	h.request.Header.Set(router_http.VcapRequestIdHeader, id)
+	h.logger.Set(router_http.VcapRequestIdHeader, id)
+	h.echoRequestId()
+}
+
+// RequestId returns the ID of the request.
+func (h *RequestHandler) RequestId() string {
+	return h.requestId
+}
+
+// echoRequestId sets the request ID on the response, replacing any the
+// endpoint sent.
+func (h *RequestHandler) echoRequestId() {
+	h.response.Header().Set(h.requestIdHeader, h.requestId)
+}
+
+// ClientIp returns the address of the client the request came from, which
+// may be behind proxies.
+func (h *RequestHandler) ClientIp() string {
+	return h.forwarding.clientIp
+}
+
+// ForwardedProto returns the protocol the client sent the request over.
+func (h *RequestHandler) ForwardedProto() string {
+	return h.forwarding.proto
 }
 
 func (h *RequestHandler) HandleHeartbeat() {
@@ -47,14 +172,28 @@ func (h *RequestHandler) HandleHeartbeat() {
 	h.response.Write([]byte("ok\n"))
 }
 
+func (h *RequestHandler) HandleDrainingHeartbeat() {
+	h.response.WriteHeader(http.StatusServiceUnavailable)
+	h.response.Write([]byte("draining\n"))
+}
+
 func (h *RequestHandler) HandleUnsupportedProtocol() {
+	h.response.Header().Set("X-Cf-RouterError", "unsupported_protocol")
+
 	client, connection, err := h.hijack()
 	if err != nil {
 		h.writeStatus(http.StatusBadRequest, "Unsupported protocol.")
 		return
 	}
 
-	fmt.Fprintf(connection, "HTTP/1.0 400 Bad Request\r\n\r\n")
+	// The server cannot write responses in the client's protocol
+	contentType, body := h.errorPage(http.StatusBadRequest, "Unsupported protocol.")
+	fmt.Fprintf(connection, "HTTP/1.0 400 Bad Request\r\n")
+	fmt.Fprintf(connection, "Content-Type: %s\r\n", contentType)
+	fmt.Fprintf(connection, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(connection, "%s: %s\r\n", h.requestIdHeader, h.requestId)
+	fmt.Fprintf(connection, "X-Cf-RouterError: unsupported_protocol\r\n\r\n")
+	connection.Write(body)
 	connection.Flush()
 	client.Close()
 }
@@ -66,6 +205,13 @@ func (h *RequestHandler) HandleMissingRoute() {
 	h.writeStatus(http.StatusNotFound, message)
 }
 
+func (h *RequestHandler) HandleNoAvailableEndpoints() {
+	h.logger.Warnf("proxy.endpoint.none-available")
+	h.response.Header().Set("X-Cf-RouterError", "no_available_endpoints")
+	message := fmt.Sprintf("Requested route ('%s') has no available endpoints.", h.request.Host)
+	h.writeStatus(http.StatusServiceUnavailable, message)
+}
+
 func (h *RequestHandler) HandleBadGateway(err error) {
 	h.logger.Set("Error", err.Error())
 	h.logger.Warnf("proxy.endpoint.failed")
@@ -73,48 +219,203 @@ func (h *RequestHandler) HandleBadGateway(err error) {
 	h.writeStatus(http.StatusBadGateway, "Registered endpoint failed to handle the request.")
 }
 
-func (h *RequestHandler) HandleTcpRequest(endpoint *route.Endpoint) {
+func (h *RequestHandler) HandleRateLimited(limit string, retryAfter time.Duration) {
+	h.logger.Set("RateLimit", limit)
+	h.logger.Warnf("proxy.rate-limited")
+
+	// Retry-After is in whole seconds
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	h.response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	h.response.Header().Set("X-Cf-RouterError", "rate_limited")
+	h.writeStatus(http.StatusTooManyRequests, "Too many requests.")
+}
+
+// HandleRequestBodyFailed answers requests whose body is too large or did
+// not arrive in time. The rest of the body is not read, so the connection is
+// closed.
+func (h *RequestHandler) HandleRequestBodyFailed(status int, err error) {
+	h.logger.Set("Error", err.Error())
+	h.logger.Warnf("proxy.request-body.failed")
+
+	h.response.Header().Set("Connection", "close")
+
+	switch status {
+	case http.StatusRequestEntityTooLarge:
+		h.response.Header().Set("X-Cf-RouterError", "request_body_too_large")
+		h.writeStatus(status, "Request body too large.")
+	case http.StatusRequestTimeout:
+		h.response.Header().Set("X-Cf-RouterError", "request_timeout")
+		h.writeStatus(status, "Request body not received in time.")
+	default:
+		h.response.Header().Set("X-Cf-RouterError", "bad_request_body")
+		h.writeStatus(status, "Request body could not be read.")
+	}
+}
+
+// LimitRequestBody makes reading more than limit bytes of the request body
+// fail.
+func (h *RequestHandler) LimitRequestBody(limit int64) {
+	if h.request.Body == nil || h.request.Body == http.NoBody {
+		return
+	}
+
+	h.request.Body = http.MaxBytesReader(nil, h.request.Body, limit)
+}
+
+func (h *RequestHandler) HandleRouteServiceUnsupported() {
+	h.logger.Warnf("proxy.route-service.unsupported")
+	h.response.Header().Set("X-Cf-RouterError", "route_service_unsupported")
+	h.writeStatus(http.StatusBadGateway, "Route services are not supported for this request.")
+}
+
+func (h *RequestHandler) HandleInvalidRouteServiceRequest(err error) {
+	h.logger.Set("Error", err.Error())
+	h.logger.Warnf("proxy.route-service.invalid-request")
+	h.response.Header().Set("X-Cf-RouterError", "route_service_request_invalid")
+	h.writeStatus(http.StatusBadRequest, "Failed to validate route service signature.")
+}
+
+func (h *RequestHandler) HandleRouteServiceFailure(err error) {
+	h.logger.Set("Error", err.Error())
+	h.logger.Warnf("proxy.route-service.failed")
+	h.response.Header().Set("X-Cf-RouterError", "route_service_failure")
+	h.writeStatus(http.StatusBadGateway, "Route service failed to handle the request.")
+}
+
+// SetupRouteServiceRequest points the request at the route service, carrying
+// the URL the client requested and its signature. The request and its
+// headers are copied, so that it is logged as the client sent it.
+func (h *RequestHandler) SetupRouteServiceRequest(serviceUrl *url.URL, forwardedUrl, signature string) {
+	h.logger.Set("RouteService", serviceUrl.String())
+
+	request := *h.request
+	request.Host = serviceUrl.Host
+	request.URL = &url.URL{Host: serviceUrl.Host, Opaque: serviceUrl.RequestURI()}
+	request.Header = cloneHeader(h.request.Header)
+
+	request.Header.Set(RouteServiceForwardedUrl, forwardedUrl)
+	request.Header.Set(RouteServiceSignature, signature)
+
+	h.request = &request
+}
+
+// ClearRouteServiceHeaders removes the headers of a request the route service
+// sent back, before it is forwarded to the route's endpoints.
+func (h *RequestHandler) ClearRouteServiceHeaders() {
+	h.request.Header.Del(RouteServiceForwardedUrl)
+	h.request.Header.Del(RouteServiceSignature)
+}
+
+// A dialFunc opens a connection to an endpoint.
+type dialFunc func(endpoint *route.Endpoint) (net.Conn, error)
+
+func (h *RequestHandler) HandleTcpRequest(endpoint *route.Endpoint, dial dialFunc) {
 	h.logger.Set("Upgrade", "tcp")
 
-	err := h.serveTcp(endpoint)
+	err := h.serveTcp(endpoint, dial)
 	if err != nil {
 		h.logger.Set("Error", err.Error())
 		h.logger.Warn("proxy.tcp.failed")
+		h.response.Header().Set("X-Cf-RouterError", "tcp_failure")
 		h.writeStatus(http.StatusBadRequest, "TCP forwarding to endpoint failed.")
 	}
 }
 
-func (h *RequestHandler) HandleWebSocketRequest(endpoint *route.Endpoint) {
+func (h *RequestHandler) HandleWebSocketRequest(endpoint *route.Endpoint, dial dialFunc) {
 	h.setupRequest(endpoint)
 
 	h.logger.Set("Upgrade", "websocket")
 
-	err := h.serveWebSocket(endpoint)
+	err := h.serveWebSocket(endpoint, dial)
 	if err != nil {
 		h.logger.Set("Error", err.Error())
 		h.logger.Warn("proxy.websocket.failed")
+		h.response.Header().Set("X-Cf-RouterError", "websocket_failure")
 		h.writeStatus(http.StatusBadRequest, "WebSocket request to endpoint failed.")
 	}
 }
 
+func (h *RequestHandler) HandleRetry(endpoint *route.Endpoint, err error) {
+	h.logger.Set("Error", err.Error())
+	h.logger.Set("FailedEndpoint", endpoint.CanonicalAddr())
+	h.logger.Warnf("proxy.endpoint.retry")
+}
+
+func (h *RequestHandler) HandleEjection(endpoint *route.Endpoint, ejectionTime time.Duration) {
+	h.logger.Set("EjectedEndpoint", endpoint.CanonicalAddr())
+	h.logger.Set("EjectionTime", ejectionTime.String())
+	h.logger.Warnf("proxy.endpoint.ejected")
+}
+
 func (h *RequestHandler) HandleHttpRequest(transport *http.Transport, endpoint *route.Endpoint) (*http.Response, error) {
 	h.transport = transport
 
-	h.setupRequest(endpoint)
-	h.setupConnection()
+	if h.attempts == 0 {
+		h.setupRequest(endpoint)
+		h.setupConnection()
+		h.setupBody()
+	} else {
+		// The rewrites of the endpoint the request was sent to first must not
+		// be sent to the next one
+		h.setRequestURL(endpoint)
+		h.request.Header = cloneHeader(h.header)
+		h.rewriteRequestHeaders(endpoint)
+		h.setupConnection()
+	}
+
+	h.attempts++
 
 	endpointResponse, err := transport.RoundTrip(h.request)
 	if err != nil {
 		return endpointResponse, err
 	}
 
-	h.forwardResponseHeaders(endpointResponse)
+	h.forwardResponseHeaders(endpointResponse, endpoint)
 
 	h.setupStickySession(endpointResponse, endpoint)
 
 	return endpointResponse, err
 }
 
+// CanRetry reports whether the request may be sent to another endpoint after
+// failing with err. Requests are retried when the endpoint could not be
+// connected to, or when they are idempotent and the endpoint did not time
+// out, as the request may still be running there and the client would wait
+// for another timeout; never once any part of the request body has been sent.
+func (h *RequestHandler) CanRetry(err error) bool {
+	if h.body != nil && h.body.consumed {
+		return false
+	}
+
+	if isDialError(err) {
+		return true
+	}
+
+	return isIdempotent(h.request.Method) && !isTimeout(err)
+}
+
+// RequestBodyErr returns why reading the client's request body failed, if it
+// did.
+func (h *RequestHandler) RequestBodyErr() error {
+	if h.body == nil {
+		return nil
+	}
+
+	return h.body.err
+}
+
+// ForwardCachedResponseHeaders sets the headers of a response from the cache,
+// replacing those the endpoint sent along with a 304 Not Modified response.
+func (h *RequestHandler) ForwardCachedResponseHeaders(response *http.Response) {
+	for k, vv := range response.Header {
+		h.response.Header()[k] = vv
+	}
+}
+
 func (h *RequestHandler) SetTraceHeaders(routerIp, addr string) {
 	h.response.Header().Set(router_http.VcapRouterHeader, routerIp)
 	h.response.Header().Set(router_http.VcapBackendHeader, addr)
@@ -122,26 +423,63 @@ func (h *RequestHandler) SetTraceHeaders(routerIp, addr string) {
 }
 
 func (h *RequestHandler) WriteResponse(endpointResponse *http.Response) int64 {
+	h.echoRequestId()
 	h.response.WriteHeader(endpointResponse.StatusCode)
 
-	bytesSent, err := h.copyToResponse(endpointResponse.Body)
+	bytesSent, err := h.copyToResponse(h.response, endpointResponse.Body)
 	if err != nil {
 		h.logger.Set("Error", err.Error())
 		h.logger.Warnf("proxy.response.copy-failed")
+		return bytesSent
 	}
 
+	h.forwardResponseTrailers(endpointResponse)
+
 	return bytesSent
 }
 
-func (h *RequestHandler) copyToResponse(src io.ReadCloser) (int64, error) {
+// WriteCompressedResponse writes the response with its body gzipped. It
+// returns the number of bytes sent to the client and the size of the body
+// before compression.
+func (h *RequestHandler) WriteCompressedResponse(endpointResponse *http.Response, level int) (int64, int64) {
+	h.echoRequestId()
+
+	header := h.response.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+
+	// The compressed body is no longer the same byte for byte
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	h.response.WriteHeader(endpointResponse.StatusCode)
+
+	gz := newGzipWriter(h.response, level)
+
+	uncompressed, err := h.copyToResponse(gz, endpointResponse.Body)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		h.logger.Set("Error", err.Error())
+		h.logger.Warnf("proxy.response.copy-failed")
+		return gz.written(), uncompressed
+	}
+
+	h.forwardResponseTrailers(endpointResponse)
+
+	return gz.written(), uncompressed
+}
+
+func (h *RequestHandler) copyToResponse(dst io.Writer, src io.ReadCloser) (int64, error) {
 	if src == nil {
 		return 0, nil
 	}
 
-	var dst io.Writer = h.response
-
 	// Use MaxLatencyFlusher if needed
-	if v, ok := h.response.(writeFlusher); ok {
+	if v, ok := dst.(writeFlusher); ok {
 		u := NewMaxLatencyWriter(v, 50*time.Millisecond)
 		defer u.Stop()
 		dst = u
@@ -156,28 +494,28 @@ func (h *RequestHandler) copyToResponse(src io.ReadCloser) (int64, error) {
 }
 
 func (h *RequestHandler) setupRequest(endpoint *route.Endpoint) {
-	h.setRequestURL(endpoint.CanonicalAddr())
-	h.setRequestXForwardedFor()
+	h.setRequestURL(endpoint)
+	h.forwarding.setHeaders(h.request)
+	h.trace.setHeaders(h.request.Header)
 	h.setRequestXRequestStart()
-	h.setRequestXVcapRequestId()
-}
 
-func (h *RequestHandler) setRequestURL(addr string) {
-	h.request.URL.Scheme = "http"
-	h.request.URL.Host = addr
+	h.header = cloneHeader(h.request.Header)
+	h.rewriteRequestHeaders(endpoint)
 }
 
-func (h *RequestHandler) setRequestXForwardedFor() {
-	if host, _, err := net.SplitHostPort(h.request.RemoteAddr); err == nil {
-		// We assume there is a trusted upstream (L7 LB) that properly
-		// strips client's XFF header
+func (h *RequestHandler) rewriteRequestHeaders(endpoint *route.Endpoint) {
+	for _, rewrite := range h.rewrites(endpoint) {
+		rewrite.Request.apply(h.request.Header)
+	}
+}
 
-		// This is sloppy but fine since we don't share this request or
-		// headers. Otherwise we should copy the underlying header and
-		// append
-		xForwardFor := append(h.request.Header["X-Forwarded-For"], host)
-		h.request.Header.Set("X-Forwarded-For", strings.Join(xForwardFor, ", "))
+func (h *RequestHandler) setRequestURL(endpoint *route.Endpoint) {
+	h.request.URL.Scheme = "http"
+	if endpoint.TLS {
+		h.request.URL.Scheme = "https"
 	}
+
+	h.request.URL.Host = endpoint.CanonicalAddr()
 }
 
 func (h *RequestHandler) setRequestXRequestStart() {
@@ -186,55 +524,76 @@ func (h *RequestHandler) setRequestXRequestStart() {
 	}
 }
 
-func (h *RequestHandler) setRequestXVcapRequestId() {
-	uuid := common.GenerateUUID()
-	h.request.Header.Set(router_http.VcapRequestIdHeader, uuid)
-	h.logger.Set(router_http.VcapRequestIdHeader, uuid)
+func (h *RequestHandler) setupConnection() {
+	// Connections to the endpoint are pooled by the transport and are not
+	// tied to the lifetime of the client's connection
+	h.request.Close = false
+
+	// Endpoints only send trailers to clients that accept them
+	acceptsTrailers := hasToken(h.request.Header.Get("Te"), "trailers")
+
+	removeHopByHopHeaders(h.request.Header)
+
+	if acceptsTrailers {
+		h.request.Header.Set("Te", "trailers")
+	}
+}
+
+func (h *RequestHandler) setupBody() {
+	if h.request.Body == nil || h.request.Body == http.NoBody {
+		return
+	}
+
+	h.body = &retryableBody{ReadCloser: h.request.Body}
+	h.request.Body = h.body
 }
 
-func (h *RequestHandler) setupConnection() {
-	// Use a new connection for every request
-	// Keep-alive can be bolted on later, if we want to
-	h.request.Close = true
-	h.request.Header.Del("Connection")
+// releaseBody hands the client's request body back to the server once no
+// more attempts will be made, so that it is closed when the request finishes.
+func (h *RequestHandler) releaseBody() {
+	if h.body != nil {
+		h.request.Body = h.body.ReadCloser
+	}
 }
 
-func (h *RequestHandler) serveTcp(endpoint *route.Endpoint) error {
+func (h *RequestHandler) serveTcp(endpoint *route.Endpoint, dial dialFunc) error {
 	var err error
 
-	client, _, err := h.hijack()
+	// Dial first, so that the client still gets an error page if the
+	// endpoint cannot be reached
+	connection, err := dial(endpoint)
 	if err != nil {
 		return err
 	}
+	defer connection.Close()
 
-	connection, err := net.Dial("tcp", endpoint.CanonicalAddr())
+	client, _, err := h.hijack()
 	if err != nil {
 		return err
 	}
-
 	defer client.Close()
-	defer connection.Close()
 
 	forwardIO(client, connection)
 
 	return nil
 }
 
-func (h *RequestHandler) serveWebSocket(endpoint *route.Endpoint) error {
+func (h *RequestHandler) serveWebSocket(endpoint *route.Endpoint, dial dialFunc) error {
 	var err error
 
-	client, _, err := h.hijack()
+	// Dial first, so that the client still gets an error page if the
+	// endpoint cannot be reached
+	connection, err := dial(endpoint)
 	if err != nil {
 		return err
 	}
+	defer connection.Close()
 
-	connection, err := net.Dial("tcp", endpoint.CanonicalAddr())
+	client, _, err := h.hijack()
 	if err != nil {
 		return err
 	}
-
 	defer client.Close()
-	defer connection.Close()
 
 	err = h.request.Write(connection)
 	if err != nil {
@@ -246,7 +605,13 @@ func (h *RequestHandler) serveWebSocket(endpoint *route.Endpoint) error {
 	return nil
 }
 
-func (h *RequestHandler) forwardResponseHeaders(endpointResponse *http.Response) {
+func (h *RequestHandler) forwardResponseHeaders(endpointResponse *http.Response, endpoint *route.Endpoint) {
+	removeHopByHopHeaders(endpointResponse.Header)
+
+	for _, rewrite := range h.rewrites(endpoint) {
+		rewrite.Response.apply(endpointResponse.Header)
+	}
+
 	for k, vv := range endpointResponse.Header {
 		for _, v := range vv {
 			h.response.Header().Add(k, v)
@@ -254,22 +619,42 @@ func (h *RequestHandler) forwardResponseHeaders(endpointResponse *http.Response)
 	}
 }
 
-func (h *RequestHandler) setupStickySession(endpointResponse *http.Response, endpoint *route.Endpoint) {
-	needSticky := false
-	for _, v := range endpointResponse.Cookies() {
-		if v.Name == StickyCookieKey {
-			needSticky = true
-			break
-		}
+// rewrites returns the header rewrites for requests to the endpoint: the one
+// configured for the request's host, followed by the one of the endpoint's
+// tags, which is applied last so that it takes precedence.
+func (h *RequestHandler) rewrites(endpoint *route.Endpoint) []HeaderRewrite {
+	var rewrites []HeaderRewrite
+
+	if rewrite, ok := h.headerRewrites.lookup(hostWithoutPort(h.request)); ok {
+		rewrites = append(rewrites, rewrite)
+	}
+
+	if rewrite, ok := tagHeaderRewrite(endpoint); ok {
+		rewrites = append(rewrites, rewrite)
 	}
 
-	if needSticky && endpoint.PrivateInstanceId != "" {
-		cookie := &http.Cookie{
-			Name:  VcapCookieId,
-			Value: endpoint.PrivateInstanceId,
-			Path:  "/",
+	return rewrites
+}
+
+// forwardResponseTrailers passes on the trailers the endpoint sent after the
+// response body, which are only known once the body has been read.
+func (h *RequestHandler) forwardResponseTrailers(endpointResponse *http.Response) {
+	for k, vv := range endpointResponse.Trailer {
+		for _, v := range vv {
+			h.response.Header().Add(http.TrailerPrefix+k, v)
 		}
+	}
+}
+
+func (h *RequestHandler) setupStickySession(endpointResponse *http.Response, endpoint *route.Endpoint) {
+	cookie, err := h.stickySessions.affinityCookie(endpointResponse, endpoint.PrivateInstanceId, time.Now())
+	if err != nil {
+		h.logger.Set("Error", err.Error())
+		h.logger.Warnf("proxy.sticky-session.failed")
+		return
+	}
 
+	if cookie != nil {
 		http.SetCookie(h.response, cookie)
 	}
 }
@@ -279,18 +664,90 @@ func (h *RequestHandler) writeStatus(code int, message string) {
 
 	h.logger.Warn(body)
 
-	http.Error(h.response, body, code)
+	contentType, page := h.errorPage(code, message)
+
+	header := h.response.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	h.response.WriteHeader(code)
+	h.response.Write(page)
+}
+
+// errorPage renders the page for an error, which is reported by the
+// X-Cf-RouterError header set on the response.
+func (h *RequestHandler) errorPage(code int, message string) (string, []byte) {
+	page := ErrorPage{
+		Status:      code,
+		StatusText:  http.StatusText(code),
+		Message:     message,
+		RouterError: h.response.Header().Get("X-Cf-RouterError"),
+		RequestId:   h.requestId,
+		Host:        h.request.Host,
+	}
+
+	contentType, body, err := renderErrorPage(h.errorTemplates, h.request.Header.Get("Accept"), page)
+	if err != nil {
+		h.logger.Set("TemplateError", err.Error())
+		h.logger.Warn("proxy.error-page.failed")
+
+		contentType, body, _ = renderErrorPage(nil, "", page)
+	}
+
+	return contentType, body
 }
 
 func (h *RequestHandler) hijack() (client net.Conn, io *bufio.ReadWriter, err error) {
+	// HTTP/2 responses cannot be hijacked
 	hijacker, ok := h.response.(http.Hijacker)
 	if !ok {
-		panic("response writer cannot hijack")
+		return nil, nil, errors.New("response writer cannot hijack")
 	}
 
 	return hijacker.Hijack()
 }
 
+func isDialError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+
+	return false
+}
+
+// hasToken reports whether the comma-separated header value v contains
+// token, ignoring case.
+func hasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	// Headers listed in Connection are hop-by-hop as well
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
 func forwardIO(a, b net.Conn) {
 	done := make(chan bool, 2)
 
@@ -305,3 +762,20 @@ func forwardIO(a, b net.Conn) {
 
 	<-done
 }
+
+// isRequestId reports whether a request ID sent by a client is safe to pass on
+// and log: no longer than 128 characters, of letters, digits and punctuation
+// used by common ID formats.
+func isRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-_.:+/=", c)) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,461 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// Endpoints registered with this tag set to "true" or "false" switch the
+// response cache on or off for their route.
+const ResponseCacheTag = "response_cache"
+
+// ResponseCaching keeps responses to GET requests that are fresh according
+// to their Cache-Control or Expires headers in memory, up to MaxSize bytes in
+// total, and serves them to later requests for the same host and URI. The
+// least recently used responses are evicted first. A zero MaxSize disables
+// the cache. Routes are cached unless their tag says otherwise, or only when
+// their tag says so with OptIn.
+type ResponseCaching struct {
+	MaxSize      int64
+	MaxEntrySize int64
+	OptIn        bool
+}
+
+func (c ResponseCaching) enabled() bool {
+	return c.MaxSize > 0
+}
+
+func (c ResponseCaching) enabledFor(endpoint *route.Endpoint) bool {
+	switch endpoint.Tags[ResponseCacheTag] {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	return !c.OptIn
+}
+
+// Response statuses that can be cached (RFC 7231, section 6.1)
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+type cacheEntry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	size       int64
+	storedAt   time.Time
+	freshUntil time.Time
+
+	// How old the response already was when it was stored
+	initialAge time.Duration
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.freshUntil)
+}
+
+func (e *cacheEntry) etag() string {
+	return e.header.Get("ETag")
+}
+
+// response returns the stored response to request, which is 304 Not Modified
+// if the client already has it.
+func (e *cacheEntry) response(request *http.Request, now time.Time) *http.Response {
+	header := make(http.Header, len(e.header)+1)
+	for k, vv := range e.header {
+		header[k] = vv
+	}
+
+	age := e.initialAge + now.Sub(e.storedAt)
+	header.Set("Age", strconv.Itoa(int(age/time.Second)))
+
+	response := &http.Response{
+		StatusCode:    e.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+	}
+
+	if etag := e.etag(); etag != "" && etagMatches(request.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Length")
+		response.StatusCode = http.StatusNotModified
+		response.Body = nil
+		response.ContentLength = 0
+	}
+
+	return response
+}
+
+// refresh updates the entry with the headers of a 304 Not Modified response
+// from the endpoint confirming it is still valid. Entries handed out by the
+// cache are copies, so the header is replaced rather than changed.
+func (e *cacheEntry) refresh(response *http.Response, now time.Time) bool {
+	header := cloneHeader(e.header)
+	for k, vv := range response.Header {
+		if k != "Content-Length" {
+			header[k] = vv
+		}
+	}
+
+	freshUntil, initialAge, ok := freshness(header, now)
+	if !ok {
+		return false
+	}
+
+	e.header = header
+	e.storedAt = now
+	e.freshUntil = freshUntil
+	e.initialAge = initialAge
+	e.computeSize()
+	return true
+}
+
+func (e *cacheEntry) computeSize() {
+	e.size = int64(len(e.body) + len(e.key))
+	for k, vv := range e.header {
+		for _, v := range vv {
+			e.size += int64(len(k) + len(v))
+		}
+	}
+}
+
+type responseCache struct {
+	sync.Mutex
+
+	maxSize      int64
+	maxEntrySize int64
+	size         int64
+
+	// Most recently used entries first
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// The request headers that responses for a host and URI vary by
+	varyBy map[string][]string
+
+	onEvict func()
+}
+
+func newResponseCache(c ResponseCaching, onEvict func()) *responseCache {
+	maxEntrySize := c.MaxEntrySize
+	if maxEntrySize <= 0 || maxEntrySize > c.MaxSize {
+		maxEntrySize = c.MaxSize
+	}
+
+	return &responseCache{
+		maxSize:      c.MaxSize,
+		maxEntrySize: maxEntrySize,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+		varyBy:       make(map[string][]string),
+		onEvict:      onEvict,
+	}
+}
+
+// cacheableRequest reports whether a response to request may be served from
+// and stored in the cache. Requests with credentials are left alone, since
+// their responses may be meant for that client only.
+func cacheableRequest(request *http.Request) bool {
+	if request.Method != "GET" {
+		return false
+	}
+
+	h := request.Header
+	return h.Get("Authorization") == "" && h.Get("Range") == "" && !hasToken(h.Get("Cache-Control"), "no-store")
+}
+
+// revalidates reports whether the client asks for the response to be checked
+// with the endpoint instead of being served from the cache.
+func revalidates(request *http.Request) bool {
+	return hasToken(request.Header.Get("Cache-Control"), "no-cache") || hasToken(request.Header.Get("Pragma"), "no-cache")
+}
+
+func cacheKey(request *http.Request) string {
+	return strings.ToLower(hostWithoutPort(request)) + request.RequestURI
+}
+
+// get returns a copy of the entry stored for the request, fresh or not.
+func (c *responseCache) get(request *http.Request) *cacheEntry {
+	c.Lock()
+	defer c.Unlock()
+
+	key := cacheKey(request)
+	element, ok := c.entries[variantKey(key, c.varyBy[key], request)]
+	if !ok {
+		return nil
+	}
+
+	c.lru.MoveToFront(element)
+
+	entry := *element.Value.(*cacheEntry)
+	return &entry
+}
+
+// store wraps the response's body so that the response is stored once its
+// body has been read to the end, if it can be cached.
+func (c *responseCache) store(request *http.Request, response *http.Response, now time.Time) {
+	if !cacheableStatus[response.StatusCode] || response.ContentLength > c.maxEntrySize {
+		return
+	}
+
+	header := response.Header
+	if header.Get("Set-Cookie") != "" || len(response.Trailer) > 0 {
+		return
+	}
+
+	cacheControl := header.Get("Cache-Control")
+	if hasToken(cacheControl, "no-store") || hasToken(cacheControl, "no-cache") || hasToken(cacheControl, "private") {
+		return
+	}
+
+	vary := varyHeaders(header)
+	for _, name := range vary {
+		if name == "*" {
+			return
+		}
+	}
+
+	freshUntil, initialAge, ok := freshness(header, now)
+	if !ok || !freshUntil.After(now) {
+		return
+	}
+
+	key := cacheKey(request)
+	entry := &cacheEntry{
+		key:        variantKey(key, vary, request),
+		status:     response.StatusCode,
+		header:     cloneHeader(header),
+		storedAt:   now,
+		freshUntil: freshUntil,
+		initialAge: initialAge,
+	}
+
+	response.Body = &cacheRecorder{
+		ReadCloser: response.Body,
+		limit:      c.maxEntrySize,
+		stored: func(body []byte) {
+			entry.body = body
+			c.put(key, vary, entry)
+		},
+	}
+}
+
+// refresh updates the stored entry the endpoint confirmed to be valid, and
+// returns the updated copy. The entry is dropped if the endpoint no longer
+// tells how long it is fresh for.
+func (c *responseCache) refresh(entry *cacheEntry, response *http.Response, now time.Time) *cacheEntry {
+	refreshed := *entry
+	ok := refreshed.refresh(response, now)
+
+	c.Lock()
+	defer c.Unlock()
+
+	element, found := c.entries[entry.key]
+	if !found {
+		return &refreshed
+	}
+
+	if !ok {
+		c.remove(entry.key)
+		return &refreshed
+	}
+
+	stored := element.Value.(*cacheEntry)
+	c.size += refreshed.size - stored.size
+	*stored = refreshed
+	c.evict()
+
+	return &refreshed
+}
+
+func (c *responseCache) put(key string, vary []string, entry *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.remove(entry.key)
+
+	entry.computeSize()
+	if entry.size > c.maxSize {
+		return
+	}
+
+	c.varyBy[key] = vary
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache is within its
+// size limit.
+func (c *responseCache) evict() {
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back().Value.(*cacheEntry).key)
+
+		if c.onEvict != nil {
+			c.onEvict()
+		}
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, key)
+	c.size -= entry.size
+}
+
+// cacheRecorder keeps a copy of the response body as it is read, and stores
+// the response once all of it has been read, unless it turns out to be too
+// large.
+type cacheRecorder struct {
+	io.ReadCloser
+	body   bytes.Buffer
+	limit  int64
+	stored func(body []byte)
+	done   bool
+}
+
+func (r *cacheRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+
+	if !r.done {
+		r.body.Write(p[:n])
+
+		if int64(r.body.Len()) > r.limit {
+			r.done = true
+			r.body = bytes.Buffer{}
+		} else if err == io.EOF {
+			r.done = true
+			r.stored(r.body.Bytes())
+		}
+	}
+
+	return n, err
+}
+
+// freshness returns until when a response with the header is fresh, and how
+// old it already is, from its Cache-Control or Expires header. Only shared
+// caches use s-maxage (RFC 7234, section 4.2.1).
+func freshness(header http.Header, now time.Time) (time.Time, time.Duration, bool) {
+	var initialAge time.Duration
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		initialAge = time.Duration(age) * time.Second
+	}
+
+	cacheControl := header.Get("Cache-Control")
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cacheControlValue(cacheControl, directive); ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				return time.Time{}, 0, false
+			}
+
+			return now.Add(time.Duration(seconds)*time.Second - initialAge), initialAge, true
+		}
+	}
+
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+
+		// The endpoint's clock may be off from ours
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+
+		return now.Add(expires.Sub(date) - initialAge), initialAge, true
+	}
+
+	return time.Time{}, 0, false
+}
+
+func cacheControlValue(cacheControl, directive string) (string, bool) {
+	for _, d := range strings.Split(cacheControl, ",") {
+		name, value := strings.TrimSpace(d), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+
+		if strings.EqualFold(name, directive) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return names
+}
+
+// variantKey tells apart the responses for a host and URI that vary by the
+// given request headers.
+func variantKey(key string, vary []string, request *http.Request) string {
+	for _, name := range vary {
+		key += "\n" + name + ":" + strings.Join(request.Header[name], ",")
+	}
+
+	return key
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag,
+// comparing weakly (RFC 7232, section 3.2).
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for k, vv := range header {
+		clone[k] = append([]string(nil), vv...)
+	}
+
+	return clone
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ResponseCacheSuite struct {
+	cache *responseCache
+	now   time.Time
+}
+
+var _ = Suite(&ResponseCacheSuite{})
+
+func (s *ResponseCacheSuite) SetUpTest(c *C) {
+	s.cache = newResponseCache(ResponseCaching{MaxSize: 1000, MaxEntrySize: 100}, nil)
+	s.now = time.Now()
+}
+
+func cacheRequest(uri string, header ...string) *http.Request {
+	r := &http.Request{Method: "GET", Host: "example.com", RequestURI: uri, Header: make(http.Header)}
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	return r
+}
+
+func cacheResponse(body string, header ...string) *http.Response {
+	r := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	return r
+}
+
+// store stores the response as the proxy does, by reading its body through.
+func (s *ResponseCacheSuite) store(request *http.Request, response *http.Response) {
+	s.cache.store(request, response, s.now)
+	ioutil.ReadAll(response.Body)
+}
+
+func (s *ResponseCacheSuite) TestStoresFreshResponses(c *C) {
+	s.store(cacheRequest("/a"), cacheResponse("a", "Cache-Control", "public, max-age=60"))
+
+	entry := s.cache.get(cacheRequest("/a"))
+	c.Assert(entry, NotNil)
+	c.Check(entry.fresh(s.now.Add(59*time.Second)), Equals, true)
+	c.Check(entry.fresh(s.now.Add(60*time.Second)), Equals, false)
+	c.Check(string(entry.body), Equals, "a")
+
+	c.Check(s.cache.get(cacheRequest("/b")), IsNil)
+}
+
+func (s *ResponseCacheSuite) TestFreshness(c *C) {
+	date := s.now.UTC().Format(http.TimeFormat)
+	expires := s.now.Add(30 * time.Second).UTC().Format(http.TimeFormat)
+
+	s.store(cacheRequest("/expires"), cacheResponse("a", "Date", date, "Expires", expires))
+	s.store(cacheRequest("/s-maxage"), cacheResponse("a", "Cache-Control", "max-age=10, s-maxage=20"))
+	s.store(cacheRequest("/age"), cacheResponse("a", "Cache-Control", "max-age=10", "Age", "5"))
+
+	c.Check(s.cache.get(cacheRequest("/expires")).freshUntil.Sub(s.now), Equals, 30*time.Second)
+	c.Check(s.cache.get(cacheRequest("/s-maxage")).freshUntil.Sub(s.now), Equals, 20*time.Second)
+	c.Check(s.cache.get(cacheRequest("/age")).freshUntil.Sub(s.now), Equals, 5*time.Second)
+}
+
+func (s *ResponseCacheSuite) TestDoesNotStore(c *C) {
+	s.store(cacheRequest("/1"), cacheResponse("a"))
+	s.store(cacheRequest("/2"), cacheResponse("a", "Cache-Control", "private, max-age=60"))
+	s.store(cacheRequest("/3"), cacheResponse("a", "Cache-Control", "no-store"))
+	s.store(cacheRequest("/4"), cacheResponse("a", "Cache-Control", "max-age=60", "Set-Cookie", "a=b"))
+	s.store(cacheRequest("/5"), cacheResponse("a", "Cache-Control", "max-age=60", "Vary", "*"))
+	s.store(cacheRequest("/6"), cacheResponse(strings.Repeat("a", 101), "Cache-Control", "max-age=60"))
+
+	response := cacheResponse(strings.Repeat("a", 101), "Cache-Control", "max-age=60")
+	response.ContentLength = -1
+	s.store(cacheRequest("/7"), response)
+
+	for _, uri := range []string{"/1", "/2", "/3", "/4", "/5", "/6", "/7"} {
+		c.Check(s.cache.get(cacheRequest(uri)), IsNil, Commentf(uri))
+	}
+}
+
+func (s *ResponseCacheSuite) TestVary(c *C) {
+	s.store(cacheRequest("/", "Accept-Language", "en"), cacheResponse("hello", "Cache-Control", "max-age=60", "Vary", "Accept-Language"))
+	s.store(cacheRequest("/", "Accept-Language", "fr"), cacheResponse("bonjour", "Cache-Control", "max-age=60", "Vary", "Accept-Language"))
+
+	c.Check(string(s.cache.get(cacheRequest("/", "Accept-Language", "en")).body), Equals, "hello")
+	c.Check(string(s.cache.get(cacheRequest("/", "Accept-Language", "fr")).body), Equals, "bonjour")
+	c.Check(s.cache.get(cacheRequest("/", "Accept-Language", "de")), IsNil)
+}
+
+func (s *ResponseCacheSuite) TestEvictsLeastRecentlyUsed(c *C) {
+	evictions := 0
+	s.cache.onEvict = func() { evictions++ }
+	s.cache.maxSize = 500
+
+	body := strings.Repeat("a", 90)
+	for _, uri := range []string{"/1", "/2", "/3", "/4", "/5", "/6", "/7"} {
+		s.store(cacheRequest(uri), cacheResponse(body, "Cache-Control", "max-age=60"))
+		s.cache.get(cacheRequest("/1"))
+	}
+
+	c.Check(s.cache.get(cacheRequest("/1")), NotNil)
+	c.Check(s.cache.get(cacheRequest("/2")), IsNil)
+	c.Check(s.cache.get(cacheRequest("/7")), NotNil)
+	c.Check(evictions > 0, Equals, true)
+	c.Check(s.cache.size <= 500, Equals, true)
+}
+
+func (s *ResponseCacheSuite) TestNotModifiedForMatchingETag(c *C) {
+	s.store(cacheRequest("/"), cacheResponse("a", "Cache-Control", "max-age=60", "ETag", `"v1"`))
+	entry := s.cache.get(cacheRequest("/"))
+
+	response := entry.response(cacheRequest("/", "If-None-Match", `"v0", W/"v1"`), s.now.Add(10*time.Second))
+	c.Check(response.StatusCode, Equals, http.StatusNotModified)
+	c.Check(response.Header.Get("Age"), Equals, "10")
+
+	response = entry.response(cacheRequest("/", "If-None-Match", `"v2"`), s.now)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ResponseCacheSuite) TestRefresh(c *C) {
+	s.store(cacheRequest("/"), cacheResponse("a", "Cache-Control", "max-age=1", "ETag", `"v1"`))
+	entry := s.cache.get(cacheRequest("/"))
+
+	later := s.now.Add(time.Minute)
+	refreshed := s.cache.refresh(entry, cacheResponse("", "Cache-Control", "max-age=60"), later)
+	c.Check(refreshed.fresh(later), Equals, true)
+	c.Check(refreshed.header.Get("Cache-Control"), Equals, "max-age=60")
+	c.Check(entry.header.Get("Cache-Control"), Equals, "max-age=1")
+
+	c.Check(s.cache.get(cacheRequest("/")).fresh(later), Equals, true)
+}
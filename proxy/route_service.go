@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// Requests sent to a route service carry the URL the client requested, and a
+// signature of it, which the route service passes back along with the request
+// when it is done with it.
+const (
+	RouteServiceForwardedUrl = "X-CF-Forwarded-Url"
+	RouteServiceSignature    = "X-CF-Proxy-Signature"
+)
+
+var (
+	errMalformedSignature = errors.New("malformed route service signature")
+	errInvalidSignature   = errors.New("invalid route service signature")
+	errExpiredSignature   = errors.New("expired route service signature")
+	errForwardedUrl       = errors.New("route service forwarded URL does not match the request")
+)
+
+// RouteServices sends requests for routes registered with a route service URL
+// to that service first. The service sends them back through the router to
+// the forwarded URL once it is done, and the router forwards those that are
+// signed with Key, or PreviousKey while keys are rotated, and no older than
+// Timeout to the route's endpoints. Route services are disabled, and requests
+// for their routes fail, when Key is empty.
+type RouteServices struct {
+	Key         []byte
+	PreviousKey []byte
+	Timeout     time.Duration
+}
+
+func (r RouteServices) enabled() bool {
+	return len(r.Key) > 0
+}
+
+// sign returns the signature of the forwarded URL, made at the given time.
+func (r RouteServices) sign(forwardedUrl string, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return timestamp + "." + signature(r.Key, timestamp, forwardedUrl)
+}
+
+// verify checks that the signature was made for the forwarded URL by this or
+// another router sharing its key, and has not expired.
+func (r RouteServices) verify(s, forwardedUrl string, now time.Time) error {
+	i := strings.Index(s, ".")
+	if i < 0 {
+		return errMalformedSignature
+	}
+
+	timestamp, mac := s[:i], s[i+1:]
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errMalformedSignature
+	}
+
+	valid := hmac.Equal([]byte(mac), []byte(signature(r.Key, timestamp, forwardedUrl)))
+	if !valid && len(r.PreviousKey) > 0 {
+		valid = hmac.Equal([]byte(mac), []byte(signature(r.PreviousKey, timestamp, forwardedUrl)))
+	}
+	if !valid {
+		return errInvalidSignature
+	}
+
+	if now.Sub(time.Unix(seconds, 0)) > r.Timeout {
+		return errExpiredSignature
+	}
+
+	return nil
+}
+
+// verifyRequest checks that a request sent back by a route service is for the
+// URL the router forwarded to it, with a valid signature.
+func (r RouteServices) verifyRequest(request *http.Request, now time.Time) error {
+	forwardedUrl := request.Header.Get(RouteServiceForwardedUrl)
+	if !matchesForwardedUrl(request, forwardedUrl) {
+		return errForwardedUrl
+	}
+
+	return r.verify(request.Header.Get(RouteServiceSignature), forwardedUrl, now)
+}
+
+func signature(key []byte, timestamp, forwardedUrl string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + forwardedUrl))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// forwardedUrl returns the URL the client requested, over the given protocol.
+func forwardedUrl(proto string, request *http.Request) string {
+	return proto + "://" + request.Host + request.RequestURI
+}
+
+// matchesForwardedUrl reports whether the request is for the forwarded URL.
+// Its scheme is not compared, since route services may call back through the
+// router over plain HTTP.
+func matchesForwardedUrl(request *http.Request, forwardedUrl string) bool {
+	i := strings.Index(forwardedUrl, "://")
+	if i < 0 {
+		return false
+	}
+
+	hostAndUri := forwardedUrl[i+3:]
+	if len(hostAndUri) != len(request.Host)+len(request.RequestURI) {
+		return false
+	}
+
+	host, uri := hostAndUri[:len(request.Host)], hostAndUri[len(request.Host):]
+	return strings.EqualFold(host, request.Host) && uri == request.RequestURI
+}
+
+// routeServiceEndpoint returns the endpoint requests are sent to for the
+// route service at the URL.
+func routeServiceEndpoint(serviceUrl string) (*route.Endpoint, *url.URL, error) {
+	u, err := url.Parse(serviceUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		return nil, nil, fmt.Errorf("invalid route service URL: %s", serviceUrl)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid route service URL: %s", serviceUrl)
+	}
+
+	endpoint := &route.Endpoint{
+		Host: u.Hostname(),
+		Port: uint16(p),
+		TLS:  u.Scheme == "https",
+	}
+
+	return endpoint, u, nil
+}
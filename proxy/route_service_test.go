@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type RouteServiceSuite struct {
+	routeServices RouteServices
+	now           time.Time
+}
+
+var _ = Suite(&RouteServiceSuite{})
+
+func (s *RouteServiceSuite) SetUpTest(c *C) {
+	s.routeServices = RouteServices{Key: []byte("key"), Timeout: time.Minute}
+	s.now = time.Now()
+}
+
+func (s *RouteServiceSuite) TestVerifiesSignature(c *C) {
+	signature := s.routeServices.sign("https://app.example.com/path", s.now)
+
+	c.Check(s.routeServices.verify(signature, "https://app.example.com/path", s.now), IsNil)
+	c.Check(s.routeServices.verify(signature, "https://app.example.com/other", s.now), Equals, errInvalidSignature)
+}
+
+func (s *RouteServiceSuite) TestRejectsMalformedSignature(c *C) {
+	c.Check(s.routeServices.verify("", "http://app/", s.now), Equals, errMalformedSignature)
+	c.Check(s.routeServices.verify("abc", "http://app/", s.now), Equals, errMalformedSignature)
+	c.Check(s.routeServices.verify("abc.def", "http://app/", s.now), Equals, errMalformedSignature)
+}
+
+func (s *RouteServiceSuite) TestRejectsExpiredSignature(c *C) {
+	signature := s.routeServices.sign("http://app/", s.now.Add(-2*time.Minute))
+
+	c.Check(s.routeServices.verify(signature, "http://app/", s.now), Equals, errExpiredSignature)
+}
+
+func (s *RouteServiceSuite) TestAcceptsPreviousKey(c *C) {
+	signature := s.routeServices.sign("http://app/", s.now)
+
+	rotated := RouteServices{Key: []byte("new key"), Timeout: time.Minute}
+	c.Check(rotated.verify(signature, "http://app/", s.now), Equals, errInvalidSignature)
+
+	rotated.PreviousKey = s.routeServices.Key
+	c.Check(rotated.verify(signature, "http://app/", s.now), IsNil)
+}
+
+func (s *RouteServiceSuite) TestVerifiesRequestIsForForwardedUrl(c *C) {
+	request := &http.Request{Host: "app.example.com", RequestURI: "/path?x=1", Header: make(http.Header)}
+	request.Header.Set(RouteServiceForwardedUrl, "https://App.example.com/path?x=1")
+	request.Header.Set(RouteServiceSignature, s.routeServices.sign("https://App.example.com/path?x=1", s.now))
+
+	c.Check(s.routeServices.verifyRequest(request, s.now), IsNil)
+
+	request.RequestURI = "/other"
+	c.Check(s.routeServices.verifyRequest(request, s.now), Equals, errForwardedUrl)
+}
+
+func (s *RouteServiceSuite) TestRouteServiceRequestLeavesClientRequestAlone(c *C) {
+	req, err := http.NewRequest("GET", "http://app/path", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("X-Client", "1")
+
+	h := NewRequestHandler(req, nil)
+
+	serviceUrl, _ := url.Parse("https://auth.example.com/check")
+	h.SetupRouteServiceRequest(serviceUrl, "http://app/path", "signature")
+
+	c.Check(h.request.Host, Equals, "auth.example.com")
+	c.Check(h.request.Header.Get(RouteServiceForwardedUrl), Equals, "http://app/path")
+	c.Check(h.request.Header.Get(RouteServiceSignature), Equals, "signature")
+	c.Check(h.request.Header.Get("X-Client"), Equals, "1")
+
+	h.request.Header.Add("X-Client", "2")
+
+	c.Check(req.Host, Equals, "app")
+	c.Check(req.Header, DeepEquals, http.Header{"X-Client": {"1"}})
+}
+
+func (s *RouteServiceSuite) TestForwardedUrl(c *C) {
+	request := &http.Request{Host: "app.example.com", RequestURI: "/path?x=1", Header: make(http.Header)}
+	c.Check(forwardedUrl("http", request), Equals, "http://app.example.com/path?x=1")
+	c.Check(forwardedUrl("https", request), Equals, "https://app.example.com/path?x=1")
+}
+
+func (s *RouteServiceSuite) TestRouteServiceEndpoint(c *C) {
+	endpoint, u, err := routeServiceEndpoint("https://auth.example.com/check?app=1")
+	c.Assert(err, IsNil)
+	c.Check(endpoint.CanonicalAddr(), Equals, "auth.example.com:443")
+	c.Check(endpoint.TLS, Equals, true)
+	c.Check(u.RequestURI(), Equals, "/check?app=1")
+
+	endpoint, _, err = routeServiceEndpoint("http://10.0.0.1:8080")
+	c.Assert(err, IsNil)
+	c.Check(endpoint.CanonicalAddr(), Equals, "10.0.0.1:8080")
+	c.Check(endpoint.TLS, Equals, false)
+
+	_, _, err = routeServiceEndpoint("ftp://auth.example.com")
+	c.Check(err, NotNil)
+
+	_, _, err = routeServiceEndpoint("/check")
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+// StickySessions pins the clients of applications that keep sessions to the
+// instance their session is on. When an endpoint sets one of the session
+// cookies in CookieNames, the router sets the VcapCookieId cookie to the
+// endpoint's instance ID, and routes requests that carry both cookies to that
+// instance. The instance ID is encrypted with Key so that clients can neither
+// read nor forge it; PreviousKey is still accepted while keys are rotated.
+// Every router must have the same Key, so that a client's requests can go to
+// any of them. Without a Key, clients are not pinned.
+type StickySessions struct {
+	CookieNames []string
+	Key         []byte
+	PreviousKey []byte
+}
+
+func (s StickySessions) isSessionCookie(name string) bool {
+	for _, n := range s.CookieNames {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// instanceId returns the instance the request's session is pinned to, if it
+// has a session.
+func (s StickySessions) instanceId(request *http.Request) (string, bool) {
+	if len(s.Key) == 0 {
+		return "", false
+	}
+
+	hasSession := false
+	for _, c := range request.Cookies() {
+		if s.isSessionCookie(c.Name) {
+			hasSession = true
+			break
+		}
+	}
+
+	if !hasSession {
+		return "", false
+	}
+
+	cookie, err := request.Cookie(VcapCookieId)
+	if err != nil {
+		return "", false
+	}
+
+	return s.decode(cookie.Value)
+}
+
+// affinityCookie returns the cookie that pins the client to the instance,
+// when the response sets one of the session cookies, or the cookie that
+// expires it, when the response deletes the session cookie. Its attributes
+// follow those of the session cookie.
+func (s StickySessions) affinityCookie(response *http.Response, instanceId string, now time.Time) (*http.Cookie, error) {
+	if len(s.Key) == 0 {
+		return nil, nil
+	}
+
+	var session *http.Cookie
+	for _, c := range response.Cookies() {
+		if c.Name == VcapCookieId {
+			// Set by a router the response already passed through, such as
+			// that of a route service
+			return nil, nil
+		}
+
+		if session == nil && s.isSessionCookie(c.Name) {
+			session = c
+		}
+	}
+
+	if session == nil {
+		return nil, nil
+	}
+
+	cookie := &http.Cookie{
+		Name:     VcapCookieId,
+		Path:     "/",
+		Secure:   session.Secure,
+		HttpOnly: session.HttpOnly,
+		SameSite: session.SameSite,
+	}
+
+	if session.MaxAge < 0 || !session.Expires.IsZero() && !session.Expires.After(now) {
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(1, 0)
+		return cookie, nil
+	}
+
+	if instanceId == "" {
+		return nil, nil
+	}
+
+	value, err := s.encode(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie.Value = value
+	cookie.MaxAge = session.MaxAge
+	cookie.Expires = session.Expires
+
+	return cookie, nil
+}
+
+func (s StickySessions) encode(instanceId string) (string, error) {
+	aead := cookieCipher(s.Key)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(instanceId), []byte(VcapCookieId))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decode returns the instance ID of a cookie value, which fails for values
+// not encrypted with either key.
+func (s StickySessions) decode(value string) (string, bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", false
+	}
+
+	for _, key := range [][]byte{s.Key, s.PreviousKey} {
+		if len(key) == 0 {
+			continue
+		}
+
+		aead := cookieCipher(key)
+
+		n := aead.NonceSize()
+		if len(sealed) < n {
+			return "", false
+		}
+
+		if instanceId, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(VcapCookieId)); err == nil {
+			return string(instanceId), true
+		}
+	}
+
+	return "", false
+}
+
+// cookieCipher returns AES-256-GCM keyed with the hash of the key, which may
+// be of any length.
+func cookieCipher(key []byte) cipher.AEAD {
+	k := sha256.Sum256(key)
+
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		panic(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return aead
+}
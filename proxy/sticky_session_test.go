@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type StickySessionSuite struct {
+	sessions StickySessions
+	now      time.Time
+}
+
+var _ = Suite(&StickySessionSuite{})
+
+func (s *StickySessionSuite) SetUpTest(c *C) {
+	s.sessions = StickySessions{
+		CookieNames: []string{"JSESSIONID", "PHPSESSID"},
+		Key:         []byte("secret"),
+	}
+	s.now = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func stickyResponse(cookies ...string) *http.Response {
+	resp := newResponse(http.StatusOK)
+	for _, cookie := range cookies {
+		resp.Header.Add("Set-Cookie", cookie)
+	}
+
+	return resp
+}
+
+func stickyRequest(cookies ...*http.Cookie) *http.Request {
+	r := &http.Request{Header: make(http.Header)}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	return r
+}
+
+func mustEncode(c *C, sessions StickySessions, instanceId string) string {
+	value, err := sessions.encode(instanceId)
+	c.Assert(err, IsNil)
+
+	return value
+}
+
+func (s *StickySessionSuite) affinityCookie(c *C, response *http.Response, instanceId string) *http.Cookie {
+	cookie, err := s.sessions.affinityCookie(response, instanceId, s.now)
+	c.Assert(err, IsNil)
+
+	return cookie
+}
+
+func (s *StickySessionSuite) TestEncryptsInstanceId(c *C) {
+	value := mustEncode(c, s.sessions, "instance-1")
+	c.Check(strings.Contains(value, "instance-1"), Equals, false)
+	c.Check(mustEncode(c, s.sessions, "instance-1"), Not(Equals), value)
+
+	instanceId, ok := s.sessions.decode(value)
+	c.Check(ok, Equals, true)
+	c.Check(instanceId, Equals, "instance-1")
+}
+
+func (s *StickySessionSuite) TestRejectsForgedValues(c *C) {
+	for _, value := range []string{"instance-1", "", "AAAA", mustEncode(c, s.sessions, "instance-1")[1:]} {
+		_, ok := s.sessions.decode(value)
+		c.Check(ok, Equals, false, Commentf("%s", value))
+	}
+
+	other := StickySessions{Key: []byte("other-secret")}
+	_, ok := s.sessions.decode(mustEncode(c, other, "instance-1"))
+	c.Check(ok, Equals, false)
+}
+
+func (s *StickySessionSuite) TestAcceptsPreviousKey(c *C) {
+	old := StickySessions{Key: []byte("old-secret")}
+	value := mustEncode(c, old, "instance-1")
+
+	s.sessions.PreviousKey = []byte("old-secret")
+
+	instanceId, ok := s.sessions.decode(value)
+	c.Check(ok, Equals, true)
+	c.Check(instanceId, Equals, "instance-1")
+}
+
+func (s *StickySessionSuite) TestCookieIsHonouredByRoutersSharingTheKey(c *C) {
+	p1 := NewProxy(ProxyArgs{StickySessions: StickySessions{Key: []byte("shared")}}).(*proxy)
+	p2 := NewProxy(ProxyArgs{StickySessions: StickySessions{Key: []byte("shared")}}).(*proxy)
+
+	cookie, err := p1.stickySessions.affinityCookie(stickyResponse("JSESSIONID=abc"), "instance-1", s.now)
+	c.Assert(err, IsNil)
+	c.Assert(cookie, NotNil)
+
+	instanceId, ok := p2.stickySessions.instanceId(stickyRequest(&http.Cookie{Name: "JSESSIONID", Value: "abc"}, cookie))
+	c.Check(ok, Equals, true)
+	c.Check(instanceId, Equals, "instance-1")
+}
+
+func (s *StickySessionSuite) TestNoAffinityWithoutKey(c *C) {
+	s.sessions.Key = nil
+
+	c.Check(s.affinityCookie(c, stickyResponse("JSESSIONID=abc"), "instance-1"), IsNil)
+
+	_, ok := s.sessions.instanceId(stickyRequest(&http.Cookie{Name: "JSESSIONID", Value: "abc"}, &http.Cookie{Name: VcapCookieId, Value: "instance-1"}))
+	c.Check(ok, Equals, false)
+}
+
+func (s *StickySessionSuite) TestInstanceIdNeedsSessionCookie(c *C) {
+	affinity := &http.Cookie{Name: VcapCookieId, Value: mustEncode(c, s.sessions, "instance-1")}
+
+	instanceId, ok := s.sessions.instanceId(stickyRequest(&http.Cookie{Name: "PHPSESSID", Value: "abc"}, affinity))
+	c.Check(ok, Equals, true)
+	c.Check(instanceId, Equals, "instance-1")
+
+	_, ok = s.sessions.instanceId(stickyRequest(&http.Cookie{Name: "other", Value: "abc"}, affinity))
+	c.Check(ok, Equals, false)
+
+	_, ok = s.sessions.instanceId(stickyRequest(&http.Cookie{Name: "PHPSESSID", Value: "abc"}))
+	c.Check(ok, Equals, false)
+}
+
+func (s *StickySessionSuite) TestAffinityCookieFollowsSessionCookie(c *C) {
+	cookie := s.affinityCookie(c, stickyResponse("PHPSESSID=abc; Path=/app; Max-Age=3600; Secure; HttpOnly; SameSite=Strict"), "instance-1")
+	c.Assert(cookie, NotNil)
+
+	c.Check(cookie.Name, Equals, VcapCookieId)
+	c.Check(cookie.Path, Equals, "/")
+	c.Check(cookie.MaxAge, Equals, 3600)
+	c.Check(cookie.Secure, Equals, true)
+	c.Check(cookie.HttpOnly, Equals, true)
+	c.Check(cookie.SameSite, Equals, http.SameSiteStrictMode)
+
+	instanceId, ok := s.sessions.decode(cookie.Value)
+	c.Check(ok, Equals, true)
+	c.Check(instanceId, Equals, "instance-1")
+}
+
+func (s *StickySessionSuite) TestNoAffinityCookieWithoutSessionCookie(c *C) {
+	c.Check(s.affinityCookie(c, stickyResponse("other=abc"), "instance-1"), IsNil)
+	c.Check(s.affinityCookie(c, stickyResponse("JSESSIONID=abc"), ""), IsNil)
+
+	// Already set by another router
+	c.Check(s.affinityCookie(c, stickyResponse("JSESSIONID=abc", VcapCookieId+"=xyz"), "instance-1"), IsNil)
+}
+
+func (s *StickySessionSuite) TestAffinityCookieExpiresWithSessionCookie(c *C) {
+	for _, session := range []string{
+		"JSESSIONID=; Max-Age=0",
+		"JSESSIONID=; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
+	} {
+		cookie := s.affinityCookie(c, stickyResponse(session), "")
+		c.Assert(cookie, NotNil, Commentf("%s", session))
+
+		c.Check(cookie.Name, Equals, VcapCookieId)
+		c.Check(cookie.Value, Equals, "")
+		c.Check(cookie.MaxAge, Equals, -1)
+	}
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// W3C Trace Context and Zipkin B3 headers
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+
+	B3Header             = "b3"
+	B3TraceIdHeader      = "X-B3-TraceId"
+	B3SpanIdHeader       = "X-B3-SpanId"
+	B3ParentSpanIdHeader = "X-B3-ParentSpanId"
+	B3SampledHeader      = "X-B3-Sampled"
+	B3FlagsHeader        = "X-B3-Flags"
+)
+
+// A Span is the part of a trace the router spent on a request.
+type Span struct {
+	TraceId  string
+	Id       string
+	ParentId string
+
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Tags     map[string]string
+}
+
+// A SpanExporter sends the spans of sampled requests to a tracing system.
+type SpanExporter interface {
+	Export(span Span)
+}
+
+// traceContext is the trace a request belongs to, which is joined when the
+// client sends one along, in the W3C or B3 headers, and started otherwise.
+// Only trusted peers decide whether the trace is sampled; otherwise sampleRate
+// of traces are.
+type traceContext struct {
+	traceId      string
+	spanId       string
+	parentSpanId string
+	sampled      bool
+
+	// Vendor specific trace state, passed on as it is
+	traceState string
+
+	// Whether the client sent the single B3 header
+	b3Single bool
+}
+
+func newTraceContext(header http.Header, trusted bool, sampleRate float64) traceContext {
+	t, ok := parseTraceparent(header.Get(TraceparentHeader))
+	if ok {
+		t.traceState = header.Get(TracestateHeader)
+	} else if t, ok = parseB3Single(header.Get(B3Header)); ok {
+		t.b3Single = true
+	} else if t, ok = parseB3(header); !ok {
+		t = traceContext{traceId: randomId(16)}
+	}
+
+	// Clients could otherwise have every request they send traced
+	if !ok || !trusted {
+		t.sampled = mathrand.Float64() < sampleRate
+	}
+
+	t.spanId = randomId(8)
+	return t
+}
+
+// parseTraceparent parses a version 00 traceparent header, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(v string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+
+	// Later versions may add fields
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return traceContext{}, false
+	}
+
+	if !isId(parts[1], 32) || !isId(parts[2], 16) || !isHex(parts[3], 2) {
+		return traceContext{}, false
+	}
+
+	flags, _ := hex.DecodeString(parts[3])
+	return traceContext{
+		traceId:      parts[1],
+		parentSpanId: parts[2],
+		sampled:      flags[0]&1 == 1,
+	}, true
+}
+
+// parseB3Single parses the single b3 header, such as
+// 80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90.
+func parseB3Single(v string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return traceContext{}, false
+	}
+
+	t, ok := b3Context(parts[0], parts[1])
+	if !ok {
+		return traceContext{}, false
+	}
+
+	if len(parts) > 2 {
+		t.sampled = parts[2] == "1" || parts[2] == "d"
+	}
+
+	return t, true
+}
+
+func parseB3(header http.Header) (traceContext, bool) {
+	t, ok := b3Context(header.Get(B3TraceIdHeader), header.Get(B3SpanIdHeader))
+	if !ok {
+		return traceContext{}, false
+	}
+
+	if sampled := header.Get(B3SampledHeader); sampled != "" {
+		t.sampled = sampled == "1" || strings.EqualFold(sampled, "true")
+	}
+	if header.Get(B3FlagsHeader) == "1" {
+		t.sampled = true
+	}
+
+	return t, true
+}
+
+// b3Context returns the context for B3 trace and span IDs. 64 bit trace IDs
+// are padded to 128 bits, as W3C trace IDs must be.
+func b3Context(traceId, spanId string) (traceContext, bool) {
+	traceId = strings.ToLower(traceId)
+	spanId = strings.ToLower(spanId)
+
+	if isId(traceId, 16) {
+		traceId = strings.Repeat("0", 16) + traceId
+	}
+
+	if !isId(traceId, 32) || !isId(spanId, 16) {
+		return traceContext{}, false
+	}
+
+	return traceContext{traceId: traceId, parentSpanId: spanId, sampled: true}, true
+}
+
+// setHeaders passes the trace on to the endpoint in both formats, with the
+// router's span as the parent of the endpoint's.
+func (t traceContext) setHeaders(header http.Header) {
+	flags, sampled := "00", "0"
+	if t.sampled {
+		flags, sampled = "01", "1"
+	}
+
+	header.Set(TraceparentHeader, "00-"+t.traceId+"-"+t.spanId+"-"+flags)
+	if t.traceState != "" {
+		header.Set(TracestateHeader, t.traceState)
+	} else {
+		header.Del(TracestateHeader)
+	}
+
+	header.Set(B3TraceIdHeader, t.traceId)
+	header.Set(B3SpanIdHeader, t.spanId)
+	header.Set(B3SampledHeader, sampled)
+	header.Del(B3FlagsHeader)
+	if t.parentSpanId != "" {
+		header.Set(B3ParentSpanIdHeader, t.parentSpanId)
+	} else {
+		header.Del(B3ParentSpanIdHeader)
+	}
+
+	if t.b3Single {
+		b3 := t.traceId + "-" + t.spanId + "-" + sampled
+		if t.parentSpanId != "" {
+			b3 += "-" + t.parentSpanId
+		}
+		header.Set(B3Header, b3)
+	}
+}
+
+func randomId(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isId reports whether v is a lower case hex ID of n digits that is not all
+// zeros, which is invalid.
+func isId(v string, n int) bool {
+	return isHex(v, n) && strings.Trim(v, "0") != ""
+}
+
+func isHex(v string, n int) bool {
+	if len(v) != n {
+		return false
+	}
+
+	for _, c := range v {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
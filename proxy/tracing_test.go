@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net/http"
+
+	. "launchpad.net/gocheck"
+)
+
+type TracingSuite struct{}
+
+var _ = Suite(&TracingSuite{})
+
+func traceHeader(header ...string) http.Header {
+	h := make(http.Header)
+	for i := 0; i < len(header); i += 2 {
+		h.Set(header[i], header[i+1])
+	}
+
+	return h
+}
+
+func (s *TracingSuite) TestStartsTraceWithoutHeaders(c *C) {
+	t := newTraceContext(traceHeader(), true, 1)
+
+	c.Check(isId(t.traceId, 32), Equals, true)
+	c.Check(isId(t.spanId, 16), Equals, true)
+	c.Check(t.parentSpanId, Equals, "")
+	c.Check(t.sampled, Equals, true)
+
+	t = newTraceContext(traceHeader(), true, 0)
+	c.Check(t.sampled, Equals, false)
+}
+
+func (s *TracingSuite) TestJoinsTraceparent(c *C) {
+	t := newTraceContext(traceHeader(
+		TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		TracestateHeader, "congo=t61rcWkgMzE",
+	), true, 0)
+
+	c.Check(t.traceId, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(t.parentSpanId, Equals, "00f067aa0ba902b7")
+	c.Check(t.spanId, Not(Equals), "00f067aa0ba902b7")
+	c.Check(t.sampled, Equals, false)
+	c.Check(t.traceState, Equals, "congo=t61rcWkgMzE")
+}
+
+func (s *TracingSuite) TestSamplingDecisionIsOnlyTakenFromTrustedPeers(c *C) {
+	header := traceHeader(
+		TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		B3SampledHeader, "1",
+	)
+
+	t := newTraceContext(header, false, 0)
+	c.Check(t.traceId, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(t.sampled, Equals, false)
+
+	t = newTraceContext(header, true, 0)
+	c.Check(t.sampled, Equals, true)
+}
+
+func (s *TracingSuite) TestIgnoresInvalidTraceparent(c *C) {
+	for _, v := range []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, ok := parseTraceparent(v)
+		c.Check(ok, Equals, false, Commentf("%s", v))
+	}
+
+	// Later versions may add fields
+	_, ok := parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	c.Check(ok, Equals, true)
+}
+
+func (s *TracingSuite) TestJoinsSingleB3(c *C) {
+	t := newTraceContext(traceHeader(B3Header, "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-0-05e3ac9a4f6e3b90"), true, 0)
+
+	c.Check(t.traceId, Equals, "80f198ee56343ba864fe8b2a57d3eff7")
+	c.Check(t.parentSpanId, Equals, "e457b5a2e4d86bd1")
+	c.Check(t.sampled, Equals, false)
+	c.Check(t.b3Single, Equals, true)
+}
+
+func (s *TracingSuite) TestJoinsMultiB3(c *C) {
+	t := newTraceContext(traceHeader(
+		B3TraceIdHeader, "a3ce929d0e0e4736",
+		B3SpanIdHeader, "00F067AA0BA902B7",
+		B3SampledHeader, "0",
+	), true, 0)
+
+	c.Check(t.traceId, Equals, "0000000000000000a3ce929d0e0e4736")
+	c.Check(t.parentSpanId, Equals, "00f067aa0ba902b7")
+	c.Check(t.sampled, Equals, false)
+	c.Check(t.b3Single, Equals, false)
+
+	t = newTraceContext(traceHeader(
+		B3TraceIdHeader, "a3ce929d0e0e4736",
+		B3SpanIdHeader, "00f067aa0ba902b7",
+		B3FlagsHeader, "1",
+	), true, 0)
+	c.Check(t.sampled, Equals, true)
+}
+
+func (s *TracingSuite) TestPrefersTraceparentOverB3(c *C) {
+	t := newTraceContext(traceHeader(
+		TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		B3Header, "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1",
+	), true, 0)
+
+	c.Check(t.traceId, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(t.b3Single, Equals, false)
+}
+
+func (s *TracingSuite) TestSetsHeaders(c *C) {
+	t := traceContext{
+		traceId:      "4bf92f3577b34da6a3ce929d0e0e4736",
+		spanId:       "e457b5a2e4d86bd1",
+		parentSpanId: "00f067aa0ba902b7",
+		sampled:      true,
+		b3Single:     true,
+	}
+
+	h := traceHeader(TracestateHeader, "stale", B3FlagsHeader, "1")
+	t.setHeaders(h)
+
+	c.Check(h.Get(TraceparentHeader), Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-e457b5a2e4d86bd1-01")
+	c.Check(h.Get(TracestateHeader), Equals, "")
+	c.Check(h.Get(B3TraceIdHeader), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(h.Get(B3SpanIdHeader), Equals, "e457b5a2e4d86bd1")
+	c.Check(h.Get(B3ParentSpanIdHeader), Equals, "00f067aa0ba902b7")
+	c.Check(h.Get(B3SampledHeader), Equals, "1")
+	c.Check(h.Get(B3FlagsHeader), Equals, "")
+	c.Check(h.Get(B3Header), Equals, "4bf92f3577b34da6a3ce929d0e0e4736-e457b5a2e4d86bd1-1-00f067aa0ba902b7")
+}
@@ -2,6 +2,7 @@ package registry
 
 import (
 	"encoding/json"
+	"reflect"
 	"sync"
 	"time"
 
@@ -22,6 +23,18 @@ type CFRegistry struct {
 
 	table map[tableKey]*tableEntry
 
+	// Number of table entries referring to each endpoint address
+	addrRefs map[string]int
+
+	endpointRemovedCallbacks []func(*route.Endpoint)
+
+	newStrategy func() route.Strategy
+
+	outlierDetector *route.OutlierDetector
+	circuitBreaker  *route.CircuitBreaker
+
+	maxUnhealthyPercent int
+
 	pruneStaleDropletsInterval time.Duration
 	dropletStaleThreshold      time.Duration
 
@@ -49,6 +62,35 @@ func NewCFRegistry(c *config.Config, mbus yagnats.NATSClient) *CFRegistry {
 
 	r.table = make(map[tableKey]*tableEntry)
 
+	r.addrRefs = make(map[string]int)
+
+	r.newStrategy = route.Strategies[c.LoadBalancingStrategy]
+	if r.newStrategy == nil {
+		r.newStrategy = route.NewRoundRobinStrategy
+	}
+
+	if c.OutlierDetection.ConsecutiveFailures > 0 {
+		r.outlierDetector = &route.OutlierDetector{
+			ConsecutiveFailures: c.OutlierDetection.ConsecutiveFailures,
+			BaseEjectionTime:    c.OutlierDetection.BaseEjectionTime,
+			MaxEjectionTime:     c.OutlierDetection.MaxEjectionTime,
+			MaxEjectionPercent:  c.OutlierDetection.MaxEjectionPercent,
+		}
+	}
+
+	if c.CircuitBreaker.ErrorPercent > 0 || c.CircuitBreaker.TimeoutPercent > 0 {
+		r.circuitBreaker = &route.CircuitBreaker{
+			Window:         c.CircuitBreaker.Window,
+			MinRequests:    c.CircuitBreaker.MinRequests,
+			ErrorPercent:   c.CircuitBreaker.ErrorPercent,
+			TimeoutPercent: c.CircuitBreaker.TimeoutPercent,
+			OpenTime:       c.CircuitBreaker.OpenTime,
+			MaxOpenPercent: c.CircuitBreaker.MaxOpenPercent,
+		}
+	}
+
+	r.maxUnhealthyPercent = c.HealthCheck.MaxUnhealthyPercent
+
 	r.pruneStaleDropletsInterval = c.PruneStaleDropletsInterval
 	r.dropletStaleThreshold = c.DropletStaleThreshold
 
@@ -61,7 +103,7 @@ func (registry *CFRegistry) Register(uri route.Uri, endpoint *route.Endpoint) {
 	registry.Lock()
 	defer registry.Unlock()
 
-	uri = uri.ToLower()
+	uri = uri.RouteKey()
 
 	key := tableKey{
 		addr: endpoint.CanonicalAddr(),
@@ -71,18 +113,31 @@ func (registry *CFRegistry) Register(uri route.Uri, endpoint *route.Endpoint) {
 	var endpointToRegister *route.Endpoint
 
 	entry, found := registry.table[key]
-	if found {
+	if found && sameRegistration(entry.endpoint, endpoint) {
 		endpointToRegister = entry.endpoint
+	} else if found {
+		// The endpoint's registration changed, such as its weight or tags,
+		// so it takes the place of the one registered before. Endpoints are
+		// read without locks while requests are routed, and so are replaced
+		// rather than updated.
+		endpoint.SetHealthy(entry.endpoint.Healthy())
+
+		endpointToRegister = endpoint
+		entry.endpoint = endpoint
 	} else {
 		endpointToRegister = endpoint
 		entry = &tableEntry{endpoint: endpoint}
 
 		registry.table[key] = entry
+		registry.addrRefs[key.addr]++
 	}
 
 	pool, found := registry.byUri[uri]
 	if !found {
-		pool = route.NewPool()
+		pool = route.NewPoolWithStrategy(registry.newStrategy())
+		pool.OutlierDetector = registry.outlierDetector
+		pool.CircuitBreaker = registry.circuitBreaker
+		pool.MaxUnhealthyPercent = registry.maxUnhealthyPercent
 		registry.byUri[uri] = pool
 	}
 
@@ -97,7 +152,7 @@ func (registry *CFRegistry) Unregister(uri route.Uri, endpoint *route.Endpoint)
 	registry.Lock()
 	defer registry.Unlock()
 
-	uri = uri.ToLower()
+	uri = uri.RouteKey()
 
 	key := tableKey{
 		addr: endpoint.CanonicalAddr(),
@@ -107,6 +162,29 @@ func (registry *CFRegistry) Unregister(uri route.Uri, endpoint *route.Endpoint)
 	registry.unregisterUri(key)
 }
 
+// sameRegistration reports whether an endpoint registered again for its route
+// is registered the same way as before.
+func sameRegistration(registered, endpoint *route.Endpoint) bool {
+	return registered.ApplicationId == endpoint.ApplicationId &&
+		registered.PrivateInstanceId == endpoint.PrivateInstanceId &&
+		registered.Weight == endpoint.Weight &&
+		registered.TLS == endpoint.TLS &&
+		registered.ServerName == endpoint.ServerName &&
+		registered.RouteServiceUrl == endpoint.RouteServiceUrl &&
+		reflect.DeepEqual(registered.Tags, endpoint.Tags)
+}
+
+// OnEndpointRemoved registers a callback that is invoked once an endpoint's
+// address is no longer referenced by any route, either because it was
+// unregistered or because it was pruned. Callbacks run with the registry
+// locked and must not call back into the registry.
+func (r *CFRegistry) OnEndpointRemoved(callback func(*route.Endpoint)) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.endpointRemovedCallbacks = append(r.endpointRemovedCallbacks, callback)
+}
+
 func (r *CFRegistry) Lookup(uri route.Uri) (*route.Endpoint, bool) {
 	r.RLock()
 	defer r.RUnlock()
@@ -116,7 +194,19 @@ func (r *CFRegistry) Lookup(uri route.Uri) (*route.Endpoint, bool) {
 		return nil, false
 	}
 
-	return pool.Sample()
+	return pool.Next()
+}
+
+func (r *CFRegistry) LookupExcept(uri route.Uri, excluded ...*route.Endpoint) (*route.Endpoint, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	pool, ok := r.lookupByUri(uri)
+	if !ok {
+		return nil, false
+	}
+
+	return pool.NextExcept(excluded...)
 }
 
 func (r *CFRegistry) LookupByPrivateInstanceId(uri route.Uri, p string) (*route.Endpoint, bool) {
@@ -131,10 +221,57 @@ func (r *CFRegistry) LookupByPrivateInstanceId(uri route.Uri, p string) (*route.
 	return pool.FindByPrivateInstanceId(p)
 }
 
+// RouteUri returns the URI of the route that requests for the URI are routed
+// by, such as a wildcard route or a path prefix of the URI, whether or not
+// any of its endpoints can be picked at the moment.
+func (r *CFRegistry) RouteUri(uri route.Uri) (route.Uri, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.routeKey(uri)
+}
+
 func (r *CFRegistry) lookupByUri(uri route.Uri) (*route.Pool, bool) {
-	uri = uri.ToLower()
-	pool, ok := r.byUri[uri]
-	return pool, ok
+	key, ok := r.routeKey(uri)
+	if !ok {
+		return nil, false
+	}
+
+	return r.byUri[key], true
+}
+
+// routeKey finds the route for the URI's host, or else the most specific
+// wildcard route covering it, with the longest path prefix of the URI. Every
+// candidate is a single map lookup, so the cost only depends on the number of
+// labels and path segments of the URI.
+func (r *CFRegistry) routeKey(uri route.Uri) (route.Uri, bool) {
+	uri = uri.RouteKey()
+
+	for {
+		key, ok := r.routeKeyByPathPrefix(uri)
+		if ok {
+			return key, true
+		}
+
+		uri, ok = uri.NextWildcard()
+		if !ok {
+			return "", false
+		}
+	}
+}
+
+func (r *CFRegistry) routeKeyByPathPrefix(uri route.Uri) (route.Uri, bool) {
+	for {
+		_, ok := r.byUri[uri]
+		if ok {
+			return uri, true
+		}
+
+		uri, ok = uri.Parent()
+		if !ok {
+			return "", false
+		}
+	}
 }
 
 func (registry *CFRegistry) StartPruningCycle() {
@@ -179,6 +316,52 @@ func (r *CFRegistry) NumEndpoints() int {
 	return len(mapForSize)
 }
 
+// NumUnhealthyEndpoints returns the number of endpoint addresses for which a
+// health check failed on any of their routes.
+func (r *CFRegistry) NumUnhealthyEndpoints() int {
+	r.RLock()
+	defer r.RUnlock()
+
+	mapForSize := make(map[string]bool)
+	for _, entry := range r.table {
+		if !entry.endpoint.Healthy() {
+			mapForSize[entry.endpoint.CanonicalAddr()] = true
+		}
+	}
+
+	return len(mapForSize)
+}
+
+// NumOpenCircuits returns the number of endpoint addresses whose circuit is
+// open or half-open on any of their routes.
+func (r *CFRegistry) NumOpenCircuits() int {
+	r.RLock()
+	defer r.RUnlock()
+
+	mapForSize := make(map[string]bool)
+	for _, entry := range r.table {
+		if entry.endpoint.CircuitState() != route.CircuitClosed {
+			mapForSize[entry.endpoint.CanonicalAddr()] = true
+		}
+	}
+
+	return len(mapForSize)
+}
+
+// Endpoints returns the endpoints of all routes; an address registered for
+// several URIs is returned once per URI.
+func (r *CFRegistry) Endpoints() []*route.Endpoint {
+	r.RLock()
+	defer r.RUnlock()
+
+	endpoints := make([]*route.Endpoint, 0, len(r.table))
+	for _, entry := range r.table {
+		endpoints = append(endpoints, entry.endpoint)
+	}
+
+	return endpoints
+}
+
 func (r *CFRegistry) MarshalJSON() ([]byte, error) {
 	r.RLock()
 	defer r.RUnlock()
@@ -244,4 +427,13 @@ func (registry *CFRegistry) unregisterUri(key tableKey) {
 	}
 
 	delete(registry.table, key)
+
+	registry.addrRefs[key.addr]--
+	if registry.addrRefs[key.addr] <= 0 {
+		delete(registry.addrRefs, key.addr)
+
+		for _, callback := range registry.endpointRemovedCallbacks {
+			callback(entry.endpoint)
+		}
+	}
 }
@@ -215,6 +215,101 @@ func (s *CFRegistrySuite) TestLookup(c *C) {
 	c.Check(b.CanonicalAddr(), Equals, "192.168.1.1:1234")
 }
 
+func (s *CFRegistrySuite) TestLookupByLongestPathPrefix(c *C) {
+	s.r.Register("foo.com", fooEndpoint)
+	s.r.Register("foo.com/api", barEndpoint)
+	s.r.Register("foo.com/api/v2/", bar2Endpoint)
+
+	for uri, expected := range map[route.Uri]*route.Endpoint{
+		"foo.com":              fooEndpoint,
+		"foo.com/":             fooEndpoint,
+		"foo.com/apix":         fooEndpoint,
+		"foo.com/api":          barEndpoint,
+		"foo.com/API/":         barEndpoint,
+		"foo.com/api/v1/users": barEndpoint,
+		"foo.com/api/v2":       bar2Endpoint,
+		"foo.com/api/v2/users": bar2Endpoint,
+	} {
+		b, ok := s.r.Lookup(uri)
+		c.Assert(ok, Equals, true)
+		c.Check(b, Equals, expected, Commentf("uri: %s", uri))
+	}
+
+	_, ok := s.r.Lookup("bar.com/api")
+	c.Check(ok, Equals, false)
+}
+
+func (s *CFRegistrySuite) TestLookupWildcard(c *C) {
+	s.r.Register("*.apps.foo.com", fooEndpoint)
+	s.r.Register("*.foo.com", barEndpoint)
+	s.r.Register("exact.apps.foo.com", bar2Endpoint)
+
+	for uri, expected := range map[route.Uri]*route.Endpoint{
+		"tenant.apps.foo.com":     fooEndpoint,
+		"a.tenant.apps.foo.com":   fooEndpoint,
+		"TENANT.apps.foo.com/api": fooEndpoint,
+		"apps.foo.com":            barEndpoint,
+		"other.foo.com":           barEndpoint,
+		"exact.apps.foo.com":      bar2Endpoint,
+	} {
+		b, ok := s.r.Lookup(uri)
+		c.Assert(ok, Equals, true)
+		c.Check(b, Equals, expected, Commentf("uri: %s", uri))
+	}
+
+	_, ok := s.r.Lookup("foo.com")
+	c.Check(ok, Equals, false)
+
+	s.r.Unregister("*.apps.foo.com", fooEndpoint)
+
+	b, ok := s.r.Lookup("tenant.apps.foo.com")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, barEndpoint)
+}
+
+func (s *CFRegistrySuite) TestExactHostWinsOverWildcardPath(c *C) {
+	s.r.Register("*.foo.com/api", fooEndpoint)
+	s.r.Register("app.foo.com", barEndpoint)
+
+	b, ok := s.r.Lookup("app.foo.com/api")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, barEndpoint)
+
+	b, ok = s.r.Lookup("other.foo.com/api/users")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, fooEndpoint)
+
+	_, ok = s.r.Lookup("other.foo.com/")
+	c.Check(ok, Equals, false)
+}
+
+func (s *CFRegistrySuite) TestUnregisterPathRoute(c *C) {
+	s.r.Register("foo.com", fooEndpoint)
+	s.r.Register("foo.com/api", barEndpoint)
+	c.Check(s.r.NumUris(), Equals, 2)
+
+	s.r.Unregister("foo.com/api/", barEndpoint)
+	c.Check(s.r.NumUris(), Equals, 1)
+
+	b, ok := s.r.Lookup("foo.com/api")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, fooEndpoint)
+}
+
+func (s *CFRegistrySuite) TestPrunePathRoute(c *C) {
+	s.r.Register("foo.com/api", barEndpoint)
+
+	time.Sleep(configObj.DropletStaleThreshold + 1*time.Millisecond)
+	s.r.Register("foo.com", fooEndpoint)
+	s.r.PruneStaleDroplets()
+
+	c.Check(s.r.NumUris(), Equals, 1)
+
+	b, ok := s.r.Lookup("foo.com/api")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, fooEndpoint)
+}
+
 func (s *CFRegistrySuite) TestLookupDoubleRegister(c *C) {
 	m1 := &route.Endpoint{
 		Host: "192.168.1.2",
@@ -236,6 +331,62 @@ func (s *CFRegistrySuite) TestLookupDoubleRegister(c *C) {
 	c.Check(s.r.NumEndpoints(), Equals, 2)
 }
 
+func (s *CFRegistrySuite) TestRegisterAgainKeepsEndpoint(c *C) {
+	m1 := &route.Endpoint{Host: "192.168.1.2", Port: 1234, Tags: map[string]string{"a": "b"}}
+	m2 := &route.Endpoint{Host: "192.168.1.2", Port: 1234, Tags: map[string]string{"a": "b"}}
+
+	s.r.Register("bar", m1)
+	s.r.Register("bar", m2)
+
+	b, ok := s.r.Lookup("bar")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, m1)
+}
+
+func (s *CFRegistrySuite) TestRegisterWithNewWeightChangesBalancing(c *C) {
+	m1 := &route.Endpoint{Host: "192.168.1.2", Port: 1234}
+	m2 := &route.Endpoint{Host: "192.168.1.2", Port: 1235}
+
+	s.r.Register("bar", m1)
+	s.r.Register("bar", m2)
+
+	heavier := &route.Endpoint{Host: "192.168.1.2", Port: 1234, Weight: 3}
+	s.r.Register("bar", heavier)
+
+	c.Check(s.r.NumEndpoints(), Equals, 2)
+
+	counts := make(map[*route.Endpoint]int)
+	for i := 0; i < 40; i++ {
+		b, ok := s.r.Lookup("bar")
+		c.Assert(ok, Equals, true)
+		counts[b]++
+	}
+
+	c.Check(counts[heavier], Equals, 30)
+	c.Check(counts[m2], Equals, 10)
+	c.Check(counts[m1], Equals, 0)
+}
+
+func (s *CFRegistrySuite) TestRegisterWithNewTagsReplacesEndpoint(c *C) {
+	m1 := &route.Endpoint{Host: "192.168.1.2", Port: 1234}
+	m1.SetHealthy(false)
+
+	s.r.Register("bar", m1)
+
+	m2 := &route.Endpoint{Host: "192.168.1.2", Port: 1234, Tags: map[string]string{"response_cache": "true"}}
+	s.r.Register("bar", m2)
+
+	// Health is kept until the next check
+	c.Check(m2.Healthy(), Equals, false)
+
+	m2.SetHealthy(true)
+
+	b, ok := s.r.Lookup("bar")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, m2)
+	c.Check(m1.Pool(), IsNil)
+}
+
 func (s *CFRegistrySuite) TestPruneStaleApps(c *C) {
 	s.r.Register("foo", fooEndpoint)
 	s.r.Register("fooo", fooEndpoint)
@@ -348,5 +499,68 @@ func (s *CFRegistrySuite) TestInfoMarshalling(c *C) {
 	marshalled, err := json.Marshal(s.r)
 	c.Check(err, IsNil)
 
-	c.Check(string(marshalled), Equals, "{\"foo\":[\"192.168.1.1:1234\"]}")
+	c.Check(string(marshalled), Equals, `{"foo":[{"address":"192.168.1.1:1234","weight":1,"healthy":true,"circuit":"closed"}]}`)
+}
+
+func (s *CFRegistrySuite) TestOnEndpointRemovedWhenUnregistered(c *C) {
+	removed := []string{}
+	s.r.OnEndpointRemoved(func(e *route.Endpoint) {
+		removed = append(removed, e.CanonicalAddr())
+	})
+
+	s.r.Register("bar", barEndpoint)
+	s.r.Register("baar", barEndpoint)
+
+	s.r.Unregister("bar", barEndpoint)
+	c.Check(removed, DeepEquals, []string{})
+
+	s.r.Unregister("baar", barEndpoint)
+	c.Check(removed, DeepEquals, []string{"192.168.1.2:4321"})
+}
+
+func (s *CFRegistrySuite) TestOnEndpointRemovedWhenPruned(c *C) {
+	removed := []string{}
+	s.r.OnEndpointRemoved(func(e *route.Endpoint) {
+		removed = append(removed, e.CanonicalAddr())
+	})
+
+	s.r.Register("foo", fooEndpoint)
+
+	time.Sleep(configObj.DropletStaleThreshold + 1*time.Millisecond)
+	s.r.PruneStaleDroplets()
+
+	c.Check(removed, DeepEquals, []string{"192.168.1.1:1234"})
+}
+
+func (s *CFRegistrySuite) TestEndpoints(c *C) {
+	s.r.Register("foo", fooEndpoint)
+	s.r.Register("bar", barEndpoint)
+	s.r.Register("baar", barEndpoint)
+
+	c.Check(s.r.Endpoints(), HasLen, 3)
+}
+
+func (s *CFRegistrySuite) TestRouteUri(c *C) {
+	s.r.Register("foo", fooEndpoint)
+	s.r.Register("*.example.com/app", barEndpoint)
+
+	uri, ok := s.r.RouteUri("foo/bar")
+	c.Check(ok, Equals, true)
+	c.Check(uri, Equals, route.Uri("foo"))
+
+	uri, ok = s.r.RouteUri("www.example.com/app/x")
+	c.Check(ok, Equals, true)
+	c.Check(uri, Equals, route.Uri("*.example.com/app"))
+
+	_, ok = s.r.RouteUri("bar")
+	c.Check(ok, Equals, false)
+}
+
+func (s *CFRegistrySuite) TestNumUnhealthyEndpoints(c *C) {
+	s.r.Register("foo", fooEndpoint)
+	s.r.Register("bar", barEndpoint)
+	c.Check(s.r.NumUnhealthyEndpoints(), Equals, 0)
+
+	barEndpoint.SetHealthy(false)
+	c.Check(s.r.NumUnhealthyEndpoints(), Equals, 1)
 }
@@ -0,0 +1,162 @@
+package route
+
+import (
+	"time"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+// CircuitBreaker stops routing to endpoints whose requests fail or time out
+// too often. An endpoint's circuit opens when the share of failed or of timed
+// out requests over a window exceeds its limit. After OpenTime the circuit is
+// half-open and lets a trial request through, which closes it again if it
+// succeeds and keeps it open for another OpenTime if it fails. No more than
+// MaxOpenPercent of a pool's circuits are open at the same time.
+type CircuitBreaker struct {
+	// Requests are counted over consecutive windows of this length
+	Window time.Duration
+
+	// Requests a window needs before the circuit can open
+	MinRequests int
+
+	// Shares of a window's requests, in percent, that may fail or time out
+	// before the circuit opens; zero disables the limit
+	ErrorPercent   int
+	TimeoutPercent int
+
+	OpenTime time.Duration
+
+	// Share of a pool's endpoints whose circuit may be open at the same time
+	MaxOpenPercent int
+}
+
+// circuit is an endpoint's circuit breaker state.
+type circuit struct {
+	open bool
+
+	// An open circuit lets no requests through until then
+	retryAt time.Time
+
+	// Set once a half-open circuit has let a trial request through, at
+	// trialAt
+	trial   bool
+	trialAt time.Time
+
+	windowStart time.Time
+	requests    int
+	errors      int
+	timeouts    int
+}
+
+func (c *circuit) state(now time.Time) CircuitState {
+	switch {
+	case !c.open:
+		return CircuitClosed
+	case now.Before(c.retryAt):
+		return CircuitOpen
+	}
+
+	return CircuitHalfOpen
+}
+
+// picked records that a request is being routed to an endpoint. A half-open
+// circuit lets no more requests through until the trial request's outcome is
+// known or OpenTime has passed. Must be called with the pool locked.
+func (b *CircuitBreaker) picked(e *Endpoint, now time.Time) {
+	if e.circuit.state(now) == CircuitHalfOpen {
+		e.circuit.trial = true
+		e.circuit.trialAt = now
+		e.circuit.retryAt = now.Add(b.OpenTime)
+	}
+}
+
+// tookTrial reports whether the trial was let through for a request that
+// picked the endpoint at or after since, which is the token the request's
+// outcome is reported with. The circuit was closed when any other request
+// picked the endpoint, so another trial can only start OpenTime after that.
+func (c *circuit) tookTrial(since time.Time, openTime time.Duration) bool {
+	return c.trial && !c.trialAt.Before(since) && c.trialAt.Before(since.Add(openTime))
+}
+
+// skipped gives back the trial of a half-open circuit when the request it was
+// let through for is not sent to the endpoint after all, so that the next
+// request becomes the trial. Must be called with the pool locked.
+func (b *CircuitBreaker) skipped(e *Endpoint, since, now time.Time) {
+	c := &e.circuit
+
+	if !c.tookTrial(since, b.OpenTime) {
+		return
+	}
+
+	c.trial = false
+	c.retryAt = now
+}
+
+// record records the outcome of a request that picked an endpoint of the
+// pool at or after since. Must be called with the pool locked.
+func (b *CircuitBreaker) record(p *Pool, e *Endpoint, failed, timedOut bool, since, now time.Time) {
+	c := &e.circuit
+
+	if c.open {
+		// Only the trial request decides, not requests that were in flight
+		// when the circuit opened
+		if !c.tookTrial(since, b.OpenTime) {
+			return
+		}
+
+		if failed {
+			c.trial = false
+			c.retryAt = now.Add(b.OpenTime)
+			return
+		}
+
+		*c = circuit{windowStart: now}
+		return
+	}
+
+	if now.Sub(c.windowStart) >= b.Window {
+		*c = circuit{windowStart: now}
+	}
+
+	c.requests++
+	if failed {
+		c.errors++
+	}
+	if timedOut {
+		c.timeouts++
+	}
+
+	if c.requests < b.MinRequests {
+		return
+	}
+
+	if exceeds(c.errors, c.requests, b.ErrorPercent) || exceeds(c.timeouts, c.requests, b.TimeoutPercent) {
+		if p.numOpenCircuits() >= len(p.endpoints)*b.MaxOpenPercent/100 {
+			return
+		}
+
+		c.open = true
+		c.retryAt = now.Add(b.OpenTime)
+	}
+}
+
+func exceeds(n, total, percent int) bool {
+	return percent > 0 && n*100 > total*percent
+}
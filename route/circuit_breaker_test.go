@@ -0,0 +1,259 @@
+package route
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type CircuitBreakerSuite struct {
+	pool *Pool
+}
+
+var _ = Suite(&CircuitBreakerSuite{})
+
+func (s *CircuitBreakerSuite) SetUpTest(c *C) {
+	s.pool = NewPool()
+	s.pool.CircuitBreaker = &CircuitBreaker{
+		Window:         10 * time.Second,
+		MinRequests:    4,
+		ErrorPercent:   50,
+		TimeoutPercent: 25,
+		OpenTime:       30 * time.Second,
+		MaxOpenPercent: 100,
+	}
+}
+
+func (s *CircuitBreakerSuite) TestCircuitOpensOnErrorRate(c *C) {
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+
+	e1.RequestSucceeded(time.Now())
+	e1.RequestFailed(time.Now())
+	e1.RequestSucceeded(time.Now())
+	c.Check(e1.CircuitState(), Equals, CircuitClosed)
+
+	// Two out of four is not above half
+	e1.RequestFailed(time.Now())
+	c.Check(e1.CircuitState(), Equals, CircuitClosed)
+
+	e1.RequestFailed(time.Now())
+	c.Check(e1.CircuitState(), Equals, CircuitOpen)
+
+	for i := 0; i < 10; i++ {
+		e, ok := s.pool.Next()
+		c.Assert(ok, Equals, true)
+		c.Check(e, Equals, e2)
+	}
+}
+
+func (s *CircuitBreakerSuite) TestCircuitOpensOnTimeoutRate(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	for i := 0; i < 3; i++ {
+		e.RequestSucceeded(time.Now())
+	}
+	e.RequestTimedOut(time.Now())
+	c.Check(e.CircuitState(), Equals, CircuitClosed)
+
+	e.RequestTimedOut(time.Now())
+	c.Check(e.CircuitState(), Equals, CircuitOpen)
+
+	_, ok := s.pool.Next()
+	c.Check(ok, Equals, false)
+}
+
+func (s *CircuitBreakerSuite) TestCircuitsOpenUpToMaxOpenPercent(c *C) {
+	s.pool.CircuitBreaker.MaxOpenPercent = 50
+
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+
+	for i := 0; i < 4; i++ {
+		e1.RequestFailed(time.Now())
+		e2.RequestFailed(time.Now())
+	}
+
+	c.Check(e1.CircuitState(), Equals, CircuitOpen)
+	c.Check(e2.CircuitState(), Equals, CircuitClosed)
+
+	e, ok := s.pool.Next()
+	c.Assert(ok, Equals, true)
+	c.Check(e, Equals, e2)
+}
+
+func (s *CircuitBreakerSuite) TestCircuitNeedsMinimumRequests(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	for i := 0; i < 3; i++ {
+		e.RequestFailed(time.Now())
+	}
+	c.Check(e.CircuitState(), Equals, CircuitClosed)
+}
+
+func (s *CircuitBreakerSuite) TestCountsStartOverEveryWindow(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	for i := 0; i < 3; i++ {
+		e.RequestFailed(time.Now())
+	}
+
+	e.circuit.windowStart = time.Now().Add(-10 * time.Second)
+
+	e.RequestFailed(time.Now())
+	c.Check(e.CircuitState(), Equals, CircuitClosed)
+	c.Check(e.circuit.requests, Equals, 1)
+}
+
+func (s *CircuitBreakerSuite) TestHalfOpenCircuitLetsOneTrialRequestThrough(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	for i := 0; i < 4; i++ {
+		e.RequestFailed(time.Now())
+	}
+	c.Assert(e.CircuitState(), Equals, CircuitOpen)
+
+	// Requests that were in flight when the circuit opened do not count
+	e.RequestSucceeded(time.Now())
+	c.Check(e.CircuitState(), Equals, CircuitOpen)
+
+	e.circuit.retryAt = time.Now().Add(-time.Second)
+	c.Check(e.CircuitState(), Equals, CircuitHalfOpen)
+
+	since := time.Now()
+
+	picked, ok := s.pool.Next()
+	c.Assert(ok, Equals, true)
+	c.Check(picked, Equals, e)
+
+	_, ok = s.pool.Next()
+	c.Check(ok, Equals, false)
+
+	e.RequestSucceeded(since)
+	c.Check(e.CircuitState(), Equals, CircuitClosed)
+
+	_, ok = s.pool.Next()
+	c.Check(ok, Equals, true)
+}
+
+func (s *CircuitBreakerSuite) TestFailedTrialRequestKeepsCircuitOpen(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	for i := 0; i < 4; i++ {
+		e.RequestFailed(time.Now())
+	}
+
+	e.circuit.retryAt = time.Now().Add(-time.Second)
+
+	since := time.Now()
+
+	_, ok := s.pool.Next()
+	c.Assert(ok, Equals, true)
+
+	e.RequestTimedOut(since)
+	c.Check(e.CircuitState(), Equals, CircuitOpen)
+	c.Check(e.circuit.retryAt.After(time.Now().Add(29*time.Second)), Equals, true)
+}
+
+func (s *CircuitBreakerSuite) TestLateCompletionDoesNotDecideTrial(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	// Picked before the circuit opened
+	since := time.Now().Add(-time.Minute)
+
+	for i := 0; i < 4; i++ {
+		e.RequestFailed(time.Now())
+	}
+
+	e.circuit.retryAt = time.Now().Add(-time.Second)
+
+	_, ok := s.pool.Next()
+	c.Assert(ok, Equals, true)
+
+	e.RequestSucceeded(since)
+	c.Check(e.CircuitState(), Equals, CircuitOpen)
+
+	e.RequestFailed(since)
+	c.Check(e.circuit.trial, Equals, true)
+}
+
+func (s *CircuitBreakerSuite) TestSkippedTrialRequestIsGivenBack(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	for i := 0; i < 4; i++ {
+		e.RequestFailed(time.Now())
+	}
+
+	e.circuit.retryAt = time.Now().Add(-time.Second)
+
+	since := time.Now()
+
+	_, ok := s.pool.Next()
+	c.Assert(ok, Equals, true)
+
+	_, ok = s.pool.Next()
+	c.Check(ok, Equals, false)
+
+	e.RequestSkipped(since)
+	c.Check(e.CircuitState(), Equals, CircuitHalfOpen)
+
+	_, ok = s.pool.Next()
+	c.Check(ok, Equals, true)
+}
+
+func (s *CircuitBreakerSuite) TestSkippingDoesNotGiveBackLaterTrial(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	// Picked before the circuit opened
+	since := time.Now().Add(-time.Minute)
+
+	for i := 0; i < 4; i++ {
+		e.RequestFailed(time.Now())
+	}
+
+	e.circuit.retryAt = time.Now().Add(-time.Second)
+
+	_, ok := s.pool.Next()
+	c.Assert(ok, Equals, true)
+
+	e.RequestSkipped(since)
+
+	_, ok = s.pool.Next()
+	c.Check(ok, Equals, false)
+}
+
+func (s *CircuitBreakerSuite) TestOpenCircuitIsNotUsedForStickySessions(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234, PrivateInstanceId: "id1"}
+	s.pool.Add(e)
+
+	for i := 0; i < 4; i++ {
+		e.RequestFailed(time.Now())
+	}
+
+	_, ok := s.pool.FindByPrivateInstanceId("id1")
+	c.Check(ok, Equals, false)
+}
+
+func (s *CircuitBreakerSuite) TestOpenCircuitIsShownInDetails(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	for i := 0; i < 4; i++ {
+		e.RequestFailed(time.Now())
+	}
+
+	c.Check(s.pool.Details(), DeepEquals, []EndpointDetail{
+		{Address: "1.2.3.4:1234", Weight: 1, Healthy: true, Circuit: "open"},
+	})
+}
@@ -4,26 +4,226 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Endpoint struct {
 	sync.Mutex
 
+	// Number of requests currently being served by this endpoint
+	inFlight int32
+
+	// Set while health checks find the endpoint unhealthy
+	unhealthy int32
+
+	// The pool the endpoint was last added to, guarded by the endpoint's lock
+	pool *Pool
+
+	// Outlier detection state, guarded by the pool's lock
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+
+	// Circuit breaker state, guarded by the pool's lock
+	circuit circuit
+
 	ApplicationId     string
 	Host              string
 	Port              uint16
 	Tags              map[string]string
 	PrivateInstanceId string
+
+	// Share of the pool's traffic relative to the other endpoints;
+	// endpoints registered without a weight count as weight 1
+	Weight int
+
+	// Whether the endpoint is connected to over TLS, and the name its
+	// certificate is verified against; the host is used when empty
+	TLS        bool
+	ServerName string
+
+	// Requests for the endpoint's route are sent to the route service at
+	// this URL first, when set
+	RouteServiceUrl string
 }
 
 func (e *Endpoint) MarshalJSON() ([]byte, error) {
 	return json.Marshal(e.CanonicalAddr())
 }
 
+// EndpointDetail describes an endpoint along with the state the router keeps
+// for it, for /routes.
+type EndpointDetail struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	Circuit string `json:"circuit"`
+}
+
+// detail is guarded by the lock of the endpoint's pool.
+func (e *Endpoint) detail(now time.Time) EndpointDetail {
+	return EndpointDetail{
+		Address: e.CanonicalAddr(),
+		Weight:  e.normalizedWeight(),
+		Healthy: e.Healthy(),
+		Circuit: e.circuit.state(now).String(),
+	}
+}
+
+func (e *Endpoint) normalizedWeight() int {
+	if e.Weight <= 0 {
+		return 1
+	}
+
+	return e.Weight
+}
+
+// TLSServerName returns the name the endpoint's certificate must be valid for.
+func (e *Endpoint) TLSServerName() string {
+	if e.ServerName != "" {
+		return e.ServerName
+	}
+
+	return e.Host
+}
+
 func (e *Endpoint) CanonicalAddr() string {
 	return fmt.Sprintf("%s:%d", e.Host, e.Port)
 }
 
+// RequestStarted is called by the proxy when it starts routing a request to
+// the endpoint, so that the endpoint's pool can balance on in-flight requests.
+func (e *Endpoint) RequestStarted() {
+	atomic.AddInt32(&e.inFlight, 1)
+}
+
+// RequestFinished is called by the proxy once the endpoint is done serving a
+// request, whether it succeeded or not.
+func (e *Endpoint) RequestFinished() {
+	atomic.AddInt32(&e.inFlight, -1)
+}
+
+func (e *Endpoint) InFlight() int32 {
+	return atomic.LoadInt32(&e.inFlight)
+}
+
+// SetHealthy is called by health checks to take the endpoint out of its
+// pool's selection, or to put it back once it has recovered.
+func (e *Endpoint) SetHealthy(healthy bool) {
+	var unhealthy int32
+	if !healthy {
+		unhealthy = 1
+	}
+
+	atomic.StoreInt32(&e.unhealthy, unhealthy)
+}
+
+func (e *Endpoint) Healthy() bool {
+	return atomic.LoadInt32(&e.unhealthy) == 0
+}
+
+// RequestFailed is called by the proxy when the endpoint could not be reached
+// or answered with a server error, for a request that picked the endpoint at
+// or after since. It returns how long the endpoint has been ejected from its
+// pool for, if the failure got it ejected.
+func (e *Endpoint) RequestFailed(since time.Time) (time.Duration, bool) {
+	pool := e.owner()
+	if pool == nil {
+		return 0, false
+	}
+
+	return pool.endpointFailed(e, false, since)
+}
+
+// RequestTimedOut is like RequestFailed, for requests that timed out
+// connecting to the endpoint or waiting for its response.
+func (e *Endpoint) RequestTimedOut(since time.Time) (time.Duration, bool) {
+	pool := e.owner()
+	if pool == nil {
+		return 0, false
+	}
+
+	return pool.endpointFailed(e, true, since)
+}
+
+// RequestSucceeded is called by the proxy when the endpoint answered without
+// a server error, for a request that picked the endpoint at or after since.
+func (e *Endpoint) RequestSucceeded(since time.Time) {
+	pool := e.owner()
+	if pool == nil {
+		return
+	}
+
+	pool.endpointSucceeded(e, since)
+}
+
+// RequestSkipped is called by the proxy when the request it picked the
+// endpoint for, at or after since, is not sent to the endpoint, such as when
+// it is rate limited or handed to a route service, so that the trial request
+// of a half-open circuit is not spent on it.
+func (e *Endpoint) RequestSkipped(since time.Time) {
+	pool := e.owner()
+	if pool == nil {
+		return
+	}
+
+	pool.endpointSkipped(e, since)
+}
+
+// CircuitState returns the state of the endpoint's circuit breaker.
+func (e *Endpoint) CircuitState() CircuitState {
+	pool := e.owner()
+	if pool == nil {
+		return CircuitClosed
+	}
+
+	return pool.circuitState(e)
+}
+
+// Pool returns the pool of the route the endpoint is registered for, or nil
+// once it has been removed.
+func (e *Endpoint) Pool() *Pool {
+	return e.owner()
+}
+
+func (e *Endpoint) owner() *Pool {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.pool
+}
+
+func (e *Endpoint) setOwner(pool *Pool) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.pool = pool
+}
+
+func (e *Endpoint) clearOwner(pool *Pool) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.pool == pool {
+		e.pool = nil
+	}
+}
+
+func (e *Endpoint) isEjected(now time.Time) bool {
+	return now.Before(e.ejectedUntil)
+}
+
+// isAvailable reports whether the endpoint may be picked. Its health is only
+// taken into account when checkHealth is set.
+func (e *Endpoint) isAvailable(now time.Time, checkHealth bool) bool {
+	if checkHealth && !e.Healthy() {
+		return false
+	}
+
+	return !e.isEjected(now) && e.circuit.state(now) != CircuitOpen
+}
+
 func (e *Endpoint) ToLogData() interface{} {
 	return struct {
 		ApplicationId string
@@ -0,0 +1,56 @@
+package route
+
+import (
+	"time"
+)
+
+// OutlierDetector takes endpoints that keep failing out of their pool's
+// selection for a while. Every ejection of an endpoint lasts
+// BaseEjectionTime longer than the previous one, up to MaxEjectionTime.
+type OutlierDetector struct {
+	// Number of consecutive failures after which an endpoint is ejected
+	ConsecutiveFailures int
+
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+
+	// Share of a pool's endpoints that may be ejected at the same time
+	MaxEjectionPercent int
+}
+
+// failed records a failed request to an endpoint of the given pool and
+// ejects the endpoint if it is due. Must be called with the pool locked.
+func (d *OutlierDetector) failed(p *Pool, e *Endpoint, now time.Time) (time.Duration, bool) {
+	e.consecutiveFailures++
+
+	if e.consecutiveFailures < d.ConsecutiveFailures || e.isEjected(now) {
+		return 0, false
+	}
+
+	if p.numEjected(now) >= len(p.endpoints)*d.MaxEjectionPercent/100 {
+		return 0, false
+	}
+
+	// Forget earlier ejections once the endpoint has behaved for long enough
+	if now.Sub(e.ejectedUntil) > d.MaxEjectionTime {
+		e.ejections = 0
+	}
+
+	e.ejections++
+
+	ejectionTime := d.BaseEjectionTime * time.Duration(e.ejections)
+	if ejectionTime > d.MaxEjectionTime {
+		ejectionTime = d.MaxEjectionTime
+	}
+
+	e.ejectedUntil = now.Add(ejectionTime)
+	e.consecutiveFailures = 0
+
+	return ejectionTime, true
+}
+
+// succeeded records a successful request to an endpoint. Must be called with
+// the endpoint's pool locked.
+func (d *OutlierDetector) succeeded(e *Endpoint) {
+	e.consecutiveFailures = 0
+}
@@ -0,0 +1,149 @@
+package route
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type OutlierSuite struct {
+	pool *Pool
+}
+
+var _ = Suite(&OutlierSuite{})
+
+func (s *OutlierSuite) SetUpTest(c *C) {
+	s.pool = NewPool()
+	s.pool.OutlierDetector = &OutlierDetector{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    10 * time.Second,
+		MaxEjectionTime:     25 * time.Second,
+		MaxEjectionPercent:  50,
+	}
+}
+
+func (s *OutlierSuite) failTimes(e *Endpoint, n int) (time.Duration, bool) {
+	var ejectionTime time.Duration
+	var ejected bool
+
+	for i := 0; i < n; i++ {
+		ejectionTime, ejected = e.RequestFailed(time.Now())
+	}
+
+	return ejectionTime, ejected
+}
+
+func (s *OutlierSuite) TestEndpointIsEjectedAfterConsecutiveFailures(c *C) {
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+
+	_, ejected := s.failTimes(e1, 2)
+	c.Check(ejected, Equals, false)
+
+	ejectionTime, ejected := e1.RequestFailed(time.Now())
+	c.Check(ejected, Equals, true)
+	c.Check(ejectionTime, Equals, 10*time.Second)
+
+	for i := 0; i < 10; i++ {
+		e, ok := s.pool.Next()
+		c.Assert(ok, Equals, true)
+		c.Check(e, Equals, e2)
+	}
+}
+
+func (s *OutlierSuite) TestSuccessResetsConsecutiveFailures(c *C) {
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+
+	s.failTimes(e1, 2)
+	e1.RequestSucceeded(time.Now())
+
+	_, ejected := s.failTimes(e1, 2)
+	c.Check(ejected, Equals, false)
+}
+
+func (s *OutlierSuite) TestEjectionTimeGrowsWithRepeatedEjections(c *C) {
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+
+	for _, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second} {
+		ejectionTime, ejected := s.failTimes(e1, 3)
+		c.Check(ejected, Equals, true)
+		c.Check(ejectionTime, Equals, expected)
+
+		// Let the ejection run out
+		e1.ejectedUntil = time.Now().Add(-time.Second)
+	}
+
+	// Endpoints that behaved for long enough start over
+	e1.ejectedUntil = time.Now().Add(-time.Minute)
+
+	ejectionTime, ejected := s.failTimes(e1, 3)
+	c.Check(ejected, Equals, true)
+	c.Check(ejectionTime, Equals, 10*time.Second)
+}
+
+func (s *OutlierSuite) TestEjectionsAreLimitedToPercentageOfPool(c *C) {
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+
+	_, ejected := s.failTimes(e1, 3)
+	c.Check(ejected, Equals, true)
+
+	_, ejected = s.failTimes(e2, 3)
+	c.Check(ejected, Equals, false)
+
+	e, ok := s.pool.Next()
+	c.Assert(ok, Equals, true)
+	c.Check(e, Equals, e2)
+}
+
+func (s *OutlierSuite) TestSingleEndpointIsNeverEjected(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	s.pool.Add(e)
+
+	_, ejected := s.failTimes(e, 10)
+	c.Check(ejected, Equals, false)
+}
+
+func (s *OutlierSuite) TestRemovedEndpointIsNotTracked(c *C) {
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+	s.pool.Remove(e1)
+
+	_, ejected := s.failTimes(e1, 3)
+	c.Check(ejected, Equals, false)
+}
+
+func (s *OutlierSuite) TestEjectedEndpointIsNotUsedForStickySessions(c *C) {
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234, PrivateInstanceId: "id1"}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678, PrivateInstanceId: "id2"}
+	s.pool.Add(e1)
+	s.pool.Add(e2)
+
+	s.failTimes(e1, 3)
+
+	_, ok := s.pool.FindByPrivateInstanceId("id1")
+	c.Check(ok, Equals, false)
+}
+
+func (s *OutlierSuite) TestPoolWithoutDetectorDoesNotEject(c *C) {
+	pool := NewPool()
+
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	pool.Add(e1)
+	pool.Add(e2)
+
+	_, ejected := s.failTimes(e1, 10)
+	c.Check(ejected, Equals, false)
+}
@@ -2,49 +2,136 @@ package route
 
 import (
 	"encoding/json"
-	"math/rand"
+	"sync"
+	"time"
 )
 
 type Pool struct {
-	endpoints map[string]*Endpoint
+	sync.Mutex
+
+	endpoints []*Endpoint
+	index     map[string]int
+
+	strategy Strategy
+
+	// Ejects failing endpoints from selection when set
+	OutlierDetector *OutlierDetector
+
+	// Stops routing to endpoints with too many errors or timeouts when set
+	CircuitBreaker *CircuitBreaker
+
+	// Share of a pool's endpoints that health checks may take out of
+	// selection. Once more of them are unhealthy, the health checks are
+	// ignored and all endpoints are picked again.
+	MaxUnhealthyPercent int
 }
 
 func NewPool() *Pool {
+	return NewPoolWithStrategy(NewRoundRobinStrategy())
+}
+
+func NewPoolWithStrategy(strategy Strategy) *Pool {
 	return &Pool{
-		endpoints: make(map[string]*Endpoint),
+		endpoints: []*Endpoint{},
+		index:     make(map[string]int),
+		strategy:  strategy,
+
+		MaxUnhealthyPercent: 100,
 	}
 }
 
 func (p *Pool) Add(endpoint *Endpoint) {
-	p.endpoints[endpoint.CanonicalAddr()] = endpoint
+	p.Lock()
+	defer p.Unlock()
+
+	addr := endpoint.CanonicalAddr()
+
+	endpoint.setOwner(p)
+
+	if i, ok := p.index[addr]; ok {
+		if p.endpoints[i] != endpoint {
+			p.endpoints[i].clearOwner(p)
+			p.endpoints[i] = endpoint
+		}
+		return
+	}
+
+	p.index[addr] = len(p.endpoints)
+	p.endpoints = append(p.endpoints, endpoint)
 }
 
 func (p *Pool) Remove(endpoint *Endpoint) {
-	delete(p.endpoints, endpoint.CanonicalAddr())
-}
+	p.Lock()
+	defer p.Unlock()
+
+	addr := endpoint.CanonicalAddr()
 
-func (p *Pool) Sample() (*Endpoint, bool) {
-	if len(p.endpoints) == 0 {
-		return nil, false
+	i, ok := p.index[addr]
+	if !ok {
+		return
 	}
 
-	index := rand.Intn(len(p.endpoints))
+	p.endpoints[i].clearOwner(p)
 
-	ticker := 0
-	for _, endpoint := range p.endpoints {
-		if ticker == index {
-			return endpoint, true
+	// Move the last endpoint into the hole
+	last := len(p.endpoints) - 1
+	if i != last {
+		p.endpoints[i] = p.endpoints[last]
+		p.index[p.endpoints[i].CanonicalAddr()] = i
+	}
+
+	p.endpoints[last] = nil
+	p.endpoints = p.endpoints[:last]
+	delete(p.index, addr)
+}
+
+// Next picks an endpoint using the pool's balancing strategy.
+func (p *Pool) Next() (*Endpoint, bool) {
+	return p.NextExcept()
+}
+
+// NextExcept picks an endpoint other than the given ones using the pool's
+// balancing strategy. Ejected endpoints and endpoints whose circuit is open
+// are never picked, and neither are unhealthy ones unless more than
+// MaxUnhealthyPercent of the pool is unhealthy.
+func (p *Pool) NextExcept(excluded ...*Endpoint) (*Endpoint, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	checkHealth := p.checkHealth()
+
+	endpoint, ok := p.strategy.Next(p.endpoints, func(endpoint *Endpoint) bool {
+		if !endpoint.isAvailable(now, checkHealth) {
+			return false
+		}
+
+		for _, e := range excluded {
+			if endpoint == e {
+				return false
+			}
 		}
 
-		ticker += 1
+		return true
+	})
+
+	if ok {
+		p.picked(endpoint, now)
 	}
 
-	panic("unreachable")
+	return endpoint, ok
 }
 
 func (p *Pool) FindByPrivateInstanceId(id string) (*Endpoint, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	checkHealth := p.checkHealth()
+
 	for _, endpoint := range p.endpoints {
-		if endpoint.PrivateInstanceId == id {
+		if endpoint.PrivateInstanceId == id && endpoint.isAvailable(now, checkHealth) {
+			p.picked(endpoint, now)
 			return endpoint, true
 		}
 	}
@@ -52,16 +139,135 @@ func (p *Pool) FindByPrivateInstanceId(id string) (*Endpoint, bool) {
 	return nil, false
 }
 
+// picked is called with the pool locked when a request is routed to one of
+// its endpoints.
+func (p *Pool) picked(endpoint *Endpoint, now time.Time) {
+	if p.CircuitBreaker != nil {
+		p.CircuitBreaker.picked(endpoint, now)
+	}
+}
+
+func (p *Pool) endpointFailed(endpoint *Endpoint, timedOut bool, since time.Time) (time.Duration, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.contains(endpoint) {
+		return 0, false
+	}
+
+	now := time.Now()
+
+	if p.CircuitBreaker != nil {
+		p.CircuitBreaker.record(p, endpoint, true, timedOut, since, now)
+	}
+
+	if p.OutlierDetector == nil {
+		return 0, false
+	}
+
+	return p.OutlierDetector.failed(p, endpoint, now)
+}
+
+func (p *Pool) endpointSucceeded(endpoint *Endpoint, since time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.contains(endpoint) {
+		return
+	}
+
+	if p.CircuitBreaker != nil {
+		p.CircuitBreaker.record(p, endpoint, false, false, since, time.Now())
+	}
+
+	if p.OutlierDetector != nil {
+		p.OutlierDetector.succeeded(endpoint)
+	}
+}
+
+func (p *Pool) endpointSkipped(endpoint *Endpoint, since time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.contains(endpoint) {
+		return
+	}
+
+	if p.CircuitBreaker != nil {
+		p.CircuitBreaker.skipped(endpoint, since, time.Now())
+	}
+}
+
+func (p *Pool) circuitState(endpoint *Endpoint) CircuitState {
+	p.Lock()
+	defer p.Unlock()
+
+	return endpoint.circuit.state(time.Now())
+}
+
+func (p *Pool) contains(endpoint *Endpoint) bool {
+	i, ok := p.index[endpoint.CanonicalAddr()]
+	return ok && p.endpoints[i] == endpoint
+}
+
+// checkHealth reports whether unhealthy endpoints are kept out of selection.
+// When more than MaxUnhealthyPercent of the pool fails its health checks, the
+// checks are more likely to be wrong than the endpoints.
+func (p *Pool) checkHealth() bool {
+	unhealthy := 0
+	for _, endpoint := range p.endpoints {
+		if !endpoint.Healthy() {
+			unhealthy++
+		}
+	}
+
+	return unhealthy*100 <= len(p.endpoints)*p.MaxUnhealthyPercent
+}
+
+func (p *Pool) numEjected(now time.Time) int {
+	n := 0
+	for _, endpoint := range p.endpoints {
+		if endpoint.isEjected(now) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (p *Pool) numOpenCircuits() int {
+	n := 0
+	for _, endpoint := range p.endpoints {
+		if endpoint.circuit.open {
+			n++
+		}
+	}
+
+	return n
+}
+
 func (p *Pool) IsEmpty() bool {
+	p.Lock()
+	defer p.Unlock()
+
 	return len(p.endpoints) == 0
 }
 
 func (p *Pool) MarshalJSON() ([]byte, error) {
-	addresses := []string{}
+	return json.Marshal(p.Details())
+}
+
+// Details describes the pool's endpoints and their state.
+func (p *Pool) Details() []EndpointDetail {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
 
-	for addr, _ := range p.endpoints {
-		addresses = append(addresses, addr)
+	details := make([]EndpointDetail, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		details = append(details, e.detail(now))
 	}
 
-	return json.Marshal(addresses)
+	return details
 }
@@ -18,13 +18,13 @@ func (s *PSuite) TestPoolAddingAndRemoving(c *C) {
 
 	pool.Add(endpoint)
 
-	foundEndpoint, found := pool.Sample()
+	foundEndpoint, found := pool.Next()
 	c.Assert(found, Equals, true)
 	c.Assert(foundEndpoint, Equals, endpoint)
 
 	pool.Remove(endpoint)
 
-	_, found = pool.Sample()
+	_, found = pool.Next()
 	c.Assert(found, Equals, false)
 }
 
@@ -36,13 +36,13 @@ func (s *PSuite) TestPoolAddingDoesNotDuplicate(c *C) {
 	pool.Add(endpoint)
 	pool.Add(endpoint)
 
-	foundEndpoint, found := pool.Sample()
+	foundEndpoint, found := pool.Next()
 	c.Assert(found, Equals, true)
 	c.Assert(foundEndpoint, Equals, endpoint)
 
 	pool.Remove(endpoint)
 
-	_, found = pool.Sample()
+	_, found = pool.Next()
 	c.Assert(found, Equals, false)
 }
 
@@ -55,12 +55,12 @@ func (s *PSuite) TestPoolAddingEquivalentEndpointsDoesNotDuplicate(c *C) {
 	pool.Add(endpoint1)
 	pool.Add(endpoint2)
 
-	_, found := pool.Sample()
+	_, found := pool.Next()
 	c.Assert(found, Equals, true)
 
 	pool.Remove(endpoint1)
 
-	_, found = pool.Sample()
+	_, found = pool.Next()
 	c.Assert(found, Equals, false)
 }
 
@@ -104,7 +104,7 @@ func (s *PSuite) TestPoolFindByPrivateInstanceId(c *C) {
 }
 
 func (s *PSuite) TestPoolSamplingIsRandomish(c *C) {
-	pool := NewPool()
+	pool := NewPoolWithStrategy(NewRandomStrategy())
 
 	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
 	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
@@ -115,7 +115,7 @@ func (s *PSuite) TestPoolSamplingIsRandomish(c *C) {
 	var occurrences1, occurrences2 int
 
 	for i := 0; i < 200; i += 1 {
-		foundEndpoint, _ := pool.Sample()
+		foundEndpoint, _ := pool.Next()
 		if foundEndpoint == endpoint1 {
 			occurrences1 += 1
 		} else {
@@ -130,6 +130,51 @@ func (s *PSuite) TestPoolSamplingIsRandomish(c *C) {
 	c.Assert(math.Abs(float64(occurrences1-occurrences2)) < 50, Equals, true)
 }
 
+func (s *PSuite) TestPoolNextExcept(c *C) {
+	pool := NewPool()
+
+	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
+
+	pool.Add(endpoint1)
+	pool.Add(endpoint2)
+
+	for i := 0; i < 10; i++ {
+		foundEndpoint, found := pool.NextExcept(endpoint1)
+		c.Assert(found, Equals, true)
+		c.Assert(foundEndpoint, Equals, endpoint2)
+	}
+
+	_, found := pool.NextExcept(endpoint1, endpoint2)
+	c.Assert(found, Equals, false)
+}
+
+func (s *PSuite) TestPoolRemovingKeepsOtherEndpoints(c *C) {
+	pool := NewPool()
+
+	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
+	endpoint3 := &Endpoint{Host: "9.10.11.12", Port: 4321}
+
+	pool.Add(endpoint1)
+	pool.Add(endpoint2)
+	pool.Add(endpoint3)
+
+	pool.Remove(endpoint1)
+
+	for i := 0; i < 10; i++ {
+		foundEndpoint, found := pool.Next()
+		c.Assert(found, Equals, true)
+		c.Assert(foundEndpoint, Not(Equals), endpoint1)
+	}
+
+	pool.Remove(endpoint3)
+
+	foundEndpoint, found := pool.Next()
+	c.Assert(found, Equals, true)
+	c.Assert(foundEndpoint, Equals, endpoint2)
+}
+
 func (s *PSuite) TestPoolMarshalsAsJSON(c *C) {
 	pool := NewPool()
 
@@ -138,5 +183,79 @@ func (s *PSuite) TestPoolMarshalsAsJSON(c *C) {
 	json, err := pool.MarshalJSON()
 	c.Assert(err, IsNil)
 
-	c.Assert(string(json), Equals, `["1.2.3.4:5678"]`)
+	c.Assert(string(json), Equals, `[{"address":"1.2.3.4:5678","weight":1,"healthy":true,"circuit":"closed"}]`)
+}
+
+func (s *PSuite) TestPoolDetails(c *C) {
+	pool := NewPool()
+
+	unhealthy := &Endpoint{Host: "1.2.3.5", Port: 5678, Weight: 3}
+	unhealthy.SetHealthy(false)
+
+	pool.Add(&Endpoint{Host: "1.2.3.4", Port: 5678})
+	pool.Add(unhealthy)
+
+	c.Check(pool.Details(), DeepEquals, []EndpointDetail{
+		{Address: "1.2.3.4:5678", Weight: 1, Healthy: true, Circuit: "closed"},
+		{Address: "1.2.3.5:5678", Weight: 3, Healthy: false, Circuit: "closed"},
+	})
+}
+
+func (s *PSuite) TestPoolSkipsUnhealthyEndpoints(c *C) {
+	pool := NewPool()
+
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 5678, PrivateInstanceId: "id1"}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 1234, PrivateInstanceId: "id2"}
+	pool.Add(e1)
+	pool.Add(e2)
+
+	e1.SetHealthy(false)
+
+	for i := 0; i < 10; i++ {
+		e, ok := pool.Next()
+		c.Assert(ok, Equals, true)
+		c.Check(e, Equals, e2)
+	}
+
+	_, ok := pool.FindByPrivateInstanceId("id1")
+	c.Check(ok, Equals, false)
+
+	e1.SetHealthy(true)
+
+	_, ok = pool.FindByPrivateInstanceId("id1")
+	c.Check(ok, Equals, true)
+}
+
+func (s *PSuite) TestPoolIgnoresHealthAboveMaxUnhealthyPercent(c *C) {
+	pool := NewPool()
+	pool.MaxUnhealthyPercent = 50
+
+	e1 := &Endpoint{Host: "1.2.3.4", Port: 5678, PrivateInstanceId: "id1"}
+	e2 := &Endpoint{Host: "5.6.7.8", Port: 1234, PrivateInstanceId: "id2"}
+	pool.Add(e1)
+	pool.Add(e2)
+
+	e1.SetHealthy(false)
+
+	for i := 0; i < 10; i++ {
+		e, ok := pool.Next()
+		c.Assert(ok, Equals, true)
+		c.Check(e, Equals, e2)
+	}
+
+	// With every endpoint unhealthy, the health checks are ignored
+	e2.SetHealthy(false)
+
+	counts := make(map[*Endpoint]int)
+	for i := 0; i < 10; i++ {
+		e, ok := pool.Next()
+		c.Assert(ok, Equals, true)
+		counts[e]++
+	}
+
+	c.Check(counts[e1], Equals, 5)
+	c.Check(counts[e2], Equals, 5)
+
+	_, ok := pool.FindByPrivateInstanceId("id1")
+	c.Check(ok, Equals, true)
 }
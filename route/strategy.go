@@ -0,0 +1,142 @@
+package route
+
+import (
+	"math/rand"
+)
+
+const (
+	RandomStrategy           = "random"
+	RoundRobinStrategy       = "round-robin"
+	LeastConnectionsStrategy = "least-connections"
+)
+
+// A Strategy picks the endpoint of a pool that the next request is routed
+// to, in proportion to the endpoints' weights. Strategies are not safe for
+// concurrent use; the pool serializes calls.
+type Strategy interface {
+	// Next returns one of the endpoints for which eligible returns true.
+	Next(endpoints []*Endpoint, eligible func(*Endpoint) bool) (*Endpoint, bool)
+}
+
+var Strategies = map[string]func() Strategy{
+	RandomStrategy:           NewRandomStrategy,
+	RoundRobinStrategy:       NewRoundRobinStrategy,
+	LeastConnectionsStrategy: NewLeastConnectionsStrategy,
+}
+
+type randomStrategy struct{}
+
+func NewRandomStrategy() Strategy {
+	return randomStrategy{}
+}
+
+func (s randomStrategy) Next(endpoints []*Endpoint, eligible func(*Endpoint) bool) (*Endpoint, bool) {
+	total := 0
+	for _, endpoint := range endpoints {
+		if eligible(endpoint) {
+			total += endpoint.normalizedWeight()
+		}
+	}
+
+	if total == 0 {
+		return nil, false
+	}
+
+	n := rand.Intn(total)
+
+	for _, endpoint := range endpoints {
+		if !eligible(endpoint) {
+			continue
+		}
+
+		n -= endpoint.normalizedWeight()
+		if n < 0 {
+			return endpoint, true
+		}
+	}
+
+	panic("unreachable")
+}
+
+// roundRobinStrategy implements smooth weighted round-robin: on every pick
+// each endpoint earns its weight, the endpoint with the most credit is chosen
+// and pays back the total. Endpoints of equal weight are picked in turn.
+type roundRobinStrategy struct {
+	credit map[*Endpoint]int
+}
+
+func NewRoundRobinStrategy() Strategy {
+	return &roundRobinStrategy{
+		credit: make(map[*Endpoint]int),
+	}
+}
+
+func (s *roundRobinStrategy) Next(endpoints []*Endpoint, eligible func(*Endpoint) bool) (*Endpoint, bool) {
+	var best *Endpoint
+	total := 0
+
+	for _, endpoint := range endpoints {
+		if !eligible(endpoint) {
+			continue
+		}
+
+		weight := endpoint.normalizedWeight()
+		s.credit[endpoint] += weight
+		total += weight
+
+		if best == nil || s.credit[endpoint] > s.credit[best] {
+			best = endpoint
+		}
+	}
+
+	if best == nil {
+		return nil, false
+	}
+
+	s.credit[best] -= total
+
+	// Forget endpoints that have left the pool
+	if len(s.credit) > len(endpoints) {
+		credit := make(map[*Endpoint]int, len(endpoints))
+		for _, endpoint := range endpoints {
+			if c, ok := s.credit[endpoint]; ok {
+				credit[endpoint] = c
+			}
+		}
+
+		s.credit = credit
+	}
+
+	return best, true
+}
+
+type leastConnectionsStrategy struct {
+	// Where to start scanning, rotated so that ties are spread evenly
+	start int
+}
+
+func NewLeastConnectionsStrategy() Strategy {
+	return &leastConnectionsStrategy{}
+}
+
+func (s *leastConnectionsStrategy) Next(endpoints []*Endpoint, eligible func(*Endpoint) bool) (*Endpoint, bool) {
+	var best *Endpoint
+
+	for i := 0; i < len(endpoints); i++ {
+		endpoint := endpoints[(s.start+i)%len(endpoints)]
+		if !eligible(endpoint) {
+			continue
+		}
+
+		// Compare in-flight requests per unit of weight
+		if best == nil || int(endpoint.InFlight())*best.normalizedWeight() < int(best.InFlight())*endpoint.normalizedWeight() {
+			best = endpoint
+		}
+	}
+
+	if len(endpoints) > 0 {
+		s.start = (s.start + 1) % len(endpoints)
+	}
+
+	return best, best != nil
+}
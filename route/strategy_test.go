@@ -0,0 +1,164 @@
+package route
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type StrategySuite struct{}
+
+func init() {
+	Suite(&StrategySuite{})
+}
+
+var allEligible = func(*Endpoint) bool { return true }
+
+func (s *StrategySuite) TestRoundRobinCyclesThroughEndpoints(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234},
+		&Endpoint{Host: "5.6.7.8", Port: 5678},
+		&Endpoint{Host: "9.10.11.12", Port: 9101},
+	}
+
+	strategy := NewRoundRobinStrategy()
+
+	for i := 0; i < 6; i++ {
+		endpoint, found := strategy.Next(endpoints, allEligible)
+		c.Assert(found, Equals, true)
+		c.Check(endpoint, Equals, endpoints[i%3])
+	}
+}
+
+func (s *StrategySuite) TestRoundRobinSkipsIneligibleEndpoints(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234},
+		&Endpoint{Host: "5.6.7.8", Port: 5678},
+		&Endpoint{Host: "9.10.11.12", Port: 9101},
+	}
+
+	strategy := NewRoundRobinStrategy()
+	eligible := func(e *Endpoint) bool { return e != endpoints[1] }
+
+	for i := 0; i < 4; i++ {
+		endpoint, found := strategy.Next(endpoints, eligible)
+		c.Assert(found, Equals, true)
+		c.Check(endpoint, Equals, endpoints[(i%2)*2])
+	}
+
+	_, found := strategy.Next(endpoints, func(*Endpoint) bool { return false })
+	c.Check(found, Equals, false)
+}
+
+func (s *StrategySuite) TestLeastConnectionsPrefersIdleEndpoints(c *C) {
+	busy := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	idle := &Endpoint{Host: "5.6.7.8", Port: 5678}
+	endpoints := []*Endpoint{busy, idle}
+
+	busy.RequestStarted()
+	busy.RequestStarted()
+
+	strategy := NewLeastConnectionsStrategy()
+
+	for i := 0; i < 4; i++ {
+		endpoint, found := strategy.Next(endpoints, allEligible)
+		c.Assert(found, Equals, true)
+		c.Check(endpoint, Equals, idle)
+	}
+
+	busy.RequestFinished()
+	busy.RequestFinished()
+	idle.RequestStarted()
+
+	endpoint, _ := strategy.Next(endpoints, allEligible)
+	c.Check(endpoint, Equals, busy)
+}
+
+func (s *StrategySuite) TestLeastConnectionsSpreadsTies(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234},
+		&Endpoint{Host: "5.6.7.8", Port: 5678},
+	}
+
+	strategy := NewLeastConnectionsStrategy()
+
+	first, _ := strategy.Next(endpoints, allEligible)
+	second, _ := strategy.Next(endpoints, allEligible)
+	c.Check(first, Not(Equals), second)
+}
+
+func (s *StrategySuite) TestRandomHonorsEligibility(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234},
+		&Endpoint{Host: "5.6.7.8", Port: 5678},
+	}
+
+	strategy := NewRandomStrategy()
+	eligible := func(e *Endpoint) bool { return e == endpoints[1] }
+
+	for i := 0; i < 10; i++ {
+		endpoint, found := strategy.Next(endpoints, eligible)
+		c.Assert(found, Equals, true)
+		c.Check(endpoint, Equals, endpoints[1])
+	}
+
+	_, found := strategy.Next([]*Endpoint{}, allEligible)
+	c.Check(found, Equals, false)
+}
+
+func countPicks(strategy Strategy, endpoints []*Endpoint, n int) map[*Endpoint]int {
+	picks := make(map[*Endpoint]int)
+
+	for i := 0; i < n; i++ {
+		endpoint, _ := strategy.Next(endpoints, allEligible)
+		picks[endpoint]++
+	}
+
+	return picks
+}
+
+func (s *StrategySuite) TestRoundRobinHonorsWeights(c *C) {
+	light := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	heavy := &Endpoint{Host: "5.6.7.8", Port: 5678, Weight: 3}
+	endpoints := []*Endpoint{light, heavy}
+
+	picks := countPicks(NewRoundRobinStrategy(), endpoints, 8)
+	c.Check(picks[light], Equals, 2)
+	c.Check(picks[heavy], Equals, 6)
+}
+
+func (s *StrategySuite) TestRoundRobinInterleavesWeightedPicks(c *C) {
+	light := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	heavy := &Endpoint{Host: "5.6.7.8", Port: 5678, Weight: 2}
+	endpoints := []*Endpoint{light, heavy}
+
+	strategy := NewRoundRobinStrategy()
+
+	expected := []*Endpoint{heavy, light, heavy, heavy, light, heavy}
+	for _, e := range expected {
+		endpoint, _ := strategy.Next(endpoints, allEligible)
+		c.Check(endpoint, Equals, e)
+	}
+}
+
+func (s *StrategySuite) TestRandomHonorsWeights(c *C) {
+	light := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	heavy := &Endpoint{Host: "5.6.7.8", Port: 5678, Weight: 4}
+	endpoints := []*Endpoint{light, heavy}
+
+	picks := countPicks(NewRandomStrategy(), endpoints, 1000)
+	c.Check(picks[light] > 100, Equals, true)
+	c.Check(picks[light] < 300, Equals, true)
+}
+
+func (s *StrategySuite) TestLeastConnectionsHonorsWeights(c *C) {
+	light := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	heavy := &Endpoint{Host: "5.6.7.8", Port: 5678, Weight: 4}
+	endpoints := []*Endpoint{light, heavy}
+
+	light.RequestStarted()
+	heavy.RequestStarted()
+	heavy.RequestStarted()
+	heavy.RequestStarted()
+
+	endpoint, _ := NewLeastConnectionsStrategy().Next(endpoints, allEligible)
+	c.Check(endpoint, Equals, heavy)
+}
@@ -4,8 +4,48 @@ import (
 	"strings"
 )
 
+// A Uri is a host name, optionally followed by a path prefix such as
+// "example.com/api". The host name may start with a "*." wildcard label that
+// matches any subdomain, as in "*.apps.example.com".
 type Uri string
 
 func (u Uri) ToLower() Uri {
 	return Uri(strings.ToLower(string(u)))
 }
+
+// RouteKey returns the form under which routes are registered and looked up:
+// lower-cased and without trailing slashes.
+func (u Uri) RouteKey() Uri {
+	return Uri(strings.TrimRight(string(u.ToLower()), "/"))
+}
+
+// Parent returns the route key of the URI without its last path segment,
+// which requests fall back to when no route matches the URI itself. A URI
+// without a path has no parent.
+func (u Uri) Parent() (Uri, bool) {
+	i := strings.LastIndex(string(u), "/")
+	if i < 0 {
+		return "", false
+	}
+
+	return u[:i].RouteKey(), true
+}
+
+// NextWildcard returns the route key of the next wildcard route that may
+// serve the URI when nothing more specific does: "*.b.c" for both "a.b.c"
+// and "*.a.b.c", keeping the path.
+func (u Uri) NextWildcard() (Uri, bool) {
+	host, path := string(u), ""
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, path = host[:i], host[i:]
+	}
+
+	host = strings.TrimPrefix(host, "*.")
+
+	i := strings.Index(host, ".")
+	if i < 0 {
+		return "", false
+	}
+
+	return Uri("*" + host[i:] + path), true
+}
@@ -0,0 +1,54 @@
+package route
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type UriSuite struct{}
+
+var _ = Suite(&UriSuite{})
+
+func (s *UriSuite) TestRouteKey(c *C) {
+	c.Check(Uri("Example.com").RouteKey(), Equals, Uri("example.com"))
+	c.Check(Uri("example.com/").RouteKey(), Equals, Uri("example.com"))
+	c.Check(Uri("example.com/API/").RouteKey(), Equals, Uri("example.com/api"))
+}
+
+func (s *UriSuite) TestParent(c *C) {
+	parent, ok := Uri("example.com/api/v1").Parent()
+	c.Check(ok, Equals, true)
+	c.Check(parent, Equals, Uri("example.com/api"))
+
+	parent, ok = parent.Parent()
+	c.Check(ok, Equals, true)
+	c.Check(parent, Equals, Uri("example.com"))
+
+	_, ok = parent.Parent()
+	c.Check(ok, Equals, false)
+}
+
+func (s *UriSuite) TestParentSkipsEmptySegments(c *C) {
+	parent, ok := Uri("example.com//api").Parent()
+	c.Check(ok, Equals, true)
+	c.Check(parent, Equals, Uri("example.com"))
+}
+
+func (s *UriSuite) TestNextWildcard(c *C) {
+	next, ok := Uri("a.b.example.com/api").NextWildcard()
+	c.Check(ok, Equals, true)
+	c.Check(next, Equals, Uri("*.b.example.com/api"))
+
+	next, ok = next.NextWildcard()
+	c.Check(ok, Equals, true)
+	c.Check(next, Equals, Uri("*.example.com/api"))
+
+	next, ok = next.NextWildcard()
+	c.Check(ok, Equals, true)
+	c.Check(next, Equals, Uri("*.com/api"))
+
+	_, ok = next.NextWildcard()
+	c.Check(ok, Equals, false)
+
+	_, ok = Uri("localhost").NextWildcard()
+	c.Check(ok, Equals, false)
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+
+	"github.com/cloudfoundry/gorouter/config"
+)
+
+// certificateStore selects the certificate for a TLS handshake by the server
+// name the client asked for, falling back to the default certificate.
+type certificateStore struct {
+	defaultCertificate *tls.Certificate
+	byName             map[string]*tls.Certificate
+}
+
+func newCertificateStore(c config.TLSConfig) (*certificateStore, error) {
+	defaultCertificate, err := tls.LoadX509KeyPair(c.DefaultCertificate.CertFile, c.DefaultCertificate.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &certificateStore{
+		defaultCertificate: &defaultCertificate,
+		byName:             make(map[string]*tls.Certificate),
+	}
+
+	for _, certificateConfig := range c.Certificates {
+		certificate, err := tls.LoadX509KeyPair(certificateConfig.CertFile, certificateConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+
+		// The first certificate configured for a name wins
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := s.byName[name]; !ok {
+				s.byName[name] = &certificate
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if certificate, ok := s.byName[name]; ok {
+		return certificate, nil
+	}
+
+	// Wildcard certificates only cover a single label
+	if i := strings.Index(name, "."); i >= 0 {
+		if certificate, ok := s.byName["*"+name[i:]]; ok {
+			return certificate, nil
+		}
+	}
+
+	return s.defaultCertificate, nil
+}
+
+func (s *certificateStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+	}
+}
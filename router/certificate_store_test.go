@@ -0,0 +1,85 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/test_util"
+)
+
+type CertificateStoreSuite struct {
+	dir string
+}
+
+var _ = Suite(&CertificateStoreSuite{})
+
+func (s *CertificateStoreSuite) SetUpTest(c *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("", "certificates")
+	c.Assert(err, IsNil)
+}
+
+func (s *CertificateStoreSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir)
+}
+
+func (s *CertificateStoreSuite) writeCertificate(c *C, name string, names ...string) config.TLSCertificateConfig {
+	certPEM, keyPEM := test_util.CreateCertificate(names...)
+
+	certificateConfig := config.TLSCertificateConfig{
+		CertFile: filepath.Join(s.dir, name+".crt"),
+		KeyFile:  filepath.Join(s.dir, name+".key"),
+	}
+
+	c.Assert(ioutil.WriteFile(certificateConfig.CertFile, certPEM, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(certificateConfig.KeyFile, keyPEM, 0600), IsNil)
+
+	return certificateConfig
+}
+
+func (s *CertificateStoreSuite) commonName(c *C, certificate *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	c.Assert(err, IsNil)
+
+	return leaf.Subject.CommonName
+}
+
+func (s *CertificateStoreSuite) TestSelectsCertificateByServerName(c *C) {
+	store, err := newCertificateStore(config.TLSConfig{
+		DefaultCertificate: s.writeCertificate(c, "default", "default.example.com"),
+		Certificates: []config.TLSCertificateConfig{
+			s.writeCertificate(c, "foo", "foo.example.com", "www.foo.example.com"),
+			s.writeCertificate(c, "wildcard", "*.apps.example.com"),
+		},
+	})
+	c.Assert(err, IsNil)
+
+	for serverName, expected := range map[string]string{
+		"foo.example.com":        "foo.example.com",
+		"WWW.foo.example.com.":   "foo.example.com",
+		"app.apps.example.com":   "*.apps.example.com",
+		"a.app.apps.example.com": "default.example.com",
+		"bar.example.com":        "default.example.com",
+		"":                       "default.example.com",
+	} {
+		certificate, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		c.Assert(err, IsNil)
+		c.Check(s.commonName(c, certificate), Equals, expected, Commentf("server name: %s", serverName))
+	}
+}
+
+func (s *CertificateStoreSuite) TestMissingCertificateFile(c *C) {
+	_, err := newCertificateStore(config.TLSConfig{
+		DefaultCertificate: config.TLSCertificateConfig{
+			CertFile: filepath.Join(s.dir, "missing.crt"),
+			KeyFile:  filepath.Join(s.dir, "missing.key"),
+		},
+	})
+	c.Check(err, NotNil)
+}
@@ -47,6 +47,8 @@ func SpecConfig(natsPort, statusPort, proxyPort uint16) *config.Config {
 
 	c.EndpointTimeout = 500 * time.Millisecond
 
+	c.StickySessions.Secret = "sticky-secret"
+
 	c.Status = config.StatusConfig{
 		Port: statusPort,
 		User: "user",
@@ -11,7 +11,14 @@ type registryMessage struct {
 	Tags map[string]string `json:"tags"`
 	App  string            `json:"app"`
 
+	Weight int `json:"weight"`
+
+	TLS        bool   `json:"tls"`
+	ServerName string `json:"server_name"`
+
 	PrivateInstanceId string `json:"private_instance_id"`
+
+	RouteServiceUrl string `json:"route_service_url"`
 }
 
 func (registryMessage *registryMessage) makeEndpoint() *route.Endpoint {
@@ -21,5 +28,9 @@ func (registryMessage *registryMessage) makeEndpoint() *route.Endpoint {
 		ApplicationId:     registryMessage.App,
 		Tags:              registryMessage.Tags,
 		PrivateInstanceId: registryMessage.PrivateInstanceId,
+		Weight:            registryMessage.Weight,
+		TLS:               registryMessage.TLS,
+		ServerName:        registryMessage.ServerName,
+		RouteServiceUrl:   registryMessage.RouteServiceUrl,
 	}
 }
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"encoding/json"
+
+	. "launchpad.net/gocheck"
+)
+
+type RegistryMessageSuite struct{}
+
+var _ = Suite(&RegistryMessageSuite{})
+
+func (s *RegistryMessageSuite) TestMakeEndpointWithWeight(c *C) {
+	var msg registryMessage
+
+	err := json.Unmarshal([]byte(`{"host":"1.2.3.4","port":1234,"uris":["test.com"],"app":"app1","weight":3}`), &msg)
+	c.Assert(err, IsNil)
+
+	endpoint := msg.makeEndpoint()
+	c.Check(endpoint.CanonicalAddr(), Equals, "1.2.3.4:1234")
+	c.Check(endpoint.ApplicationId, Equals, "app1")
+	c.Check(endpoint.Weight, Equals, 3)
+}
+
+func (s *RegistryMessageSuite) TestMakeEndpointWithoutWeight(c *C) {
+	var msg registryMessage
+
+	err := json.Unmarshal([]byte(`{"host":"1.2.3.4","port":1234,"uris":["test.com"]}`), &msg)
+	c.Assert(err, IsNil)
+
+	c.Check(msg.makeEndpoint().Weight, Equals, 0)
+}
+
+func (s *RegistryMessageSuite) TestMakeEndpointWithTLS(c *C) {
+	var msg registryMessage
+
+	err := json.Unmarshal([]byte(`{"host":"1.2.3.4","port":1234,"uris":["test.com"],"tls":true,"server_name":"app.internal"}`), &msg)
+	c.Assert(err, IsNil)
+
+	endpoint := msg.makeEndpoint()
+	c.Check(endpoint.TLS, Equals, true)
+	c.Check(endpoint.TLSServerName(), Equals, "app.internal")
+}
+
+func (s *RegistryMessageSuite) TestMakeEndpointWithRouteService(c *C) {
+	var msg registryMessage
+
+	err := json.Unmarshal([]byte(`{"host":"1.2.3.4","port":1234,"uris":["test.com"],"route_service_url":"https://auth.example.com/check"}`), &msg)
+	c.Assert(err, IsNil)
+
+	c.Check(msg.makeEndpoint().RouteServiceUrl, Equals, "https://auth.example.com/check")
+}
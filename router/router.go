@@ -3,18 +3,25 @@ package router
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	vcap "github.com/cloudfoundry/gorouter/common"
 	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/healthcheck"
 	"github.com/cloudfoundry/gorouter/log"
 	"github.com/cloudfoundry/gorouter/proxy"
 	"github.com/cloudfoundry/gorouter/registry"
 	"github.com/cloudfoundry/gorouter/server"
+	"github.com/cloudfoundry/gorouter/tracing"
 	"github.com/cloudfoundry/gorouter/util"
 	"github.com/cloudfoundry/gorouter/varz"
 	"github.com/cloudfoundry/yagnats"
@@ -29,11 +36,23 @@ type Router struct {
 	registry   *registry.CFRegistry
 	varz       varz.Varz
 	component  *vcap.VcapComponent
+	server     *server.Server
+
+	listening int32 // accessed atomically
+
+	stopOnce sync.Once
+	stopped  chan bool
 }
 
 func NewRouter(c *config.Config) *Router {
+	// Clients are pinned with cookies that every router must be able to read
+	if c.StickySessions.Secret == "" {
+		log.Fatal("sticky_sessions: a secret shared by all routers is required")
+	}
+
 	router := &Router{
-		config: c,
+		config:  c,
+		stopped: make(chan bool),
 	}
 
 	// setup number of procs
@@ -46,16 +65,57 @@ func NewRouter(c *config.Config) *Router {
 	router.registry = registry.NewCFRegistry(router.config, router.mbusClient)
 	router.registry.StartPruningCycle()
 
+	healthcheck.NewHealthChecker(router.config, router.registry).Start()
+
 	router.varz = varz.NewVarz(router.registry)
 	args := proxy.ProxyArgs{
-		EndpointTimeout: router.config.EndpointTimeout,
-		Ip:              router.config.Ip,
-		TraceKey:        router.config.TraceKey,
-		Registry:        router.registry,
-		Reporter:        router.varz,
-		Logger:          access_log.CreateRunningAccessLogger(router.config),
+		EndpointTimeout:         router.config.EndpointTimeout,
+		EndpointIdleTimeout:     router.config.EndpointIdleTimeout,
+		MaxIdleConnsPerEndpoint: router.config.MaxIdleConnsPerEndpoint,
+		MaxRetries:              router.config.MaxRetries,
+		BackendRootCAs:          router.config.BackendRootCAs,
+		Ip:                      router.config.Ip,
+		TraceKey:                router.config.TraceKey,
+		RouteRateLimit:          rateLimit(router.config.RateLimit.Route),
+		AppRateLimit:            rateLimit(router.config.RateLimit.App),
+		ClientIpRateLimit:       rateLimit(router.config.RateLimit.ClientIp),
+		MaxRequestBodySize:      router.config.MaxRequestBodySize,
+		Compression:             compression(router.config.Gzip),
+		ResponseCaching:         responseCaching(router.config.ResponseCache),
+		ErrorTemplates:          router.config.ErrorTemplates,
+		RouteServices:           routeServices(router.config.RouteServices),
+		HeaderRewrites:          headerRewrites(router.config.HeaderRewrites),
+		TrustedProxies:          router.config.TrustedProxies,
+		RequestIdHeader:         router.config.RequestIdHeader,
+		StickySessions:          stickySessions(router.config.StickySessions),
+		SpanExporter:            spanExporter(router.config),
+		TraceSampleRate:         router.config.Tracing.SampleRate,
+		Registry:                router.registry,
+		Reporter:                router.varz,
+		Logger:                  access_log.CreateRunningAccessLogger(router.config),
 	}
 	router.proxy = proxy.NewProxy(args)
+	router.registry.OnEndpointRemoved(router.proxy.CloseIdleConnections)
+
+	var proxyProtocol *server.ProxyProtocol
+	if router.config.ProxyProtocol.Enabled {
+		proxyProtocol = &server.ProxyProtocol{
+			Required:    router.config.ProxyProtocol.Required,
+			TrustedNets: router.config.ProxyProtocol.TrustedNets,
+		}
+	}
+
+	router.server = &server.Server{
+		Handler:                 router.proxy,
+		ReadHeaderTimeout:       router.config.RequestHeaderTimeout,
+		ReadTimeout:             router.config.RequestTimeout,
+		IdleTimeout:             router.config.IdleTimeout,
+		MaxHeaderBytes:          router.config.MaxHeaderBytes,
+		RequestRejectedCallback: router.varz.CaptureRejectedRequest,
+		TLSHandshakeCallback:    router.captureTLSHandshake,
+		ProxyProtocol:           proxyProtocol,
+		H2C:                     router.config.H2C,
+	}
 
 	var host string
 	if router.config.Status.Port != 0 {
@@ -82,6 +142,9 @@ func NewRouter(c *config.Config) *Router {
 		InfoRoutes: map[string]json.Marshaler{
 			"/routes": router.registry,
 		},
+		AdminRoutes: map[string]http.Handler{
+			"/drain": http.HandlerFunc(router.handleDrain),
+		},
 	}
 
 	vcap.StartComponent(router.component)
@@ -146,18 +209,110 @@ func (r *Router) Run() {
 		log.Fatalf("net.Listen: %s", err)
 	}
 
+	var listenTLS net.Listener
+	var tlsConfig *tls.Config
+	if r.config.TLS.Port != 0 {
+		certificates, err := newCertificateStore(r.config.TLS)
+		if err != nil {
+			log.Fatalf("Loading TLS certificates: %s", err)
+		}
+
+		tlsConfig = certificates.tlsConfig()
+		if r.config.TLS.HTTP2 {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+
+		// TLS is served on top of the listener so that the PROXY protocol
+		// header can be read ahead of the handshake
+		listenTLS, err = net.Listen("tcp", fmt.Sprintf(":%d", r.config.TLS.Port))
+		if err != nil {
+			log.Fatalf("net.Listen: %s", err)
+		}
+	}
+
 	util.WritePidFile(r.config.Pidfile)
 
 	log.Infof("Listening on %s", listen.Addr())
 
-	server := server.Server{Handler: r.proxy}
+	atomic.StoreInt32(&r.listening, 1)
 
 	go func() {
-		err := server.Serve(listen)
-		if err != nil {
+		err := r.server.Serve(listen)
+		if err != nil && err != server.ErrServerClosed {
 			log.Fatalf("proxy.Serve: %s", err)
 		}
 	}()
+
+	if listenTLS != nil {
+		log.Infof("Listening for TLS on %s", listenTLS.Addr())
+
+		go func() {
+			err := r.server.ServeTLS(listenTLS, tlsConfig)
+			if err != nil && err != server.ErrServerClosed {
+				log.Fatalf("proxy.Serve: %s", err)
+			}
+		}()
+	}
+}
+
+// Drain makes the router report itself unhealthy to load balancers, waits
+// for them to notice, then stops it.
+func (r *Router) Drain() {
+	r.stop(true)
+}
+
+// Stop stops accepting connections and waits for the requests in flight,
+// including WebSocket and TCP sessions, to finish, up to the drain timeout.
+func (r *Router) Stop() {
+	r.stop(false)
+}
+
+// Stopped is closed once the router has stopped.
+func (r *Router) Stopped() <-chan bool {
+	return r.stopped
+}
+
+func (r *Router) stop(drain bool) {
+	r.stopOnce.Do(func() {
+		// There is nothing to drain before the router listens, and once
+		// stopped it never does
+		if drain && atomic.LoadInt32(&r.listening) == 1 {
+			log.Infof("Draining, waiting %s for load balancers to notice", r.config.DrainWait)
+
+			r.proxy.Drain()
+			r.component.Healthz.Drain()
+
+			time.Sleep(r.config.DrainWait)
+		}
+
+		log.Infof("Stopping, waiting up to %s for requests in flight", r.config.DrainTimeout)
+
+		if !r.server.Shutdown(r.config.DrainTimeout) {
+			log.Warnf("Stopped with requests still in flight")
+		}
+
+		close(r.stopped)
+	})
+}
+
+func (r *Router) handleDrain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	go r.Drain()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (r *Router) captureTLSHandshake(state tls.ConnectionState, err error) {
+	if err != nil {
+		log.Debugf("TLS handshake failed: %s", err)
+	}
+
+	r.varz.CaptureTLSHandshake(state, err)
 }
 
 func (r *Router) RegisterComponent() {
@@ -286,3 +441,94 @@ func (r *Router) subscribeRegistry(subject string, successCallback func(*registr
 		log.Errorf("Error subscribing to %s: %s", subject, err)
 	}
 }
+
+func rateLimit(c config.RateLimitConfig) proxy.RateLimit {
+	return proxy.RateLimit{
+		RequestsPerSecond: c.RequestsPerSecond,
+		Burst:             c.Burst,
+	}
+}
+
+func compression(c config.GzipConfig) proxy.Compression {
+	if !c.Enabled {
+		return proxy.Compression{}
+	}
+
+	return proxy.Compression{
+		ContentTypes: c.ContentTypes,
+		MinSize:      int64(c.MinSize),
+		Level:        c.Level,
+	}
+}
+
+func responseCaching(c config.ResponseCacheConfig) proxy.ResponseCaching {
+	if !c.Enabled {
+		return proxy.ResponseCaching{}
+	}
+
+	return proxy.ResponseCaching{
+		MaxSize:      c.MaxSize,
+		MaxEntrySize: c.MaxEntrySize,
+		OptIn:        c.OptIn,
+	}
+}
+
+func routeServices(c config.RouteServicesConfig) proxy.RouteServices {
+	if c.Secret == "" {
+		return proxy.RouteServices{}
+	}
+
+	return proxy.RouteServices{
+		Key:         []byte(c.Secret),
+		PreviousKey: []byte(c.PreviousSecret),
+		Timeout:     c.Timeout,
+	}
+}
+
+func stickySessions(c config.StickySessionsConfig) proxy.StickySessions {
+	s := proxy.StickySessions{CookieNames: c.CookieNames}
+
+	if c.Secret != "" {
+		s.Key = []byte(c.Secret)
+	}
+	if c.PreviousSecret != "" {
+		s.PreviousKey = []byte(c.PreviousSecret)
+	}
+
+	return s
+}
+
+func headerRewrites(c map[string]config.HeaderRewriteConfig) proxy.HeaderRewrites {
+	if len(c) == 0 {
+		return nil
+	}
+
+	rewrites := make(proxy.HeaderRewrites, len(c))
+	for host, rewrite := range c {
+		rewrites[strings.ToLower(host)] = proxy.HeaderRewrite{
+			Request:  headerRules(rewrite.Request),
+			Response: headerRules(rewrite.Response),
+		}
+	}
+
+	return rewrites
+}
+
+func headerRules(c config.HeaderRulesConfig) proxy.HeaderRules {
+	return proxy.HeaderRules{
+		Remove: c.Remove,
+		Set:    c.Set,
+		Add:    c.Add,
+	}
+}
+
+func spanExporter(c *config.Config) proxy.SpanExporter {
+	if c.Tracing.ZipkinUrl == "" {
+		return nil
+	}
+
+	exporter := tracing.NewZipkinExporter(c)
+	exporter.Start()
+
+	return exporter
+}
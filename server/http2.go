@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// The connection preface every HTTP/2 client starts with (RFC 7540, section
+// 3.5). The request line alone is enough to tell it apart from HTTP/1.x.
+var (
+	http2PrefaceRequestLine = []byte("PRI * HTTP/2.0")
+	http2Preface            = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+)
+
+var errListenerClosed = errors.New("http2: listener closed")
+
+// http2Listener feeds the connections Server hands over to the HTTP/2
+// implementation in net/http.
+type http2Listener struct {
+	addr  net.Addr
+	conns chan net.Conn
+}
+
+func (l *http2Listener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, errListenerClosed
+	}
+
+	return c, nil
+}
+
+func (l *http2Listener) Close() error {
+	return nil
+}
+
+func (l *http2Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// bufferedConn replays what was already read into the buffer before reading
+// from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serveHTTP2 hands the connection over to net/http, which serves HTTP/2 on it
+// with the same handler. TLS connections must have completed their handshake.
+func (srv *Server) serveHTTP2(rwc net.Conn) {
+	srv.http2Once.Do(func() {
+		srv.http2Listener = &http2Listener{
+			addr:  rwc.LocalAddr(),
+			conns: make(chan net.Conn),
+		}
+
+		var protocols http.Protocols
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+
+		s := &http.Server{
+			Handler:           http.HandlerFunc(srv.serveRequest),
+			Protocols:         &protocols,
+			ReadHeaderTimeout: srv.ReadHeaderTimeout,
+			ReadTimeout:       srv.ReadTimeout,
+			IdleTimeout:       srv.IdleTimeout,
+			MaxHeaderBytes:    srv.MaxHeaderBytes,
+		}
+
+		srv.mu.Lock()
+		srv.http2Server = s
+		srv.mu.Unlock()
+
+		go s.Serve(srv.http2Listener)
+	})
+
+	srv.mu.Lock()
+	done := srv.initDone()
+	srv.mu.Unlock()
+
+	select {
+	case srv.http2Listener.conns <- rwc:
+	case <-done:
+		rwc.Close()
+	}
+}
+
+// isHTTP2Preface reports whether the client opened the connection with the
+// HTTP/2 connection preface, without consuming any of it.
+func isHTTP2Preface(r *bufio.Reader) bool {
+	// Every HTTP/1.x request line is at least as long as the preface's, so
+	// this never waits for bytes an HTTP/1.x client won't send
+	b, err := r.Peek(len(http2PrefaceRequestLine))
+	if err != nil || !bytes.Equal(b, http2PrefaceRequestLine) {
+		return false
+	}
+
+	b, err = r.Peek(len(http2Preface))
+	return err == nil && bytes.Equal(b, http2Preface)
+}
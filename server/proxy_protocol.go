@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocol configures reading the PROXY protocol header (versions 1 and
+// 2) that load balancers send ahead of the client's data to pass on the
+// client's address.
+type ProxyProtocol struct {
+	// Connections without a header are rejected
+	Required bool
+
+	// The header is only accepted from these networks, and so from nowhere if
+	// there are none
+	TrustedNets []*net.IPNet
+}
+
+// How long a client has to send the header
+const proxyHeaderTimeout = 5 * time.Second
+
+// The longest version 1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var (
+	errNoProxyHeader        = errors.New("proxy protocol: no header")
+	errUntrustedProxyHeader = errors.New("proxy protocol: header required from untrusted address")
+	errInvalidProxyHeader   = errors.New("proxy protocol: invalid header")
+)
+
+// proxyProtocolConn is a connection whose remote address is the one passed
+// on in the PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (p *ProxyProtocol) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range p.TrustedNets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accept reads the header from rwc if its peer is trusted, and returns the
+// connection to read the client's data from.
+func (p *ProxyProtocol) accept(rwc net.Conn) (net.Conn, error) {
+	if !p.trusts(rwc.RemoteAddr()) {
+		if p.Required {
+			return nil, errUntrustedProxyHeader
+		}
+		return rwc, nil
+	}
+
+	r := bufio.NewReader(rwc)
+
+	rwc.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	addr, err := readProxyHeader(r)
+	rwc.SetReadDeadline(time.Time{})
+
+	if err == errNoProxyHeader && !p.Required {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr == nil {
+		addr = rwc.RemoteAddr()
+	}
+
+	return &proxyProtocolConn{Conn: rwc, r: r, remoteAddr: addr}, nil
+}
+
+// readProxyHeader consumes the header and returns the source address it
+// carries, which is nil for connections the load balancer opened itself or
+// whose address it could not tell.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// The shortest header of either version is longer than the signature
+	b, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, errNoProxyHeader
+	}
+
+	switch {
+	case bytes.Equal(b, proxyV2Signature):
+		return readProxyV2Header(r)
+	case bytes.HasPrefix(b, proxyV1Prefix):
+		return readProxyV1Header(r)
+	}
+
+	return nil, errNoProxyHeader
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		return nil, nil
+	case len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6"):
+		return nil, errInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+
+	if versionCommand>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	switch versionCommand & 0xf {
+	case 0x0:
+		// LOCAL: health checks and the like from the load balancer itself
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	// The payload holds the source and destination addresses, then the
+	// source and destination ports
+	switch family >> 4 {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+
+	// Unix sockets and unspecified families carry no usable address
+	return nil, nil
+}
@@ -33,6 +33,8 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -42,17 +44,21 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // A conn represents the server side of an HTTP connection.
 type conn struct {
-	remoteAddr string            // network address of remote side
-	server     *Server           // the Server on which the connection arrived
-	rwc        net.Conn          // i/o connection
-	lr         *io.LimitedReader // io.LimitReader(rwc)
-	buf        *bufio.ReadWriter // buffered(lr,rwc), reading from bufio->limitReader->rwc
-	hijacked   bool              // connection has been hijacked by handler
+	remoteAddr string               // network address of remote side
+	server     *Server              // the Server on which the connection arrived
+	rwc        net.Conn             // i/o connection
+	lr         *io.LimitedReader    // io.LimitReader(rwc)
+	buf        *bufio.ReadWriter    // buffered(lr,rwc), reading from bufio->limitReader->rwc
+	hijacked   bool                 // connection has been hijacked by handler
+	tlsConfig  *tls.Config          // TLS is served on rwc if set
+	tlsState   *tls.ConnectionState // or nil when not using TLS
 }
 
 type request struct {
@@ -143,16 +149,22 @@ func (w *response) ReadFrom(src io.Reader) (n int64, err error) {
 const noLimit int64 = (1 << 63) - 1
 
 // Create new connection from rwc.
-func (srv *Server) newConn(rwc net.Conn) (c *conn, err error) {
+func (srv *Server) newConn(rwc net.Conn, tlsConfig *tls.Config) (c *conn, err error) {
 	c = new(conn)
-	c.remoteAddr = rwc.RemoteAddr().String()
 	c.server = srv
+	c.tlsConfig = tlsConfig
+	c.setConn(rwc)
+	return c, nil
+}
+
+// setConn makes rwc the connection that c is served on.
+func (c *conn) setConn(rwc net.Conn) {
+	c.remoteAddr = rwc.RemoteAddr().String()
 	c.rwc = rwc
 	c.lr = io.LimitReader(rwc, noLimit).(*io.LimitedReader)
 	br := bufio.NewReader(c.lr)
 	bw := bufio.NewWriter(rwc)
 	c.buf = bufio.NewReadWriter(br, bw)
-	return c, nil
 }
 
 // DefaultMaxHeaderBytes is the maximum permitted size of the headers
@@ -200,12 +212,27 @@ const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
 var errTooLarge = errors.New("http: request too large")
 
+// errNoRequest is returned by readRequest when the client closes the
+// connection or leaves it idle until the read deadline instead of starting
+// another request.
+var errNoRequest = errors.New("http: no request")
+
 // Read next request from connection.
 func (c *conn) readRequest() (r *request, w *response, err error) {
 	if c.hijacked {
 		return nil, nil, http.ErrHijacked
 	}
 	c.lr.N = int64(c.server.maxHeaderBytes()) + 4096 /* bufio slop */
+	if _, err = c.buf.Peek(1); err != nil {
+		return nil, nil, errNoRequest
+	}
+
+	// Once the client started the request it has the header timeout to
+	// finish the headers
+	t0 := time.Now()
+	if d := c.server.readHeaderTimeout(); d != 0 {
+		c.rwc.SetReadDeadline(t0.Add(d))
+	}
 	var req *http.Request
 	if req, err = http.ReadRequest(c.buf.Reader); err != nil {
 		if c.lr.N == 0 {
@@ -215,7 +242,14 @@ func (c *conn) readRequest() (r *request, w *response, err error) {
 	}
 	c.lr.N = noLimit
 
+	// The body has until the read timeout, counting from the start of the
+	// request
+	if c.server.ReadHeaderTimeout != 0 || c.server.ReadTimeout != 0 {
+		c.rwc.SetReadDeadline(deadline(t0, c.server.ReadTimeout))
+	}
+
 	req.RemoteAddr = c.remoteAddr
+	req.TLS = c.tlsState
 
 	w = new(response)
 	w.conn = c
@@ -291,6 +325,11 @@ func (w *response) WriteHeader(code int) {
 		w.closeAfterReply = true
 	}
 
+	// Clients are told not to reuse connections once shutting down
+	if w.conn.server.isShuttingDown() {
+		w.closeAfterReply = true
+	}
+
 	if code == http.StatusNotModified || code == http.StatusNoContent {
 		// Must not have body.
 		for _, header := range []string{"Content-Type", "Content-Length", "Transfer-Encoding"} {
@@ -356,7 +395,7 @@ func (w *response) WriteHeader(code int) {
 		text = "status code " + codestring
 	}
 	io.WriteString(w.conn.buf, proto+" "+codestring+" "+text+"\r\n")
-	w.header.Write(w.conn.buf)
+	w.header.WriteSubset(w.conn.buf, w.trailerKeys())
 	io.WriteString(w.conn.buf, "\r\n")
 }
 
@@ -430,6 +469,7 @@ func (r *request) finishRequest() {
 	if w.chunking {
 		io.WriteString(w.conn.buf, "0\r\n")
 		// trailer key/value pairs, followed by blank line
+		w.trailer().Write(w.conn.buf)
 		io.WriteString(w.conn.buf, "\r\n")
 	}
 	w.conn.buf.Flush()
@@ -448,6 +488,26 @@ func (r *request) finishRequest() {
 	}
 }
 
+// Handlers set trailers through header keys prefixed with http.TrailerPrefix,
+// which are only sent at the end of a chunked response.
+func (w *response) trailerKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for k := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+func (w *response) trailer() http.Header {
+	trailer := make(http.Header)
+	for k := range w.trailerKeys() {
+		trailer[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = w.header[k]
+	}
+	return trailer
+}
+
 func (w *response) Flush() {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
@@ -485,23 +545,74 @@ func (c *conn) serve() {
 		}
 	}()
 
-	for {
+	if c.server.ProxyProtocol != nil {
+		rwc, err := c.server.ProxyProtocol.accept(c.rwc)
+		if err != nil {
+			log.Printf("http: rejecting connection from %s: %v", c.remoteAddr, err)
+			c.close()
+			return
+		}
+		c.setConn(rwc)
+	}
+
+	if d := c.server.readHeaderTimeout(); d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	}
+	if c.server.WriteTimeout != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+	}
+
+	if c.tlsConfig != nil {
+		c.setConn(tls.Server(c.rwc, c.tlsConfig))
+	}
+
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if c.server.TLSHandshakeCallback != nil {
+			state := tlsConn.ConnectionState()
+			c.server.TLSHandshakeCallback(state, err)
+		}
+		if err != nil {
+			c.close()
+			return
+		}
+		c.tlsState = new(tls.ConnectionState)
+		*c.tlsState = tlsConn.ConnectionState()
+
+		// Only offered through ALPN if the listener is configured for it
+		if c.tlsState.NegotiatedProtocol == "h2" {
+			c.handOverHTTP2(c.rwc)
+			return
+		}
+	} else if c.server.H2C && isHTTP2Preface(c.buf.Reader) {
+		c.handOverHTTP2(&bufferedConn{Conn: c.rwc, r: c.buf.Reader})
+		return
+	}
+
+	for requests := 0; ; requests++ {
+		if requests > 0 {
+			c.rwc.SetReadDeadline(deadline(time.Now(), c.server.idleTimeout()))
+		}
+
 		req, w, err := c.readRequest()
 		if err != nil {
-			msg := "400 Bad Request"
-			if err == errTooLarge {
+			code := http.StatusBadRequest
+			if err == errNoRequest {
+				break // Don't reply
+			} else if err == errTooLarge {
 				// Their HTTP client may or may not be
 				// able to read this if we're
 				// responding to them and hanging up
 				// while they're still writing their
 				// request.  Undefined behavior.
-				msg = "413 Request Entity Too Large"
+				code = http.StatusRequestHeaderFieldsTooLarge
 			} else if err == io.EOF {
 				break // Don't reply
 			} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				break // Don't reply
+				code = http.StatusRequestTimeout
 			}
-			fmt.Fprintf(c.rwc, "HTTP/1.1 %s\r\n\r\n", msg)
+			c.server.requestRejected(code)
+			fmt.Fprintf(c.rwc, "HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code))
 			break
 		}
 
@@ -525,17 +636,12 @@ func (c *conn) serve() {
 			break
 		}
 
-		handler := c.server.Handler
-		if handler == nil {
-			handler = http.DefaultServeMux
-		}
-
 		// HTTP cannot have multiple simultaneous active requests.[*]
 		// Until the server replies to this request, it can't read another,
 		// so we might as well run the handler in this goroutine.
 		// [*] Not strictly true: HTTP pipelining.  We could let them all process
 		// in parallel even if their responses need to be serialized.
-		handler.ServeHTTP(w, req.Request)
+		c.server.serveRequest(w, req.Request)
 		if c.hijacked {
 			return
 		}
@@ -547,6 +653,17 @@ func (c *conn) serve() {
 	c.close()
 }
 
+// handOverHTTP2 passes the connection on to be served as HTTP/2, after which
+// it no longer belongs to c.
+func (c *conn) handOverHTTP2(rwc net.Conn) {
+	// net/http sets its own deadlines
+	rwc.SetDeadline(time.Time{})
+
+	c.rwc = nil
+	c.buf = nil
+	c.server.serveHTTP2(rwc)
+}
+
 // Hijack implements the Hijacker.Hijack method. Our response is both a ResponseWriter
 // and a Hijacker.
 func (w *response) Hijack() (rwc net.Conn, buf *bufio.ReadWriter, err error) {
@@ -556,6 +673,11 @@ func (w *response) Hijack() (rwc net.Conn, buf *bufio.ReadWriter, err error) {
 	w.conn.hijacked = true
 	rwc = w.conn.rwc
 	buf = w.conn.buf
+
+	// Hijacked connections, such as WebSocket sessions, last as long as
+	// their new owner wants
+	rwc.SetDeadline(time.Time{})
+
 	w.conn.rwc = nil
 	w.conn.buf = nil
 	return
@@ -568,17 +690,182 @@ type Server struct {
 	ReadTimeout    time.Duration // maximum duration before timing out read of the request
 	WriteTimeout   time.Duration // maximum duration before timing out write of the response
 	MaxHeaderBytes int           // maximum size of request headers, DefaultMaxHeaderBytes if 0
+
+	// ReadHeaderTimeout is how long clients have to send the headers of a
+	// request once they started it, and to open the connection; ReadTimeout
+	// is used if zero. IdleTimeout is how long a kept-alive connection waits
+	// for the next request; ReadTimeout is used if zero.
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+
+	// RequestRejectedCallback, if set, is called with the status code of
+	// every request the server answers itself without calling the handler,
+	// such as when the request headers are too large or too slow to arrive.
+	RequestRejectedCallback func(status int)
+
+	// TLSHandshakeCallback, if set, is called with the outcome of the
+	// handshake of every connection accepted from a TLS listener.
+	TLSHandshakeCallback func(state tls.ConnectionState, err error)
+
+	// ProxyProtocol, if set, makes Serve read the client's address from the
+	// PROXY protocol header that accepted connections start with.
+	ProxyProtocol *ProxyProtocol
+
+	// H2C enables HTTP/2 without TLS for clients that open the connection
+	// with the HTTP/2 preface. HTTP/2 over TLS is served whenever a listener
+	// offers it through ALPN.
+	H2C bool
+
+	http2Once     sync.Once
+	http2Listener *http2Listener
+	http2Server   *http.Server
+
+	mu           sync.Mutex
+	listeners    map[net.Listener]bool
+	shuttingDown bool
+	done         chan struct{} // closed on shutdown
+
+	activeRequests int64 // accessed atomically
+}
+
+// ErrServerClosed is returned by Serve after the server was shut down.
+var ErrServerClosed = errors.New("http: Server closed")
+
+func (srv *Server) handler() http.Handler {
+	if srv.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return srv.Handler
+}
+
+// serveRequest calls the handler, counting the request as active until it
+// returns, which for hijacked connections is when they are done with.
+func (srv *Server) serveRequest(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&srv.activeRequests, 1)
+	defer atomic.AddInt64(&srv.activeRequests, -1)
+
+	srv.handler().ServeHTTP(w, r)
+}
+
+func (srv *Server) initDone() chan struct{} {
+	if srv.done == nil {
+		srv.done = make(chan struct{})
+	}
+	return srv.done
+}
+
+func (srv *Server) trackListener(l net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.shuttingDown {
+		return false
+	}
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+	}
+	srv.listeners[l] = true
+	return true
+}
+
+func (srv *Server) readHeaderTimeout() time.Duration {
+	if srv.ReadHeaderTimeout != 0 {
+		return srv.ReadHeaderTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout != 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) requestRejected(status int) {
+	if srv.RequestRejectedCallback != nil {
+		srv.RequestRejectedCallback(status)
+	}
 }
 
+// deadline returns the deadline for a timeout starting at t, which is none
+// for a zero timeout.
+func deadline(t time.Time, timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return t.Add(timeout)
+}
+
+func (srv *Server) isShuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.shuttingDown
+}
+
+// Shutdown stops accepting connections on all listeners being served and
+// waits up to timeout for the requests being handled to finish, including
+// hijacked connections. It reports whether they all finished in time.
+func (srv *Server) Shutdown(timeout time.Duration) bool {
+	srv.mu.Lock()
+	if !srv.shuttingDown {
+		srv.shuttingDown = true
+		close(srv.initDone())
+
+		for l := range srv.listeners {
+			l.Close()
+		}
+
+		if srv.http2Server != nil {
+			// Sends GOAWAY on HTTP/2 connections once their streams are done
+			go srv.http2Server.Shutdown(context.Background())
+		}
+	}
+	srv.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&srv.activeRequests) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+
+	return true
+}
+
+const shutdownPollInterval = 50 * time.Millisecond
+
 // Serve accepts incoming connections on the Listener l, creating a
 // new service thread for each.  The service threads read requests and
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
+	return srv.serve(l, nil)
+}
+
+// ServeTLS is like Serve, but serves TLS with the given configuration on the
+// connections accepted from l. Unlike with a TLS listener, the PROXY protocol
+// header can be read ahead of the handshake.
+func (srv *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	return srv.serve(l, config)
+}
+
+func (srv *Server) serve(l net.Listener, tlsConfig *tls.Config) error {
 	defer l.Close()
+
+	if !srv.trackListener(l) {
+		return ErrServerClosed
+	}
+
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		rw, e := l.Accept()
 		if e != nil {
+			if srv.isShuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -595,13 +882,7 @@ func (srv *Server) Serve(l net.Listener) error {
 			return e
 		}
 		tempDelay = 0
-		if srv.ReadTimeout != 0 {
-			rw.SetReadDeadline(time.Now().Add(srv.ReadTimeout))
-		}
-		if srv.WriteTimeout != 0 {
-			rw.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
-		}
-		c, err := srv.newConn(rw)
+		c, err := srv.newConn(rw, tlsConfig)
 		if err != nil {
 			continue
 		}
@@ -9,6 +9,7 @@ package server_test
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,6 +29,7 @@ import (
 
 	"github.com/cloudfoundry/gorouter/server"
 	"github.com/cloudfoundry/gorouter/server/httptest"
+	"github.com/cloudfoundry/gorouter/test_util"
 )
 
 type dummyAddr string
@@ -640,6 +642,352 @@ func TestTLSHandshakeTimeout(t *testing.T) {
 	})
 }
 
+func TestTLSConnectionState(t *testing.T) {
+	cert := test_util.CreateTLSCertificate("example.com")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	handshakes := make(chan error, 2)
+	s := &server.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || r.TLS.ServerName != "example.com" {
+				t.Errorf("TLS = %#v; want state with server name example.com", r.TLS)
+			}
+		}),
+		TLSHandshakeCallback: func(state tls.ConnectionState, err error) {
+			handshakes <- err
+		},
+	}
+	go s.Serve(ln)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status = %d; want 200", res.StatusCode)
+	}
+	conn.Close()
+
+	if err := <-handshakes; err != nil {
+		t.Errorf("handshake error = %v; want nil", err)
+	}
+
+	plain, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	fmt.Fprintf(plain, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	defer plain.Close()
+
+	if err := <-handshakes; err == nil {
+		t.Errorf("handshake error = nil; want an error for a plain HTTP request")
+	}
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	cert := test_util.CreateTLSCertificate("example.com")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	s := &server.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil {
+				t.Errorf("TLS = nil; want connection state")
+			}
+			fmt.Fprintf(w, "%s", r.Proto)
+		}),
+	}
+	go s.Serve(ln)
+
+	for _, protos := range []struct {
+		http1, http2 bool
+		want         string
+	}{
+		{false, true, "HTTP/2.0"},
+		{true, false, "HTTP/1.1"},
+	} {
+		var p http.Protocols
+		p.SetHTTP1(protos.http1)
+		p.SetHTTP2(protos.http2)
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Protocols:       &p,
+		}}
+
+		res, err := client.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.Proto != protos.want || string(body) != protos.want {
+			t.Errorf("proto = %s, served as %q; want %s", res.Proto, body, protos.want)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s", r.Proto)
+	}))
+	ts.Config.H2C = true
+	ts.Start()
+	defer ts.Close()
+
+	var p http.Protocols
+	p.SetUnencryptedHTTP2(true)
+
+	client := &http.Client{Transport: &http.Transport{Protocols: &p}}
+
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.Proto != "HTTP/2.0" || string(body) != "HTTP/2.0" {
+		t.Errorf("proto = %s, served as %q; want HTTP/2.0", res.Proto, body)
+	}
+
+	// HTTP/1.x is still served
+	res, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("served as %q; want HTTP/1.1", body)
+	}
+}
+
+func TestChunkedResponseTrailers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(http.TrailerPrefix+"Early", "not in the header")
+		fmt.Fprintf(w, "I am a chunked response.")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if _, ok := res.Header[http.TrailerPrefix+"Early"]; ok {
+		t.Errorf("trailer sent in the header: %v", res.Header)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	want := http.Header{"Early": {"not in the header"}, "Grpc-Status": {"0"}}
+	if !reflect.DeepEqual(res.Trailer, want) {
+		t.Errorf("trailer = %v; want %v", res.Trailer, want)
+	}
+}
+
+// loopbackNets trusts the PROXY protocol headers sent by the tests.
+func loopbackNets() []*net.IPNet {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	return []*net.IPNet{loopback}
+}
+
+func serveProxyProtocol(t *testing.T, pp *server.ProxyProtocol, tlsConfig *tls.Config) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	s := &server.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s", r.RemoteAddr)
+		}),
+		ProxyProtocol: pp,
+	}
+	if tlsConfig != nil {
+		go s.ServeTLS(ln, tlsConfig)
+	} else {
+		go s.Serve(ln)
+	}
+
+	return ln
+}
+
+// proxyProtocolGet sends header ahead of a request and returns the remote
+// address the server saw, or an error if it did not respond.
+func proxyProtocolGet(ln net.Listener, header string) (string, error) {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", header)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestProxyProtocol(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // is noisy otherwise
+	defer log.SetOutput(os.Stderr)
+
+	ln := serveProxyProtocol(t, &server.ProxyProtocol{TrustedNets: loopbackNets()}, nil)
+	defer ln.Close()
+
+	v2 := "\r\n\r\n\x00\r\nQUIT\n" +
+		"\x21\x21\x00\x24" + // PROXY over TCP/IPv6, 36 bytes of addresses
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+		"\xc8\x22\x00\x50"
+	v2Local := "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"
+
+	for _, tt := range []struct {
+		header string
+		want   string
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n", "203.0.113.7:51234"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 51234 80\r\n", "[2001:db8::1]:51234"},
+		{v2, "[2001:db8::1]:51234"},
+		{"PROXY UNKNOWN\r\n", "127.0.0.1:"},
+		{v2Local, "127.0.0.1:"},
+		{"", "127.0.0.1:"},
+	} {
+		got, err := proxyProtocolGet(ln, tt.header)
+		if err != nil {
+			t.Errorf("header %q: %v", tt.header, err)
+		} else if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("header %q: remote address = %s; want %s", tt.header, got, tt.want)
+		}
+	}
+
+	for _, header := range []string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 51234 80\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\n",
+	} {
+		if got, err := proxyProtocolGet(ln, header); err == nil {
+			t.Errorf("header %q: served as %s; want the connection rejected", header, got)
+		}
+	}
+}
+
+func TestProxyProtocolRequired(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // is noisy otherwise
+	defer log.SetOutput(os.Stderr)
+
+	ln := serveProxyProtocol(t, &server.ProxyProtocol{Required: true, TrustedNets: loopbackNets()}, nil)
+	defer ln.Close()
+
+	if got, err := proxyProtocolGet(ln, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"); got != "203.0.113.7:51234" {
+		t.Errorf("remote address = %s, %v; want 203.0.113.7:51234", got, err)
+	}
+
+	if got, err := proxyProtocolGet(ln, ""); err == nil {
+		t.Errorf("served as %s without a header; want the connection rejected", got)
+	}
+}
+
+func TestProxyProtocolFromUntrustedAddress(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // is noisy otherwise
+	defer log.SetOutput(os.Stderr)
+
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	ln := serveProxyProtocol(t, &server.ProxyProtocol{TrustedNets: []*net.IPNet{trusted}}, nil)
+	defer ln.Close()
+
+	if got, err := proxyProtocolGet(ln, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"); err == nil {
+		t.Errorf("served as %s; want the header not to be accepted", got)
+	}
+
+	if got, err := proxyProtocolGet(ln, ""); err != nil || !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("remote address = %s, %v; want 127.0.0.1", got, err)
+	}
+
+	required := serveProxyProtocol(t, &server.ProxyProtocol{Required: true, TrustedNets: []*net.IPNet{trusted}}, nil)
+	defer required.Close()
+
+	if got, err := proxyProtocolGet(required, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"); err == nil {
+		t.Errorf("served as %s; want the connection rejected", got)
+	}
+}
+
+func TestProxyProtocolWithoutTrustedNets(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // is noisy otherwise
+	defer log.SetOutput(os.Stderr)
+
+	ln := serveProxyProtocol(t, &server.ProxyProtocol{}, nil)
+	defer ln.Close()
+
+	if got, err := proxyProtocolGet(ln, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"); err == nil {
+		t.Errorf("served as %s; want the header not to be accepted", got)
+	}
+
+	if got, err := proxyProtocolGet(ln, ""); err != nil || !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("remote address = %s, %v; want 127.0.0.1", got, err)
+	}
+}
+
+func TestProxyProtocolWithTLS(t *testing.T) {
+	cert := test_util.CreateTLSCertificate("example.com")
+
+	ln := serveProxyProtocol(t, &server.ProxyProtocol{Required: true, TrustedNets: loopbackNets()}, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n")
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "203.0.113.7:51234" {
+		t.Errorf("remote address = %s; want 203.0.113.7:51234", body)
+	}
+}
+
 type serverExpectTest struct {
 	contentLength    int    // of request body
 	expectation      string // e.g. "100-continue"
@@ -958,8 +1306,86 @@ func TestRequestLimit(t *testing.T) {
 		// we do support it (at least currently), so we expect a response below.
 		t.Fatalf("Do: %v", err)
 	}
-	if res.StatusCode != 413 {
-		t.Fatalf("expected 413 response status; got: %d %s", res.StatusCode, res.Status)
+	if res.StatusCode != 431 {
+		t.Fatalf("expected 431 response status; got: %d %s", res.StatusCode, res.Status)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	rejected := make(chan int, 1)
+
+	srv := &server.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("didn't expect to get request in Handler")
+		}),
+		ReadHeaderTimeout:       100 * time.Millisecond,
+		RequestRejectedCallback: func(status int) { rejected <- status },
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: foo\r\n")
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusRequestTimeout)
+	}
+	if status := <-rejected; status != http.StatusRequestTimeout {
+		t.Errorf("rejected status = %d, want %d", status, http.StatusRequestTimeout)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := &server.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+		ReadHeaderTimeout: time.Second,
+		IdleTimeout:       100 * time.Millisecond,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+
+	t1 := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("ReadByte = %v, want EOF", err)
+	}
+	if latency := time.Since(t1); latency > 900*time.Millisecond {
+		t.Errorf("idle connection closed after %s, want about 100ms", latency)
 	}
 }
 
@@ -1188,3 +1614,111 @@ func BenchmarkClientServer(b *testing.B) {
 
 	b.StopTimer()
 }
+
+func TestShutdown(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	srv := &server.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-release
+			io.WriteString(w, "done")
+		}),
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+	<-started
+
+	shutdown := make(chan bool, 1)
+	go func() { shutdown <- srv.Shutdown(5 * time.Second) }()
+
+	select {
+	case err := <-served:
+		if err != server.ErrServerClosed {
+			t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("new connection accepted while shutting down")
+	}
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "done" {
+		t.Errorf("body = %q, want %q", body, "done")
+	}
+	if !res.Close {
+		t.Error("response to request in flight does not close the connection")
+	}
+
+	select {
+	case ok := <-shutdown:
+		if !ok {
+			t.Error("Shutdown reported requests left over")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+
+	srv := &server.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-release
+		}),
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+	<-started
+
+	if srv.Shutdown(100 * time.Millisecond) {
+		t.Error("Shutdown did not time out with a request in flight")
+	}
+}
@@ -0,0 +1,130 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/log"
+	"github.com/cloudfoundry/gorouter/proxy"
+)
+
+const (
+	maxBatchSize = 100
+	maxQueued    = 10000
+)
+
+// ZipkinExporter sends spans in batches to a Zipkin collector, in the JSON
+// format of its v2 API.
+type ZipkinExporter struct {
+	url           string
+	localEndpoint zipkinEndpoint
+	interval      time.Duration
+	client        *http.Client
+
+	spans chan proxy.Span
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+	Ipv4        string `json:"ipv4,omitempty"`
+}
+
+type zipkinSpan struct {
+	TraceId       string            `json:"traceId"`
+	Id            string            `json:"id"`
+	ParentId      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+func NewZipkinExporter(c *config.Config) *ZipkinExporter {
+	return &ZipkinExporter{
+		url: c.Tracing.ZipkinUrl,
+		localEndpoint: zipkinEndpoint{
+			ServiceName: c.Tracing.ServiceName,
+			Ipv4:        c.Ip,
+		},
+		interval: time.Second,
+		client:   &http.Client{Timeout: 5 * time.Second},
+
+		spans: make(chan proxy.Span, maxQueued),
+	}
+}
+
+// Start sends the exported spans every interval, or as soon as there are
+// enough for a batch, until the process exits.
+func (e *ZipkinExporter) Start() {
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		var batch []zipkinSpan
+
+		for {
+			select {
+			case span := <-e.spans:
+				batch = append(batch, e.zipkinSpan(span))
+				if len(batch) < maxBatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+
+			e.send(batch)
+			batch = nil
+		}
+	}()
+}
+
+// Export queues the span for the next batch. Spans are dropped while the
+// collector cannot keep up, rather than holding up requests.
+func (e *ZipkinExporter) Export(span proxy.Span) {
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+func (e *ZipkinExporter) zipkinSpan(span proxy.Span) zipkinSpan {
+	return zipkinSpan{
+		TraceId:       span.TraceId,
+		Id:            span.Id,
+		ParentId:      span.ParentId,
+		Name:          span.Name,
+		Kind:          "SERVER",
+		Timestamp:     span.Start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(span.Duration / time.Microsecond),
+		LocalEndpoint: e.localEndpoint,
+		Tags:          span.Tags,
+	}
+}
+
+func (e *ZipkinExporter) send(batch []zipkinSpan) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Warnf("tracing: encoding spans failed: %s", err)
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("tracing: sending spans to %s failed: %s", e.url, err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Warnf("tracing: sending spans to %s failed: %s", e.url, resp.Status)
+	}
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/proxy"
+)
+
+type ZipkinExporterSuite struct {
+	server   *httptest.Server
+	batches  chan []map[string]interface{}
+	exporter *ZipkinExporter
+}
+
+var _ = Suite(&ZipkinExporterSuite{})
+
+func (s *ZipkinExporterSuite) SetUpTest(c *C) {
+	s.batches = make(chan []map[string]interface{}, 10)
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "POST")
+		c.Check(r.URL.Path, Equals, "/api/v2/spans")
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+
+		var batch []map[string]interface{}
+		c.Check(json.NewDecoder(r.Body).Decode(&batch), IsNil)
+		s.batches <- batch
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	conf := config.DefaultConfig()
+	conf.Tracing.ZipkinUrl = s.server.URL + "/api/v2/spans"
+	conf.Ip = "10.0.0.1"
+
+	s.exporter = NewZipkinExporter(conf)
+	s.exporter.interval = 10 * time.Millisecond
+}
+
+func (s *ZipkinExporterSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *ZipkinExporterSuite) TestSendsSpans(c *C) {
+	s.exporter.Start()
+
+	start := time.Unix(1500000000, 0)
+	s.exporter.Export(proxy.Span{
+		TraceId:  "4bf92f3577b34da6a3ce929d0e0e4736",
+		Id:       "00f067aa0ba902b7",
+		ParentId: "e457b5a2e4d86bd1",
+		Name:     "get",
+		Start:    start,
+		Duration: 1500 * time.Microsecond,
+		Tags:     map[string]string{"http.status_code": "200"},
+	})
+
+	var batch []map[string]interface{}
+	select {
+	case batch = <-s.batches:
+	case <-time.After(time.Second):
+		c.Fatal("no spans were sent")
+	}
+
+	c.Assert(batch, HasLen, 1)
+
+	span := batch[0]
+	c.Check(span["traceId"], Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(span["id"], Equals, "00f067aa0ba902b7")
+	c.Check(span["parentId"], Equals, "e457b5a2e4d86bd1")
+	c.Check(span["name"], Equals, "get")
+	c.Check(span["kind"], Equals, "SERVER")
+	c.Check(span["timestamp"], Equals, 1500000000000000.0)
+	c.Check(span["duration"], Equals, 1500.0)
+	c.Check(span["localEndpoint"], DeepEquals, map[string]interface{}{"serviceName": "gorouter", "ipv4": "10.0.0.1"})
+	c.Check(span["tags"], DeepEquals, map[string]interface{}{"http.status_code": "200"})
+}
+
+func (s *ZipkinExporterSuite) TestDropsSpansWhenQueueIsFull(c *C) {
+	// Not started, so nothing is taken off the queue
+	for i := 0; i < maxQueued+10; i++ {
+		s.exporter.Export(proxy.Span{Name: "get"})
+	}
+
+	c.Check(len(s.exporter.spans), Equals, maxQueued)
+}
@@ -1,9 +1,11 @@
 package varz
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -25,13 +27,27 @@ type varz struct {
 		Component TaggedHttpMetric `json:"component"`
 	} `json:"tags"`
 
-	Urls     int `json:"urls"`
-	Droplets int `json:"droplets"`
+	Urls               int `json:"urls"`
+	Droplets           int `json:"droplets"`
+	UnhealthyEndpoints int `json:"unhealthy_endpoints"`
+	OpenCircuits       int `json:"open_circuits"`
 
 	BadRequests    int     `json:"bad_requests"`
 	BadGateways    int     `json:"bad_gateways"`
+	Retries        int     `json:"retries"`
+	Ejections      int     `json:"ejections"`
+	RateLimited    int     `json:"rate_limited_requests"`
+	CacheHits      int     `json:"cache_hits"`
+	CacheMisses    int     `json:"cache_misses"`
+	CacheEvictions int     `json:"cache_evictions"`
 	RequestsPerSec float64 `json:"requests_per_sec"`
 
+	// Requests refused for being too slow or too large, by status code
+	RejectedRequests map[string]int `json:"rejected_requests"`
+
+	TLSHandshakeErrors int            `json:"tls_handshake_errors"`
+	TLSVersions        map[string]int `json:"tls_versions"`
+
 	TopApps []topAppsEntry `json:"top10_app_requests"`
 
 	MillisSinceLastRegistryUpdate int64 `json:"ms_since_last_registry_update"`
@@ -164,6 +180,14 @@ type Varz interface {
 
 	CaptureBadRequest(req *http.Request)
 	CaptureBadGateway(req *http.Request)
+	CaptureRetry(b *route.Endpoint, req *http.Request)
+	CaptureEndpointEjection(b *route.Endpoint)
+	CaptureRateLimited(b *route.Endpoint, req *http.Request)
+	CaptureRejectedRequest(status int)
+	CaptureCacheHit(b *route.Endpoint, req *http.Request)
+	CaptureCacheMiss(b *route.Endpoint, req *http.Request)
+	CaptureCacheEviction()
+	CaptureTLSHandshake(state tls.ConnectionState, err error)
 	CaptureRoutingRequest(b *route.Endpoint, req *http.Request)
 	CaptureRoutingResponse(b *route.Endpoint, res *http.Response, startedAt time.Time, d time.Duration)
 }
@@ -184,6 +208,8 @@ func NewVarz(r *registry.CFRegistry) Varz {
 
 	x.All = NewHttpMetric()
 	x.Tags.Component = make(map[string]*HttpMetric)
+	x.TLSVersions = make(map[string]int)
+	x.RejectedRequests = make(map[string]int)
 
 	return x
 }
@@ -194,6 +220,8 @@ func (x *RealVarz) MarshalJSON() ([]byte, error) {
 
 	x.varz.Urls = x.r.NumUris()
 	x.varz.Droplets = x.r.NumEndpoints()
+	x.varz.UnhealthyEndpoints = x.r.NumUnhealthyEndpoints()
+	x.varz.OpenCircuits = x.r.NumOpenCircuits()
 
 	x.varz.RequestsPerSec = x.varz.All.Rate.Rate1()
 	millis_per_nano := int64(1000000)
@@ -241,6 +269,67 @@ func (x *RealVarz) CaptureBadGateway(req *http.Request) {
 	x.BadGateways++
 }
 
+func (x *RealVarz) CaptureRetry(b *route.Endpoint, req *http.Request) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.Retries++
+}
+
+func (x *RealVarz) CaptureEndpointEjection(b *route.Endpoint) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.Ejections++
+}
+
+func (x *RealVarz) CaptureRateLimited(b *route.Endpoint, req *http.Request) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.RateLimited++
+}
+
+func (x *RealVarz) CaptureRejectedRequest(status int) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.RejectedRequests[strconv.Itoa(status)]++
+}
+
+func (x *RealVarz) CaptureCacheHit(b *route.Endpoint, req *http.Request) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.CacheHits++
+}
+
+func (x *RealVarz) CaptureCacheMiss(b *route.Endpoint, req *http.Request) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.CacheMisses++
+}
+
+func (x *RealVarz) CaptureCacheEviction() {
+	x.Lock()
+	defer x.Unlock()
+
+	x.CacheEvictions++
+}
+
+func (x *RealVarz) CaptureTLSHandshake(state tls.ConnectionState, err error) {
+	x.Lock()
+	defer x.Unlock()
+
+	if err != nil {
+		x.TLSHandshakeErrors++
+		return
+	}
+
+	x.TLSVersions[tls.VersionName(state.Version)]++
+}
+
 func (x *RealVarz) CaptureAppStats(b *route.Endpoint, t time.Time) {
 	if b.ApplicationId != "" {
 		x.activeApps.Mark(b.ApplicationId, t)
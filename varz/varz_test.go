@@ -1,7 +1,9 @@
 package varz
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -77,9 +79,20 @@ func (s *VarzSuite) TestMembersOfUniqueVarz(c *C) {
 		"tags",
 		"urls",
 		"droplets",
+		"unhealthy_endpoints",
+		"open_circuits",
 		"requests",
 		"bad_requests",
 		"bad_gateways",
+		"retries",
+		"ejections",
+		"rate_limited_requests",
+		"rejected_requests",
+		"cache_hits",
+		"cache_misses",
+		"cache_evictions",
+		"tls_handshake_errors",
+		"tls_versions",
 		"requests_per_sec",
 		"top10_app_requests",
 		"ms_since_last_registry_update",
@@ -127,6 +140,44 @@ func (s *VarzSuite) TestUrlsInVarz(c *C) {
 	c.Check(s.findValue("urls"), Equals, float64(2))
 }
 
+func (s *VarzSuite) TestUnhealthyEndpointsInVarz(c *C) {
+	c.Check(s.findValue("unhealthy_endpoints"), Equals, float64(0))
+
+	s.Registry.Register("foo.vcap.me", &route.Endpoint{Host: "192.168.1.1", Port: 1234})
+	s.Registry.Register("bar.vcap.me", &route.Endpoint{Host: "192.168.1.2", Port: 1234})
+
+	for _, e := range s.Registry.Endpoints() {
+		if e.Host == "192.168.1.1" {
+			e.SetHealthy(false)
+		}
+	}
+
+	c.Check(s.findValue("unhealthy_endpoints"), Equals, float64(1))
+}
+
+func (s *VarzSuite) TestOpenCircuitsInVarz(c *C) {
+	conf := config.DefaultConfig()
+	conf.CircuitBreaker.TimeoutPercent = 20
+	conf.CircuitBreaker.MaxOpenPercent = 100
+	s.Registry = registry.NewCFRegistry(conf, fakeyagnats.New())
+	s.Varz = NewVarz(s.Registry)
+
+	c.Check(s.findValue("open_circuits"), Equals, float64(0))
+
+	s.Registry.Register("foo.vcap.me", &route.Endpoint{Host: "192.168.1.1", Port: 1234})
+	s.Registry.Register("bar.vcap.me", &route.Endpoint{Host: "192.168.1.2", Port: 1234})
+
+	for _, e := range s.Registry.Endpoints() {
+		if e.Host == "192.168.1.1" {
+			for i := 0; i < 20; i++ {
+				e.RequestTimedOut(time.Now())
+			}
+		}
+	}
+
+	c.Check(s.findValue("open_circuits"), Equals, float64(1))
+}
+
 func (s *VarzSuite) TestUpdateBadRequests(c *C) {
 	r := http.Request{}
 
@@ -147,6 +198,72 @@ func (s *VarzSuite) TestUpdateBadGateways(c *C) {
 	c.Check(s.findValue("bad_gateways"), Equals, float64(2))
 }
 
+func (s *VarzSuite) TestUpdateRetries(c *C) {
+	b := &route.Endpoint{}
+	r := &http.Request{}
+
+	s.CaptureRetry(b, r)
+	c.Check(s.findValue("retries"), Equals, float64(1))
+
+	s.CaptureRetry(b, r)
+	c.Check(s.findValue("retries"), Equals, float64(2))
+}
+
+func (s *VarzSuite) TestUpdateEjections(c *C) {
+	b := &route.Endpoint{}
+
+	s.CaptureEndpointEjection(b)
+	c.Check(s.findValue("ejections"), Equals, float64(1))
+
+	s.CaptureEndpointEjection(b)
+	c.Check(s.findValue("ejections"), Equals, float64(2))
+}
+
+func (s *VarzSuite) TestUpdateRateLimited(c *C) {
+	b := &route.Endpoint{}
+	r := &http.Request{}
+
+	s.CaptureRateLimited(b, r)
+	c.Check(s.findValue("rate_limited_requests"), Equals, float64(1))
+
+	s.CaptureRateLimited(b, r)
+	c.Check(s.findValue("rate_limited_requests"), Equals, float64(2))
+}
+
+func (s *VarzSuite) TestUpdateRejectedRequests(c *C) {
+	s.CaptureRejectedRequest(http.StatusRequestTimeout)
+	s.CaptureRejectedRequest(http.StatusRequestEntityTooLarge)
+	s.CaptureRejectedRequest(http.StatusRequestEntityTooLarge)
+
+	c.Check(s.findValue("rejected_requests", "408"), Equals, float64(1))
+	c.Check(s.findValue("rejected_requests", "413"), Equals, float64(2))
+}
+
+func (s *VarzSuite) TestUpdateCacheCounts(c *C) {
+	b := &route.Endpoint{}
+	r := &http.Request{}
+
+	s.CaptureCacheHit(b, r)
+	s.CaptureCacheHit(b, r)
+	s.CaptureCacheMiss(b, r)
+	s.CaptureCacheEviction()
+
+	c.Check(s.findValue("cache_hits"), Equals, float64(2))
+	c.Check(s.findValue("cache_misses"), Equals, float64(1))
+	c.Check(s.findValue("cache_evictions"), Equals, float64(1))
+}
+
+func (s *VarzSuite) TestUpdateTLSHandshakes(c *C) {
+	s.CaptureTLSHandshake(tls.ConnectionState{Version: tls.VersionTLS12}, nil)
+	s.CaptureTLSHandshake(tls.ConnectionState{Version: tls.VersionTLS13}, nil)
+	s.CaptureTLSHandshake(tls.ConnectionState{Version: tls.VersionTLS13}, nil)
+	s.CaptureTLSHandshake(tls.ConnectionState{}, errors.New("bad certificate"))
+
+	c.Check(s.findValue("tls_versions", "TLS 1.2"), Equals, float64(1))
+	c.Check(s.findValue("tls_versions", "TLS 1.3"), Equals, float64(2))
+	c.Check(s.findValue("tls_handshake_errors"), Equals, float64(1))
+}
+
 func (s *VarzSuite) TestUpdateRequests(c *C) {
 	b := &route.Endpoint{}
 	r := http.Request{}